@@ -0,0 +1,104 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torcx/internal/torcx"
+)
+
+var (
+	cmdApply = &cobra.Command{
+		Use:   "apply --dry-run | --live [--force]",
+		Short: "show or perform how the next profile would be applied",
+		Long: `Show how torcx-generator would apply profiles on next boot.
+Profiles are applied at boot-time by torcx-generator; with "--dry-run" the
+resulting plan is printed as JSON, without mounting or writing anything.
+
+With "--live", profiles are re-applied on the running system instead:
+images not in the next profile anymore are removed, new ones are applied,
+and systemd is reloaded. Images with active units are only removed with
+"--force", which stops those units first.`,
+		RunE: runApply,
+	}
+	flagApplyDryRun bool
+	flagApplyLive   bool
+	flagApplyForce  bool
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdApply)
+	cmdApply.Flags().BoolVar(&flagApplyDryRun, "dry-run", false, "only print the apply plan")
+	cmdApply.Flags().BoolVar(&flagApplyLive, "live", false, "re-apply profiles on the running system")
+	cmdApply.Flags().BoolVar(&flagApplyForce, "force", false, "with --live, stop active units of removed images")
+}
+
+func runApply(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+	if flagApplyDryRun == flagApplyLive {
+		return errors.New("exactly one of --dry-run or --live is required")
+	}
+	if flagApplyForce && !flagApplyLive {
+		return errors.New("--force is only supported with --live")
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+	applyCfg, err := fillApplyRuntime(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "apply configuration failed")
+	}
+
+	if flagApplyLive {
+		if err := torcx.ApplyProfileLive(applyCfg, flagApplyForce); err != nil {
+			return errors.Wrap(err, "live apply failed")
+		}
+		return nil
+	}
+
+	images, collisions, err := torcx.PlanProfile(applyCfg)
+	if err != nil {
+		return errors.Wrap(err, "planning failed")
+	}
+
+	lowerNames := []string{}
+	if len(applyCfg.LowerProfiles) > 0 {
+		lowerNames = applyCfg.LowerProfiles
+	}
+	planOut := ApplyPlan{
+		Kind: TorcxApplyPlanV0K,
+		Value: applyPlan{
+			LowerProfileNames: lowerNames,
+			UpperProfileName:  applyCfg.UpperProfile,
+			Images:            images,
+			Collisions:        collisions,
+		},
+	}
+
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	err = jsonOut.Encode(planOut)
+
+	return err
+}
@@ -17,6 +17,7 @@ package cli
 import (
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -31,14 +32,22 @@ import (
 func fillCommonRuntime(OsRelease string) (*torcx.CommonConfig, error) {
 	var err error
 
-	usrMountpoint := torcx.VendorUsrDir
+	// Alternate root directory, prefixed to all host paths below
+	root := viper.GetString("root")
+	if root != "" && !filepath.IsAbs(root) {
+		return nil, errors.Errorf("non-absolute root %q", root)
+	}
+	rootCfg := torcx.CommonConfig{Root: root}
+
+	usrMountpoint := rootCfg.RootPath(torcx.VendorUsrDir)
 	path, ok := viper.Get("USR_MOUNTPOINT").(string)
 	if ok && filepath.IsAbs(path) {
-		usrMountpoint = path
+		usrMountpoint = rootCfg.RootPath(path)
 	}
 
 	// Default common config settings
 	commonCfg := torcx.CommonConfig{
+		Root:    root,
 		BaseDir: torcx.DefaultBaseDir,
 		RunDir:  torcx.DefaultRunDir,
 		UsrDir:  usrMountpoint,
@@ -61,15 +70,23 @@ func fillCommonRuntime(OsRelease string) (*torcx.CommonConfig, error) {
 
 	// Add OEM store (versioned first)
 	if OsRelease != "" {
-		commonCfg.StorePaths = append(commonCfg.StorePaths, filepath.Join(torcx.OemStoreDir, OsRelease))
+		commonCfg.StorePaths = append(commonCfg.StorePaths, filepath.Join(commonCfg.RootPath(torcx.OemStoreDir), OsRelease))
 	}
-	commonCfg.StorePaths = append(commonCfg.StorePaths, torcx.OemStoreDir)
+	commonCfg.StorePaths = append(commonCfg.StorePaths, commonCfg.RootPath(torcx.OemStoreDir))
 
-	// Read common config from config file, if present
+	// Read common config from config file, if present.
+	// With an alternate root, the boot-time config location does not apply.
 	cfgPath := torcx.RuntimeConfigPath()
+	if root != "" {
+		cfgPath = commonCfg.RootPath(torcx.DefaultConfigPath)
+	}
+	builtinStores := len(commonCfg.StorePaths)
 	if err := torcx.ReadCommonConfig(cfgPath, &commonCfg); err != nil {
 		return nil, errors.Wrapf(err, "reading common config from %q", cfgPath)
 	}
+	for i := builtinStores; i < len(commonCfg.StorePaths); i++ {
+		commonCfg.StorePaths[i] = commonCfg.RootPath(commonCfg.StorePaths[i])
+	}
 
 	// Overrides from environment
 	if baseDir := viper.GetString("basedir"); baseDir != "" {
@@ -81,6 +98,30 @@ func fillCommonRuntime(OsRelease string) (*torcx.CommonConfig, error) {
 	if confdir := viper.GetString("confdir"); confdir != "" {
 		commonCfg.ConfDir = confdir
 	}
+	if policy := viper.GetString("collision_policy"); policy != "" {
+		commonCfg.CollisionPolicy = torcx.CollisionPolicy(policy)
+	}
+	if mode := viper.GetString("apply_mode"); mode != "" {
+		commonCfg.ApplyMode = torcx.ApplyMode(mode)
+	}
+	if target := viper.GetString("overlay_target"); target != "" {
+		commonCfg.OverlayTarget = target
+	}
+	if policy := viper.GetString("signature_policy"); policy != "" {
+		commonCfg.SignaturePolicy = torcx.SignaturePolicy(policy)
+	}
+	if cache := viper.GetString("unpack_cache"); cache != "" {
+		enabled, err := strconv.ParseBool(cache)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid unpack_cache %q", cache)
+		}
+		commonCfg.UnpackCache = enabled
+	}
+
+	// Read and written directories are all within the root
+	commonCfg.BaseDir = commonCfg.RootPath(commonCfg.BaseDir)
+	commonCfg.RunDir = commonCfg.RootPath(commonCfg.RunDir)
+	commonCfg.ConfDir = commonCfg.RootPath(commonCfg.ConfDir)
 
 	// Add user and runtime store paths (versioned first)
 	if OsRelease != "" {
@@ -88,14 +129,15 @@ func fillCommonRuntime(OsRelease string) (*torcx.CommonConfig, error) {
 	}
 	commonCfg.StorePaths = append(commonCfg.StorePaths, filepath.Join(commonCfg.BaseDir, "store"))
 	extraStorePaths := viper.GetStringSlice("storepath")
-	if extraStorePaths != nil {
-		commonCfg.StorePaths = append(commonCfg.StorePaths, extraStorePaths...)
+	for _, p := range extraStorePaths {
+		commonCfg.StorePaths = append(commonCfg.StorePaths, commonCfg.RootPath(p))
 	}
 
 	if err := torcx.ValidateCommonConfig(&commonCfg); err != nil {
 		return nil, errors.Wrap(err, "invalid common config")
 	}
 	logrus.WithFields(logrus.Fields{
+		"root":        commonCfg.Root,
 		"base_dir":    commonCfg.BaseDir,
 		"run_dir":     commonCfg.RunDir,
 		"conf_dir":    commonCfg.ConfDir,
@@ -127,6 +127,43 @@ func TestStorePaths(t *testing.T) {
 	}
 }
 
+func TestRootPaths(t *testing.T) {
+	if err := os.Setenv("TORCX_ROOT", "/sysroot"); err != nil {
+		t.Fatalf("failed to set env: %s", err)
+	}
+	defer os.Unsetenv("TORCX_ROOT")
+	viper.SetEnvPrefix("TORCX")
+	viper.AutomaticEnv()
+
+	cfg, err := fillCommonRuntime("999.9")
+	if err != nil {
+		t.Fatalf("expected no error, got %#v", err)
+	}
+
+	if cfg.BaseDir != "/sysroot/var/lib/torcx" {
+		t.Fatalf("wrong basedir: got %q", cfg.BaseDir)
+	}
+	if cfg.RunDir != "/sysroot/run/torcx" {
+		t.Fatalf("wrong rundir: got %q", cfg.RunDir)
+	}
+	if cfg.ConfDir != "/sysroot/etc/torcx" {
+		t.Fatalf("wrong confdir: got %q", cfg.ConfDir)
+	}
+	if cfg.SealFilePath() != "/sysroot/run/metadata/torcx" {
+		t.Fatalf("wrong seal path: got %q", cfg.SealFilePath())
+	}
+	expectedStorePaths := []string{
+		"/sysroot/usr/share/torcx/store",
+		"/sysroot/usr/share/oem/torcx/store/999.9",
+		"/sysroot/usr/share/oem/torcx/store",
+		"/sysroot/var/lib/torcx/store/999.9",
+		"/sysroot/var/lib/torcx/store",
+	}
+	if !reflect.DeepEqual(cfg.StorePaths, expectedStorePaths) {
+		t.Fatalf("wrong StorePaths, expected %q, got %q", expectedStorePaths, cfg.StorePaths)
+	}
+}
+
 func TestHasExpFeature(t *testing.T) {
 	tests := map[string]bool{
 		"a": true,
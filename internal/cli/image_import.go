@@ -0,0 +1,67 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"os"
+
+	"github.com/coreos/torcx/internal/torcx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdImageImport = &cobra.Command{
+		Use:   "import ARCHIVE",
+		Short: "import an image archive into the user store",
+		Long: `Import an image archive into the versioned user store.
+Its digest is recorded alongside, and verified before the image is applied.`,
+		RunE: runImageImport,
+	}
+	flagImageImportOsVersion string
+	flagImageImportDigest    string
+)
+
+func init() {
+	cmdImage.AddCommand(cmdImageImport)
+	cmdImageImport.Flags().StringVarP(&flagImageImportOsVersion, "os-release", "n", "", "override OS version")
+	cmdImageImport.Flags().StringVar(&flagImageImportDigest, "digest", "", "expected archive digest (e.g. sha512-...)")
+}
+
+func runImageImport(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return cmd.Usage()
+	}
+
+	commonCfg, err := fillCommonRuntime(flagImageImportOsVersion)
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	storePath := commonCfg.UserStorePath(flagImageImportOsVersion)
+	if err := os.MkdirAll(storePath, 0755); err != nil {
+		return err
+	}
+	path, err := torcx.ImportArchive(args[0], storePath, flagImageImportDigest)
+	if err != nil {
+		return errors.Wrapf(err, "failed to import %s", args[0])
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"path": path,
+	}).Info("image imported")
+	return nil
+}
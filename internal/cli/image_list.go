@@ -58,7 +58,7 @@ func runImageList(cmd *cobra.Command, args []string) error {
 
 	storePaths := commonCfg.StorePaths
 	if flagImageListOsVersion != "" {
-		osReleasePath := torcx.VendorOsReleasePath("/usr")
+		osReleasePath := torcx.VendorOsReleasePath(commonCfg.UsrDir)
 		osRelease, err := torcx.CurrentOsVersionID(osReleasePath)
 		if err != nil {
 			osRelease = ""
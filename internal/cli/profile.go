@@ -48,12 +48,12 @@ func fillProfileRuntime(commonCfg *torcx.CommonConfig) (*torcx.ProfileConfig, er
 		return nil, errors.New("missing common configuration")
 	}
 
-	upn, lpn, err := torcx.CurrentProfileNames()
+	upn, lpn, err := commonCfg.CurrentProfileNames()
 	if err == nil {
 		lowerProfileNames = lpn
 		upperProfileName = upn
 	}
-	cpp, err := torcx.CurrentProfilePath()
+	cpp, err := commonCfg.CurrentProfilePath()
 	if err == nil {
 		curProfilePath = cpp
 	}
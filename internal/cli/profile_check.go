@@ -118,8 +118,13 @@ func runProfileCheck(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	trust, err := torcx.LoadStoreTrust(commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "loading store trust")
+	}
 
 	missing := false
+	untrusted := false
 	for _, im := range profile {
 		if remoteOnly && im.Remote == "" {
 			logrus.WithFields(logrus.Fields{
@@ -137,6 +142,14 @@ func runProfileCheck(cmd *cobra.Command, args []string) error {
 				"reference": im.Reference,
 				"remote":    im.Remote,
 			}).Error("image/reference not found")
+		} else if _, err := trust.VerifyArchive(ar); err != nil {
+			untrusted = true
+			logrus.WithFields(logrus.Fields{
+				"name":         im.Name,
+				"reference":    im.Reference,
+				"archive path": ar.Filepath,
+				"remote":       im.Remote,
+			}).Error("image/reference not trusted: ", err)
 		} else {
 			logrus.WithFields(logrus.Fields{
 				"name":         im.Name,
@@ -150,6 +163,59 @@ func runProfileCheck(cmd *cobra.Command, args []string) error {
 	if missing {
 		return fmt.Errorf("incomplete profile")
 	}
+	if untrusted {
+		return fmt.Errorf("untrusted images in profile")
+	}
+
+	owners, err := torcx.ReadProfileAssetOwners(flagProfileCheckPath)
+	if err != nil {
+		return errors.Wrap(err, "reading asset owners")
+	}
+	unitOverrides, err := torcx.ReadProfileUnitOverrides(flagProfileCheckPath)
+	if err != nil {
+		return errors.Wrap(err, "reading unit enablement overrides")
+	}
+	applyCfg := &torcx.ApplyConfig{CommonConfig: *commonCfg}
+	report, err := torcx.InspectProfile(applyCfg, &storeCache, profile, owners, unitOverrides)
+	if err != nil {
+		return errors.Wrap(err, "profile inspection failed")
+	}
+	failed := false
+	for _, im := range profile {
+		err, ok := report.Unsatisfied[im.Name]
+		if !ok {
+			continue
+		}
+		logFields := logrus.Fields{
+			"name":      im.Name,
+			"reference": im.Reference,
+		}
+		if im.Optional {
+			logrus.WithFields(logFields).Warn("unsatisfied dependencies for optional image: ", err)
+		} else {
+			failed = true
+			logrus.WithFields(logFields).Error("unsatisfied dependencies: ", err)
+		}
+	}
+	logrus.WithField("order", report.Order).Debug("apply order")
+	for _, col := range report.Collisions {
+		logFields := logrus.Fields{
+			"asset":      col.Asset,
+			"images":     col.Images,
+			"owner":      col.Owner,
+			"resolution": col.Resolution,
+		}
+		if col.Resolution == string(torcx.CollisionPolicyFail) {
+			failed = true
+			logrus.WithFields(logFields).Error("asset collision")
+		} else {
+			logrus.WithFields(logFields).Warn("asset collision")
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("unsatisfiable profile")
+	}
 
 	return nil
 }
@@ -33,12 +33,13 @@ var (
 		RunE:  runProfilePopulate,
 	}
 
-	flagProfilePopulateName      string
-	flagProfilePopulatePath      string
-	flagProfilePopulateOsVersion string
-
-	// TODO(lucab): consider whether to make this configurable
-	timeoutMins = 1
+	flagProfilePopulateName       string
+	flagProfilePopulatePath       string
+	flagProfilePopulateOsVersion  string
+	flagProfilePopulateRetries    int
+	flagProfilePopulateBackoff    time.Duration
+	flagProfilePopulateMaxBackoff time.Duration
+	flagProfilePopulateTimeout    time.Duration
 )
 
 func init() {
@@ -46,6 +47,33 @@ func init() {
 	cmdProfilePopulate.Flags().StringVar(&flagProfilePopulateName, "name", "", "profile name to populate")
 	cmdProfilePopulate.Flags().StringVar(&flagProfilePopulatePath, "file", "", "profile file to populate")
 	cmdProfilePopulate.Flags().StringVarP(&flagProfilePopulateOsVersion, "os-release", "n", "", "override OS version")
+	cmdProfilePopulate.Flags().IntVar(&flagProfilePopulateRetries, "fetch-retries", torcx.DefaultRetryPolicy.Retries, "how many times a failed fetch is retried")
+	cmdProfilePopulate.Flags().DurationVar(&flagProfilePopulateBackoff, "fetch-backoff", torcx.DefaultRetryPolicy.Backoff, "delay before the first retry, doubled on each retry")
+	cmdProfilePopulate.Flags().DurationVar(&flagProfilePopulateMaxBackoff, "fetch-max-backoff", torcx.DefaultRetryPolicy.MaxBackoff, "maximum delay between retries")
+	cmdProfilePopulate.Flags().DurationVar(&flagProfilePopulateTimeout, "fetch-timeout", torcx.DefaultRetryPolicy.Timeout, "overall deadline for fetching remote manifests and images")
+}
+
+// retryPolicy returns the fetch retry policy from the config file,
+// overridden by flags explicitly set on the command line.
+func retryPolicy(cmd *cobra.Command, commonCfg *torcx.CommonConfig) (torcx.RetryPolicy, error) {
+	policy, err := commonCfg.RetryPolicy()
+	if err != nil {
+		return policy, err
+	}
+	flags := cmd.Flags()
+	if flags.Changed("fetch-retries") {
+		policy.Retries = flagProfilePopulateRetries
+	}
+	if flags.Changed("fetch-backoff") {
+		policy.Backoff = flagProfilePopulateBackoff
+	}
+	if flags.Changed("fetch-max-backoff") {
+		policy.MaxBackoff = flagProfilePopulateMaxBackoff
+	}
+	if flags.Changed("fetch-timeout") {
+		policy.Timeout = flagProfilePopulateTimeout
+	}
+	return policy, policy.Validate()
 }
 
 func runProfilePopulate(cmd *cobra.Command, args []string) error {
@@ -58,6 +86,11 @@ func runProfilePopulate(cmd *cobra.Command, args []string) error {
 		return cmd.Usage()
 	}
 
+	retry, err := retryPolicy(cmd, commonCfg)
+	if err != nil {
+		return errors.Wrap(err, "invalid fetch retry policy")
+	}
+
 	if flagProfilePopulatePath == "" {
 		if flagProfilePopulateName == "" {
 			flagProfilePopulateName, err = commonCfg.NextProfileName()
@@ -122,12 +155,14 @@ func runProfilePopulate(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMins)*time.Minute)
+	// A single deadline bounds the whole run, including retries
+	ctx, cancel := context.WithTimeout(context.Background(), retry.Timeout)
 	defer cancel()
-	remotesCache, err := torcx.NewRemotesCache(ctx, commonCfg.UsrDir, commonCfg.RemotesDirs(), remotes)
+	remotesCache, err := torcx.NewRemotesCache(ctx, commonCfg.UsrDir, commonCfg.RemotesDirs(), remotes, retry)
 	if err != nil {
 		return err
 	}
+	remotesCache.SignaturePolicy = commonCfg.SignaturePolicy
 
 	versionedStorePath := commonCfg.UserStorePath(flagProfilePopulateOsVersion)
 	if err := os.MkdirAll(versionedStorePath, 0755); err != nil {
@@ -146,9 +181,7 @@ func runProfilePopulate(cmd *cobra.Command, args []string) error {
 			continue
 		}
 
-		ctxTo, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutMins)*time.Minute)
-		defer cancel()
-		if err := remotesCache.FetchImage(ctxTo, im, versionedStorePath); err != nil {
+		if err := remotesCache.FetchImage(ctx, im, versionedStorePath); err != nil {
 			return err
 		}
 		remoteCount++
@@ -0,0 +1,56 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torcx/internal/torcx"
+)
+
+var (
+	cmdReset = &cobra.Command{
+		Use:   "reset",
+		Short: "undo the applied profile",
+		Long: `Undo the state applied and sealed by torcx-generator, without rebooting.
+Changes recorded in the apply journal are reverted: propagated assets are
+removed and images are unmounted. Then the unpack directory is unmounted, and
+the run directory and seal files are removed.
+
+On the next systemd reload, torcx-generator applies the next profile again.`,
+		RunE: runReset,
+	}
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdReset)
+}
+
+func runReset(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	if err := torcx.ResetSystemState(commonCfg); err != nil {
+		return errors.Wrap(err, "reset failed")
+	}
+	return nil
+}
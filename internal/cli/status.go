@@ -0,0 +1,62 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/coreos/torcx/internal/torcx"
+)
+
+var (
+	cmdStatus = &cobra.Command{
+		Use:   "status",
+		Short: "show the outcome of the last apply",
+		RunE:  runStatus,
+	}
+)
+
+func init() {
+	TorcxCmd.AddCommand(cmdStatus)
+}
+
+func runStatus(cmd *cobra.Command, args []string) error {
+	if len(args) != 0 {
+		return cmd.Usage()
+	}
+
+	commonCfg, err := fillCommonRuntime("")
+	if err != nil {
+		return errors.Wrap(err, "common configuration failed")
+	}
+
+	status, err := torcx.ReadApplyStatus(commonCfg.RunStatus())
+	if os.IsNotExist(errors.Cause(err)) {
+		return errors.Errorf("no apply status found at %q", commonCfg.RunStatus())
+	}
+	if err != nil {
+		return errors.Wrap(err, "reading apply status failed")
+	}
+
+	jsonOut := json.NewEncoder(os.Stdout)
+	jsonOut.SetIndent("", "  ")
+	err = jsonOut.Encode(status)
+
+	return err
+}
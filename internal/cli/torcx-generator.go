@@ -29,15 +29,59 @@ import (
 )
 
 var (
-	// TorcxGenCmd is the top-level cobra command for `torcx-generator`
+	// TorcxGenCmd is the top-level cobra command for `torcx-generator`.
+	// As a systemd generator, it takes the normal, early and late
+	// output directories as arguments.
 	TorcxGenCmd = &cobra.Command{
-		Use:          "torcx-generator",
+		Use:          "torcx-generator [normal-dir [early-dir late-dir]]",
 		RunE:         runGenerator,
 		SilenceUsage: true,
 	}
 )
 
+// generatorDirs are the output directories passed by systemd to generators.
+// Only Normal is used: the early directory takes precedence over /etc,
+// so units there could not be overridden by the administrator, while
+// the late one comes after /usr/lib and would let vendor units shadow
+// the ones shipped by images.
+type generatorDirs struct {
+	Normal string
+	Early  string
+	Late   string
+}
+
+// parseGeneratorDirs maps generator arguments to output directories.
+// Arguments are either none (manual invocation), only the normal
+// directory, or all three directories.
+func parseGeneratorDirs(args []string) (*generatorDirs, error) {
+	switch len(args) {
+	case 0, 1, 3:
+	default:
+		return nil, errors.Errorf("expected 0, 1 or 3 output directories, got %d", len(args))
+	}
+	for _, dir := range args {
+		if !filepath.IsAbs(dir) {
+			return nil, errors.Errorf("output directory %q is not absolute", dir)
+		}
+	}
+
+	dirs := &generatorDirs{}
+	if len(args) > 0 {
+		dirs.Normal = args[0]
+	}
+	if len(args) == 3 {
+		dirs.Early = args[1]
+		dirs.Late = args[2]
+	}
+	return dirs, nil
+}
+
 func runGenerator(cmd *cobra.Command, args []string) error {
+	genDirs, err := parseGeneratorDirs(args)
+	if err != nil {
+		return err
+	}
+
 	hook, err := logrus_syslog.NewSyslogHook("", "", syslog.LOG_INFO, "")
 	if err == nil {
 		logrus.AddHook(hook)
@@ -52,6 +96,13 @@ func runGenerator(cmd *cobra.Command, args []string) error {
 	}
 	if torcx.IsExistingPath(commonCfg.RunDir) {
 		logrus.Info("torcx already run")
+		// Generator directories are emptied on each systemd reload
+		if genDirs.Normal != "" {
+			applyCfg := &torcx.ApplyConfig{CommonConfig: *commonCfg}
+			if err := torcx.RestoreGeneratedUnits(applyCfg, genDirs.Normal); err != nil {
+				logrus.Warn("failed to restore generated units: ", err)
+			}
+		}
 		return nil
 	}
 
@@ -60,15 +111,27 @@ func runGenerator(cmd *cobra.Command, args []string) error {
 		return errors.Wrap(err, "apply configuration failed")
 	}
 
-	err = torcx.ApplyProfile(applyCfg)
-	if err != nil {
-		return errors.Wrap(err, "apply failed")
+	// Units go to the normal-priority generator directory, so that
+	// they can be overridden by local configuration in /etc.
+	if genDirs.Normal != "" {
+		applyCfg.Dirs.Units = genDirs.Normal
 	}
+	logrus.WithFields(logrus.Fields{
+		"normal": genDirs.Normal,
+		"early":  genDirs.Early,
+		"late":   genDirs.Late,
+	}).Debug("generator output directories")
 
-	err = torcx.SealSystemState(applyCfg)
+	applyErr := torcx.ApplyProfile(applyCfg)
+
+	// Seal even on failure, recording it in the seal file
+	err = torcx.SealSystemState(applyCfg, applyErr)
 	if err != nil {
 		return errors.Wrapf(err, "sealing system state failed")
 	}
+	if applyErr != nil {
+		return errors.Wrap(applyErr, "apply failed")
+	}
 	return nil
 }
 
@@ -86,16 +149,26 @@ func fillApplyRuntime(commonCfg *torcx.CommonConfig) (*torcx.ApplyConfig, error)
 		upperProfileName = ""
 	}
 
+	// The upper profile can override the configured apply mode
+	applyMode, err := torcx.ProfileApplyMode(commonCfg, upperProfileName)
+	if err != nil {
+		logrus.Warnf("unable to read apply mode from profile: %s", err)
+		applyMode = commonCfg.ApplyMode
+	}
+
 	logrus.WithFields(logrus.Fields{
 		"lower profiles (vendor/oem)": lowerProfileNames,
 		"upper profile (user)":        upperProfileName,
+		"apply mode":                  applyMode,
 	}).Debug("apply configuration parsed")
 
-	return &torcx.ApplyConfig{
+	applyCfg := &torcx.ApplyConfig{
 		CommonConfig:  *commonCfg,
 		LowerProfiles: lowerProfileNames,
 		UpperProfile:  upperProfileName,
-	}, nil
+	}
+	applyCfg.ApplyMode = applyMode
+	return applyCfg, nil
 }
 
 // lowerProfiles returns a list of lower profiles (vendor/oem) found on
@@ -0,0 +1,168 @@
+// Copyright 2017 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coreos/torcx/internal/torcx"
+	"github.com/spf13/viper"
+)
+
+func TestParseGeneratorDirs(t *testing.T) {
+	tests := []struct {
+		desc string
+		args []string
+
+		isErr bool
+		dirs  *generatorDirs
+	}{
+		{
+			"manual",
+			nil,
+			false,
+			&generatorDirs{},
+		},
+		{
+			"normal only",
+			[]string{"/run/systemd/generator"},
+			false,
+			&generatorDirs{Normal: "/run/systemd/generator"},
+		},
+		{
+			"all",
+			[]string{"/run/systemd/generator", "/run/systemd/generator.early", "/run/systemd/generator.late"},
+			false,
+			&generatorDirs{"/run/systemd/generator", "/run/systemd/generator.early", "/run/systemd/generator.late"},
+		},
+		{
+			"two",
+			[]string{"/run/systemd/generator", "/run/systemd/generator.early"},
+			true,
+			nil,
+		},
+		{
+			"relative",
+			[]string{"generator"},
+			true,
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Logf("Testing %q", tt.desc)
+		dirs, err := parseGeneratorDirs(tt.args)
+		if tt.isErr {
+			if err == nil {
+				t.Errorf("expected error, got %#v", dirs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !reflect.DeepEqual(dirs, tt.dirs) {
+			t.Errorf("expected %#v, got %#v", tt.dirs, dirs)
+		}
+	}
+}
+
+// TestGeneratorRerun checks that units survive systemd reloads, which
+// empty the output directory before running the generator again.
+func TestGeneratorRerun(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "torcx_generator_rerun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	runDir := filepath.Join(tmpDir, "run")
+	genDir := filepath.Join(tmpDir, "generator")
+	imageRoot := filepath.Join(tmpDir, "unpack", "foo")
+	for _, dir := range []string{runDir, genDir, imageRoot} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unitSrc := filepath.Join(imageRoot, "foo.service")
+	if err := ioutil.WriteFile(unitSrc, []byte("[Service]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("basedir", filepath.Join(tmpDir, "base"))
+	viper.Set("rundir", runDir)
+	viper.Set("confdir", filepath.Join(tmpDir, "conf"))
+	defer viper.Reset()
+
+	// Status as left by the first generator run
+	status := torcx.ApplyStatusV0JSON{
+		Kind: torcx.ApplyStatusV0K,
+		Value: torcx.ApplyStatusV0{
+			Images: []torcx.ImageStatusV0{
+				{
+					Name:      "foo",
+					Reference: "com.example.foo",
+					Success:   true,
+					ImageRoot: imageRoot,
+					Assets: []torcx.AssetEntry{
+						{Type: "units", Kind: torcx.JournalFile, Source: unitSrc, Target: filepath.Join(genDir, "foo.service")},
+						{Type: "units", Kind: torcx.JournalSymlink, Target: filepath.Join(genDir, "bar.service"), LinkDest: "foo.service"},
+					},
+				},
+			},
+		},
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonCfg := torcx.CommonConfig{RunDir: runDir}
+	if err := ioutil.WriteFile(commonCfg.RunStatus(), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		// systemd empties generator directories before each run
+		if err := os.RemoveAll(genDir); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(genDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := runGenerator(nil, []string{genDir}); err != nil {
+			t.Fatalf("run %d: unexpected error: %s", i, err)
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(genDir, "foo.service"))
+		if err != nil {
+			t.Fatalf("run %d: %s", i, err)
+		}
+		if string(content) != "[Service]\n" {
+			t.Errorf("run %d: unexpected unit content %q", i, content)
+		}
+		dest, err := os.Readlink(filepath.Join(genDir, "bar.service"))
+		if err != nil {
+			t.Fatalf("run %d: %s", i, err)
+		}
+		if dest != "foo.service" {
+			t.Errorf("run %d: unexpected symlink destination %q", i, dest)
+		}
+	}
+}
@@ -52,8 +52,14 @@ func Init() error {
 	verboseFlag := TorcxCmd.PersistentFlags().VarPF((*cliCfgVerbose)(&TorcxCliCfg), "verbose", "v", "verbosity level")
 	verboseFlag.NoOptDefVal = "info"
 
+	// The root directory can also be set via TORCX_ROOT
+	TorcxCmd.PersistentFlags().String("root", "", "alternate root directory, prefixed to all host paths")
+	if err := viper.BindPFlag("root", TorcxCmd.PersistentFlags().Lookup("root")); err != nil {
+		return err
+	}
+
 	multicall.AddCobra(TorcxCmd.Use, TorcxCmd)
-	multicall.AddCobra(TorcxGenCmd.Use, TorcxGenCmd)
+	multicall.AddCobra(TorcxGenCmd.Name(), TorcxGenCmd)
 
 	return nil
 }
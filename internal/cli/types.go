@@ -14,6 +14,8 @@
 
 package cli
 
+import "github.com/coreos/torcx/internal/torcx"
+
 const (
 	// TorcxProfileListV0K is the JSON kind identifier for a profile list
 	TorcxProfileListV0K = "torcx-profile-list-v0"
@@ -50,3 +52,21 @@ type ImageEntry struct {
 	Reference string `json:"reference"`
 	Filepath  string `json:"filepath"`
 }
+
+const (
+	// TorcxApplyPlanV0K is the JSON kind identifier for an apply plan
+	TorcxApplyPlanV0K = "torcx-apply-plan-v0"
+)
+
+// ApplyPlan is the JSON container for apply plan output
+type ApplyPlan struct {
+	Kind  string    `json:"kind"`
+	Value applyPlan `json:"value"`
+}
+
+type applyPlan struct {
+	LowerProfileNames []string               `json:"lower_profile_names"`
+	UpperProfileName  string                 `json:"upper_profile_name"`
+	Images            []torcx.ImagePlan      `json:"images"`
+	Collisions        []torcx.AssetCollision `json:"collisions,omitempty"`
+}
@@ -18,120 +18,135 @@ var (
 	ErrSetCapacity            = errors.New("Unable set loopback capacity")
 )
 
+// maxAttachAttempts bounds retries when a free loop device is grabbed
+// by someone else before it could be configured.
+const maxAttachAttempts = 32
+
 func stringToLoopName(src string) [LoNameSize]uint8 {
 	var dst [LoNameSize]uint8
 	copy(dst[:], src[:])
 	return dst
 }
 
-func getNextFreeLoopbackIndex() (int, error) {
-	f, err := os.OpenFile("/dev/loop-control", os.O_RDONLY, 0644)
-	if err != nil {
-		return 0, err
+// configureLoopback attaches `backingFile` to `loopFile` with `flags`.
+// LOOP_CONFIGURE does it atomically; kernels older than 5.8 fall back to
+// LOOP_SET_FD and LOOP_SET_STATUS64.
+func configureLoopback(loopFile, backingFile *os.File, flags uint32) error {
+	config := &loopConfig{
+		fd: uint32(backingFile.Fd()),
+		info: loopInfo64{
+			loFileName: stringToLoopName(backingFile.Name()),
+			loFlags:    flags,
+		},
 	}
-	defer f.Close()
-
-	index, err := ioctlLoopCtlGetFree(f.Fd())
-	if index < 0 {
-		index = 0
+	err := ioctlLoopConfigure(loopFile.Fd(), config)
+	if err == unix.EINVAL && flags&LoFlagsDirectIO != 0 {
+		// Backing filesystem without direct-io support
+		config.info.loFlags &^= LoFlagsDirectIO
+		err = ioctlLoopConfigure(loopFile.Fd(), config)
 	}
-	return index, err
-}
-
-func openNextAvailableLoopback(index int, sparseFile *os.File) (loopFile *os.File, err error) {
-	// Start looking for a free /dev/loop
-	for {
-		target := fmt.Sprintf("/dev/loop%d", index)
-		index++
-
-		fi, err := os.Stat(target)
-		if err != nil {
-			if os.IsNotExist(err) {
-				logrus.Error("There are no more loopback devices available.")
-			}
-			return nil, ErrAttachLoopbackDevice
-		}
-
-		if fi.Mode()&os.ModeDevice != os.ModeDevice {
-			logrus.Errorf("Loopback device %s is not a block device.", target)
-			continue
-		}
-
-		// OpenFile adds O_CLOEXEC
-		loopFile, err = os.OpenFile(target, os.O_RDWR, 0644)
-		if err != nil {
-			logrus.Errorf("Error opening loopback device: %s", err)
-			return nil, ErrAttachLoopbackDevice
-		}
-
-		// Try to attach to the loop file
-		if err := ioctlLoopSetFd(loopFile.Fd(), sparseFile.Fd()); err != nil {
-			loopFile.Close()
-
-			// If the error is EBUSY, then try the next loopback
-			if err != unix.EBUSY {
-				logrus.Errorf("Cannot set up loopback device %s: %s", target, err)
-				return nil, ErrAttachLoopbackDevice
-			}
-
-			// Otherwise, we keep going with the loop
-			continue
-		}
-		// In case of success, we finished. Break the loop.
-		break
+	if err != unix.EINVAL && err != unix.ENOTTY {
+		return err
 	}
 
-	// This can't happen, but let's be sure
-	if loopFile == nil {
-		logrus.Errorf("Unreachable code reached! Error attaching %s to a loopback device.", sparseFile.Name())
-		return nil, ErrAttachLoopbackDevice
+	if err := ioctlLoopSetFd(loopFile.Fd(), backingFile.Fd()); err != nil {
+		return err
 	}
-
-	return loopFile, nil
+	// Read-only mode follows from the backing file open mode
+	loopInfo := &loopInfo64{
+		loFileName: stringToLoopName(backingFile.Name()),
+		loFlags:    flags &^ (LoFlagsReadOnly | LoFlagsDirectIO),
+	}
+	if err := ioctlLoopSetStatus64(loopFile.Fd(), loopInfo); err != nil {
+		ioctlLoopClrFd(loopFile.Fd())
+		return err
+	}
+	if flags&LoFlagsDirectIO != 0 {
+		if err := ioctlLoopSetDirectIO(loopFile.Fd(), 1); err != nil {
+			logrus.Debugf("Direct-io unavailable for %s: %s", loopFile.Name(), err)
+		}
+	}
+	return nil
 }
 
-// AttachLoopDevice attaches the given squashfs file to the next
-// available loopback device. It returns an opened *os.File of the loop device
-// created.
-func AttachLoopDevice(fileName string) (loop *os.File, err error) {
-	// Try to retrieve the next available loopback device via syscall.
-	// If it fails, we discard error and start looping for a
-	// loopback from index 0.
-	startIndex, err := getNextFreeLoopbackIndex()
-	if err != nil {
-		logrus.Debugf("Error retrieving the next available loopback: %s", err)
+// Attach attaches the given file to a free loopback device obtained
+// from /dev/loop-control, configured with `flags` (e.g. LoFlagsReadOnly).
+// It returns an opened *os.File of the loop device created.
+func Attach(fileName string, flags uint32) (*os.File, error) {
+	mode := os.O_RDWR
+	if flags&LoFlagsReadOnly != 0 {
+		mode = os.O_RDONLY
 	}
-
 	// OpenFile adds O_CLOEXEC
-	file, err := os.OpenFile(fileName, os.O_RDONLY, 0600)
+	file, err := os.OpenFile(fileName, mode, 0)
 	if err != nil {
 		logrus.Errorf("Error opening file %s: %s", fileName, err)
 		return nil, ErrAttachLoopbackDevice
 	}
 	defer file.Close()
 
-	loopFile, err := openNextAvailableLoopback(startIndex, file)
-	if err != nil {
-		return nil, err
-	}
+	return AttachFile(file, flags)
+}
 
-	// Set the status of the loopback device
-	loopInfo := &loopInfo64{
-		loFileName: stringToLoopName(loopFile.Name()),
-		loOffset:   0,
-		loFlags:    LoFlagsAutoClear,
+// AttachFile attaches an already opened file to a free loopback device,
+// like Attach. The file is left open.
+func AttachFile(file *os.File, flags uint32) (*os.File, error) {
+	fileName := file.Name()
+	ctl, err := os.OpenFile("/dev/loop-control", os.O_RDWR, 0)
+	if err != nil {
+		logrus.Errorf("Error opening loop control device: %s", err)
+		return nil, ErrAttachLoopbackDevice
 	}
+	defer ctl.Close()
 
-	if err := ioctlLoopSetStatus64(loopFile.Fd(), loopInfo); err != nil {
-		logrus.Errorf("Cannot set up loopback device info: %s", err)
+	for attempt := 0; attempt < maxAttachAttempts; attempt++ {
+		index, err := ioctlLoopCtlGetFree(ctl.Fd())
+		if err != nil {
+			logrus.Errorf("Error retrieving a free loopback device: %s", err)
+			return nil, ErrAttachLoopbackDevice
+		}
+		loopFile, err := os.OpenFile(fmt.Sprintf("/dev/loop%d", index), os.O_RDWR, 0)
+		if err != nil {
+			logrus.Errorf("Error opening loopback device: %s", err)
+			return nil, ErrAttachLoopbackDevice
+		}
 
-		// If the call failed, then free the loopback device
-		if err := ioctlLoopClrFd(loopFile.Fd()); err != nil {
-			logrus.Error("Error while cleaning up the loopback device")
+		err = configureLoopback(loopFile, file, flags)
+		if err == nil {
+			return loopFile, nil
 		}
 		loopFile.Close()
-		return nil, ErrAttachLoopbackDevice
+		// Another tool grabbed this device in the meantime, try the next free one
+		if err != unix.EBUSY {
+			logrus.Errorf("Cannot set up loopback device %s: %s", loopFile.Name(), err)
+			return nil, ErrAttachLoopbackDevice
+		}
 	}
 
-	return loopFile, nil
+	logrus.Errorf("No free loopback device for %s after %d attempts", fileName, maxAttachAttempts)
+	return nil, ErrAttachLoopbackDevice
+}
+
+// AttachLoopDevice attaches the given image file read-only to a free
+// loopback device, with autoclear and direct-io. It returns an opened
+// *os.File of the loop device created.
+func AttachLoopDevice(fileName string) (*os.File, error) {
+	return Attach(fileName, LoFlagsReadOnly|LoFlagsAutoClear|LoFlagsDirectIO)
+}
+
+// AttachLoopDeviceFile attaches an already opened image file like
+// AttachLoopDevice.
+func AttachLoopDeviceFile(file *os.File) (*os.File, error) {
+	return AttachFile(file, LoFlagsReadOnly|LoFlagsAutoClear|LoFlagsDirectIO)
+}
+
+// DetachLoopDevice detaches the backing file of a loopback device. A
+// device still in use is detached once released.
+func DetachLoopDevice(loopFile *os.File) error {
+	err := ioctlLoopClrFd(loopFile.Fd())
+	if err == unix.ENXIO {
+		// Already detached
+		return nil
+	}
+	return err
 }
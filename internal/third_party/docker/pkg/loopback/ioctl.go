@@ -27,6 +27,17 @@ func ioctlLoopSetStatus64(loopFd uintptr, loopInfo *loopInfo64) error {
 	return nil
 }
 
+func ioctlLoopConfigure(loopFd uintptr, config *loopConfig) error {
+	if _, _, err := unix.Syscall(unix.SYS_IOCTL, loopFd, LoopConfigure, uintptr(unsafe.Pointer(config))); err != 0 {
+		return err
+	}
+	return nil
+}
+
+func ioctlLoopSetDirectIO(loopFd uintptr, value int) error {
+	return unix.IoctlSetInt(int(loopFd), LoopSetDirectIO, value)
+}
+
 func ioctlLoopClrFd(loopFd uintptr) error {
 	if _, _, err := unix.Syscall(unix.SYS_IOCTL, loopFd, LoopClrFd, 0); err != 0 {
 		return err
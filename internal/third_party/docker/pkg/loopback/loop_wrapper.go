@@ -18,6 +18,14 @@ type loopInfo64 struct {
 	loInit           [2]uint64
 }
 
+// loopConfig is the argument of LOOP_CONFIGURE
+type loopConfig struct {
+	fd        uint32
+	blockSize uint32
+	info      loopInfo64
+	reserved  [8]uint64
+}
+
 // IOCTL consts; taken from /usr/include/linux/loop.h
 const (
 	LoopSetFd       = 0x4C00
@@ -25,6 +33,8 @@ const (
 	LoopSetStatus64 = 0x4C04
 	LoopGetStatus64 = 0x4C05
 	LoopSetCapacity = 0x4C07
+	LoopSetDirectIO = 0x4C08
+	LoopConfigure   = 0x4C0A
 	LoopCtlGetFree  = 0x4C82
 )
 
@@ -33,6 +43,7 @@ const (
 	LoFlagsReadOnly  = 1
 	LoFlagsAutoClear = 4
 	LoFlagsPartScan  = 8
+	LoFlagsDirectIO  = 16
 	LoKeySize        = 32
 	LoNameSize       = 64
 )
@@ -0,0 +1,80 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// archiveFile is an opened archive file.
+type archiveFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// pinnedReader reads a pinned archive file from its start.
+type pinnedReader struct {
+	*io.SectionReader
+}
+
+// Close leaves the pinned file open, for the next reader.
+func (pinnedReader) Close() error {
+	return nil
+}
+
+// pin opens the archive file once, so that it is verified and unpacked
+// from the same file even if it is replaced in the store meanwhile.
+// OCI layout directories are not pinned.
+func (ar *Archive) pin() error {
+	if ar.file != nil || ar.Format == ArchiveFormatOCI {
+		return nil
+	}
+	fp, err := os.Open(ar.Filepath)
+	if err != nil {
+		return errors.Wrapf(err, "opening %q", ar.Filepath)
+	}
+	ar.file = fp
+	return nil
+}
+
+// unpin closes the archive file opened by pin.
+func (ar *Archive) unpin() {
+	if ar.file != nil {
+		ar.file.Close()
+		ar.file = nil
+	}
+}
+
+// open returns a reader over the archive file from its start, sharing the
+// pinned file if any.
+func (ar Archive) open() (archiveFile, error) {
+	if ar.file == nil {
+		fp, err := os.Open(ar.Filepath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "opening %q", ar.Filepath)
+		}
+		return fp, nil
+	}
+	fi, err := ar.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return pinnedReader{io.NewSectionReader(ar.file, 0, fi.Size())}, nil
+}
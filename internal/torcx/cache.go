@@ -0,0 +1,353 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	_ "crypto/sha512" // used by go-digest
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// UnpackCacheEntryV0K - unpack cache entry kind, v0
+	UnpackCacheEntryV0K = "torcx-unpack-cache-entry-v0"
+
+	// cacheEntryFile holds the metadata of a cache entry
+	cacheEntryFile = "entry.json"
+	// cacheRootfsDir holds the unpacked tree of a cache entry
+	cacheRootfsDir = "rootfs"
+	// cacheTmpPrefix marks cache entries being populated
+	cacheTmpPrefix = ".tmp-"
+)
+
+// UnpackCacheEntryV0 holds the JSON metadata of an unpack cache entry (version 0)
+type UnpackCacheEntryV0 struct {
+	Kind  string           `json:"kind"`
+	Value UnpackCacheEntry `json:"value"`
+}
+
+// UnpackCacheEntry describes a tarball archive unpacked in the cache.
+type UnpackCacheEntry struct {
+	ArchiveDigest string `json:"archive_digest"`
+	// TreeDigest covers paths, types, modes, owners, file contents and
+	// link targets of the tree
+	TreeDigest string `json:"tree_digest"`
+	// Source, Size and ModTime identify the archive in the store, for eviction
+	Source  string    `json:"source"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// cacheLocks serialises the lookup and population of each cache entry,
+// as images are unpacked in parallel.
+var (
+	cacheLocksMu sync.Mutex
+	cacheLocks   = map[string]*sync.Mutex{}
+)
+
+// lockCacheEntry locks the cache entry at `entryDir`, returning the
+// unlock function.
+func lockCacheEntry(entryDir string) func() {
+	cacheLocksMu.Lock()
+	mu, ok := cacheLocks[entryDir]
+	if !ok {
+		mu = &sync.Mutex{}
+		cacheLocks[entryDir] = mu
+	}
+	cacheLocksMu.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// cacheKey returns the cache entry name for an archive digest.
+func cacheKey(d digest.Digest) string {
+	return formatHash(d)
+}
+
+// isSHA512 returns whether `d` is a valid sha512 digest. Empty digests
+// are not, as they make Algorithm() panic.
+func isSHA512(d digest.Digest) bool {
+	return d.Validate() == nil && d.Algorithm() == digest.SHA512
+}
+
+// archiveDigest computes the content digest of the archive file at `path`.
+func archiveDigest(path string) (digest.Digest, os.FileInfo, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	d, err := digest.SHA512.FromReader(bufio.NewReader(fp))
+	if err != nil {
+		return "", nil, errors.Wrapf(err, "hashing %q", path)
+	}
+	return d, fi, nil
+}
+
+// treeDigest computes a digest over the directory tree at `root`,
+// including file contents.
+func treeDigest(root string) (digest.Digest, error) {
+	dg := digest.SHA512.Digester()
+	h := dg.Hash()
+	walkFn := func(path string, fi os.FileInfo, inErr error) error {
+		if inErr != nil {
+			return inErr
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		uid, gid := -1, -1
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00%d:%d\x00", rel, fi.Mode(), uid, gid)
+
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(h, link)
+		case fi.Mode().IsRegular():
+			fp, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer fp.Close()
+			if _, err := io.Copy(h, bufio.NewReader(fp)); err != nil {
+				return err
+			}
+		}
+		h.Write([]byte{0})
+		return nil
+	}
+	if err := filepath.Walk(root, walkFn); err != nil {
+		return "", errors.Wrapf(err, "hashing tree %q", root)
+	}
+	return dg.Digest(), nil
+}
+
+// readCacheEntry reads the metadata of the cache entry at `entryDir`.
+func readCacheEntry(entryDir string) (*UnpackCacheEntry, error) {
+	b, err := ioutil.ReadFile(filepath.Join(entryDir, cacheEntryFile))
+	if err != nil {
+		return nil, err
+	}
+	var manifest UnpackCacheEntryV0
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Kind != UnpackCacheEntryV0K {
+		return nil, errors.Errorf("unknown cache entry kind %q", manifest.Kind)
+	}
+	return &manifest.Value, nil
+}
+
+// writeCacheEntry writes the metadata of the cache entry at `entryDir`.
+func writeCacheEntry(entryDir string, entry *UnpackCacheEntry) error {
+	b, err := json.Marshal(UnpackCacheEntryV0{
+		Kind:  UnpackCacheEntryV0K,
+		Value: *entry,
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(entryDir, cacheEntryFile), b, 0644)
+}
+
+// populateCacheEntry unpacks a tarball or OCI archive into a new cache entry at
+// `entryDir`, atomically.
+func populateCacheEntry(archive Archive, entry *UnpackCacheEntry, entryDir string) error {
+	tmpDir, err := ioutil.TempDir(filepath.Dir(entryDir), cacheTmpPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	rootfs := filepath.Join(tmpDir, cacheRootfsDir)
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return err
+	}
+	if err := extractArchive(archive, rootfs); err != nil {
+		return err
+	}
+
+	td, err := treeDigest(rootfs)
+	if err != nil {
+		return err
+	}
+	entry.TreeDigest = td.String()
+	if err := writeCacheEntry(tmpDir, entry); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpDir, entryDir); err != nil {
+		if _, statErr := os.Stat(entryDir); statErr == nil {
+			// Populated concurrently for another image with the same content
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// prepareCachedTarball returns the cached tree for a tarball archive,
+// verifying it or populating the cache if needed. Entries are looked up by
+// the sha512 digest `d` of the archive, which is hashed if not known.
+func prepareCachedTarball(applyCfg *ApplyConfig, archive Archive, d digest.Digest) (string, error) {
+	tarPath := archive.Filepath
+	cacheDir := applyCfg.UnpackCacheDir()
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return "", err
+	}
+
+	fi, err := os.Stat(tarPath)
+	if err != nil {
+		return "", err
+	}
+	if !isSHA512(d) {
+		fp, err := archive.open()
+		if err != nil {
+			return "", err
+		}
+		d, err = digest.SHA512.FromReader(bufio.NewReader(fp))
+		fp.Close()
+		if err != nil {
+			return "", errors.Wrapf(err, "hashing %q", tarPath)
+		}
+	}
+	entryDir := filepath.Join(cacheDir, cacheKey(d))
+	rootfs := filepath.Join(entryDir, cacheRootfsDir)
+	logFields := logrus.Fields{
+		"archive": tarPath,
+		"entry":   entryDir,
+	}
+
+	unlock := lockCacheEntry(entryDir)
+	defer unlock()
+
+	entry, err := readCacheEntry(entryDir)
+	if err == nil {
+		td, err := treeDigest(rootfs)
+		if err == nil && td.String() == entry.TreeDigest {
+			// Keep track of the archive, for eviction
+			if entry.Source != tarPath || entry.Size != fi.Size() || !entry.ModTime.Equal(fi.ModTime()) {
+				entry.Source, entry.Size, entry.ModTime = tarPath, fi.Size(), fi.ModTime()
+				if err := writeCacheEntry(entryDir, entry); err != nil {
+					return "", err
+				}
+			}
+			logrus.WithFields(logFields).Debug("unpack cache hit")
+			return rootfs, nil
+		}
+		logrus.WithFields(logFields).Warn("discarding corrupted unpack cache entry")
+	}
+	if err := os.RemoveAll(entryDir); err != nil {
+		return "", err
+	}
+
+	entry = &UnpackCacheEntry{
+		ArchiveDigest: d.String(),
+		Source:        tarPath,
+		Size:          fi.Size(),
+		ModTime:       fi.ModTime(),
+	}
+	if err := populateCacheEntry(archive, entry, entryDir); err != nil {
+		return "", err
+	}
+	logrus.WithFields(logFields).Debug("unpack cache populated")
+	return rootfs, nil
+}
+
+// mountCachedTarball bind-mounts the cached tree for a tarball archive
+// read-only, returning the target top directory.
+func mountCachedTarball(applyCfg *ApplyConfig, tx *journalTx, rootfs, imageName string) (string, error) {
+	topDir := filepath.Join(applyCfg.RunUnpackDir(), imageName)
+	if err := tx.mkdirAll(topDir); err != nil {
+		return "", err
+	}
+
+	// Record the mountpoint first, reverting an unmounted entry is harmless
+	if err := tx.record(JournalMount, topDir); err != nil {
+		return "", err
+	}
+	if err := unix.Mount(rootfs, topDir, "", unix.MS_BIND, ""); err != nil {
+		return "", errors.Wrapf(err, "bind-mounting %q", rootfs)
+	}
+	if err := unix.Mount("", topDir, "", unix.MS_BIND|unix.MS_REMOUNT|unix.MS_RDONLY, ""); err != nil {
+		return "", errors.Wrapf(err, "remounting %q read-only", topDir)
+	}
+	return topDir, nil
+}
+
+// evictUnpackCache removes cache entries whose archive is not in the
+// store anymore, and leftovers from interrupted runs.
+func evictUnpackCache(applyCfg *ApplyConfig) error {
+	cacheDir := applyCfg.UnpackCacheDir()
+	names, err := ioutil.ReadDir(cacheDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, fi := range names {
+		entryDir := filepath.Join(cacheDir, fi.Name())
+		reason := ""
+		if strings.HasPrefix(fi.Name(), cacheTmpPrefix) {
+			reason = "interrupted"
+		} else if entry, err := readCacheEntry(entryDir); err != nil {
+			reason = "invalid"
+		} else if st, err := os.Stat(entry.Source); err != nil {
+			reason = "archive removed"
+		} else if st.Size() != entry.Size || !st.ModTime().Equal(entry.ModTime) {
+			reason = "archive changed"
+		}
+		if reason == "" {
+			continue
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"entry":  entryDir,
+			"reason": reason,
+		}).Debug("evicting unpack cache entry")
+		if err := os.RemoveAll(entryDir); err != nil {
+			return errors.Wrapf(err, "evicting %q", entryDir)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestTreeDigest(t *testing.T) {
+	root, err := ioutil.TempDir("", "torcx_test_tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fpath := filepath.Join(root, "bin", "foo")
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fpath, []byte("foo"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	d1, err := treeDigest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d2, _ := treeDigest(root); d1 != d2 {
+		t.Fatalf("unstable digest: %s != %s", d1, d2)
+	}
+
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := []func() error{
+		// Same size and modification time, different content
+		func() error {
+			if err := ioutil.WriteFile(fpath, []byte("bar"), 0755); err != nil {
+				return err
+			}
+			return os.Chtimes(fpath, fi.ModTime(), fi.ModTime())
+		},
+		func() error { return os.Chmod(fpath, 0644) },
+		func() error { return os.Symlink("foo", filepath.Join(root, "bin", "bar")) },
+	}
+	prev := d1
+	for i, change := range changes {
+		if err := change(); err != nil {
+			t.Fatal(err)
+		}
+		d, err := treeDigest(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d == prev {
+			t.Errorf("change #%d not detected", i)
+		}
+		prev = d
+	}
+}
+
+func TestEvictUnpackCache(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "torcx_test_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	applyCfg := &ApplyConfig{CommonConfig: CommonConfig{BaseDir: baseDir}}
+	cacheDir := applyCfg.UnpackCacheDir()
+
+	archive := filepath.Join(baseDir, "foo.torcx.tgz")
+	if err := ioutil.WriteFile(archive, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := map[string]*UnpackCacheEntry{
+		"sha512-present": {Source: archive, Size: fi.Size(), ModTime: fi.ModTime()},
+		"sha512-changed": {Source: archive, Size: fi.Size() + 1, ModTime: fi.ModTime()},
+		"sha512-removed": {Source: filepath.Join(baseDir, "bar.torcx.tgz")},
+		"sha512-invalid": nil,
+		".tmp-123":       {Source: archive, Size: fi.Size(), ModTime: fi.ModTime()},
+	}
+	for name, entry := range entries {
+		entryDir := filepath.Join(cacheDir, name)
+		if err := os.MkdirAll(entryDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if entry != nil {
+			if err := writeCacheEntry(entryDir, entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := evictUnpackCache(applyCfg); err != nil {
+		t.Fatal(err)
+	}
+	for name := range entries {
+		_, err := os.Stat(filepath.Join(cacheDir, name))
+		if kept := err == nil; kept != (name == "sha512-present") {
+			t.Errorf("entry %q: unexpected eviction state, kept=%t", name, kept)
+		}
+	}
+}
+
+func TestPrepareCachedTarball(t *testing.T) {
+	baseDir, err := ioutil.TempDir("", "torcx_test_cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(baseDir)
+	applyCfg := &ApplyConfig{CommonConfig: CommonConfig{BaseDir: baseDir}}
+
+	makeTgz := func(content []byte) []byte {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		if err := tw.WriteHeader(&tar.Header{Name: "bin/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: "bin/hello", Mode: 0755, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	content := []byte("hello\n")
+
+	// Two images with the same content, unpacked in parallel
+	archives := []Archive{
+		{Filepath: filepath.Join(baseDir, "foo.torcx.tgz"), Format: ArchiveFormatTgz},
+		{Filepath: filepath.Join(baseDir, "bar.torcx.tgz"), Format: ArchiveFormatTgz},
+	}
+	for _, archive := range archives {
+		if err := ioutil.WriteFile(archive.Filepath, makeTgz(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootfs := make([]string, len(archives))
+	errs := make([]error, len(archives))
+	var wg sync.WaitGroup
+	for i := range archives {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rootfs[i], errs[i] = prepareCachedTarball(applyCfg, archives[i], "")
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("archive %q: %v", archives[i].Filepath, err)
+		}
+	}
+	if rootfs[0] != rootfs[1] {
+		t.Fatalf("expected a single entry, got %q and %q", rootfs[0], rootfs[1])
+	}
+	if _, err := os.Stat(filepath.Join(rootfs[0], "bin", "hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupted tree is unpacked again
+	hello := filepath.Join(rootfs[0], "bin", "hello")
+	fi, err := os.Stat(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(hello, []byte("HELLO\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(hello, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := prepareCachedTarball(applyCfg, archives[0], ""); err != nil || again != rootfs[0] {
+		t.Fatalf("expected entry %q, got %q (%v)", rootfs[0], again, err)
+	}
+	if b, err := ioutil.ReadFile(hello); err != nil || !bytes.Equal(b, content) {
+		t.Errorf("expected restored content %q, got %q (%v)", content, b, err)
+	}
+
+	// A replaced archive with the same modification time gets its own entry
+	fi, err = os.Stat(archives[0].Filepath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(archives[0].Filepath, makeTgz([]byte("world\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(archives[0].Filepath, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	other, err := prepareCachedTarball(applyCfg, archives[0], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == rootfs[0] {
+		t.Errorf("replaced archive served from entry %q", other)
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CollisionPolicy selects how assets shipped by multiple images are handled.
+type CollisionPolicy string
+
+const (
+	// CollisionPolicyFail fails all images colliding with an earlier one
+	CollisionPolicyFail CollisionPolicy = "fail"
+	// CollisionPolicyFirstWins keeps assets from the first image in apply order
+	CollisionPolicyFirstWins CollisionPolicy = "first-wins"
+	// CollisionPolicyLastWins keeps assets from the last image in apply order
+	CollisionPolicyLastWins CollisionPolicy = "last-wins"
+
+	// collisionResolutionOwner marks collisions resolved by the upper profile
+	collisionResolutionOwner = "owner"
+)
+
+// Validate checks that the policy is a known one. An empty policy
+// stands for the default one (first-wins).
+func (cp CollisionPolicy) Validate() error {
+	switch cp {
+	case "", CollisionPolicyFail, CollisionPolicyFirstWins, CollisionPolicyLastWins:
+		return nil
+	}
+	return errors.Errorf("unknown collision policy %q, must be one of %q, %q, %q",
+		cp, CollisionPolicyFail, CollisionPolicyFirstWins, CollisionPolicyLastWins)
+}
+
+// AssetCollision describes an asset shipped by more than one image.
+type AssetCollision struct {
+	// Asset is the asset type and path, e.g. "bin/runc"
+	Asset  string   `json:"asset"`
+	Target string   `json:"target"`
+	Images []string `json:"images"`
+	Owner  string   `json:"owner"`
+	// Resolution is either "owner" (as named by the upper profile)
+	// or the collision policy in effect
+	Resolution string `json:"resolution"`
+}
+
+// plannedImage holds the propagation steps for all assets of an image,
+// and its dependencies.
+type plannedImage struct {
+	name   string
+	groups []plannedGroup
+	deps   Dependencies
+}
+
+// plannedGroup holds the propagation steps for a group of assets.
+type plannedGroup struct {
+	assetGroup
+	ops []assetOp
+}
+
+// planImageManifest reads the manifest of the image `name` rooted at `imageRoot`,
+// computing the propagation steps for all its assets and the enablement of its
+// units. `enable` overrides unit enablement, by unit name.
+func planImageManifest(applyCfg *ApplyConfig, fsys imageFS, name string, imageRoot string, enable map[string]bool) (*plannedImage, error) {
+	manifest, err := retrieveManifest(applyCfg, fsys, imageRoot)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed retrieving assets from image")
+	}
+
+	groups := []plannedGroup{}
+	for _, group := range assetGroups(applyCfg, &manifest.Assets) {
+		if len(group.entries) <= 0 {
+			continue
+		}
+		ops, err := planAssets(fsys, imageRoot, group)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to plan %s", group.desc)
+		}
+		if group.bins {
+			// Binaries are linked to as seen from within the root
+			for i := range ops {
+				ops[i].LinkDest = applyCfg.RootRelative(ops[i].LinkDest)
+			}
+		}
+		groups = append(groups, plannedGroup{group, ops})
+	}
+	markTemplates(groups, imageRoot, manifest.Templates)
+
+	// Unit enablement links go along with units
+	unitsDir := applyCfg.Dirs.withDefaults(&applyCfg.CommonConfig).Units
+	installOps, err := planInstall(fsys, imageRoot, unitsDir, manifest.Install, manifest.Presets, enable)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to plan unit enablement")
+	}
+	if len(installOps) > 0 {
+		group := assetGroup{kind: "units", desc: "unit enablement", dir: unitsDir}
+		for _, inst := range manifest.Install {
+			group.entries = append(group.entries, inst.Unit)
+		}
+		groups = append(groups, plannedGroup{group, installOps})
+	}
+
+	return &plannedImage{name: name, groups: groups, deps: manifest.Dependencies}, nil
+}
+
+// assetKey names the asset created by `op`, as used in profile asset owners.
+func assetKey(group assetGroup, op assetOp) string {
+	rel, err := filepath.Rel(group.dir, op.Target)
+	if err != nil {
+		rel = filepath.Base(op.Target)
+	}
+	return group.kind + "/" + rel
+}
+
+// resolveCollisions finds assets shipped by more than one image and drops
+// their propagation steps from all images but the owning one.
+// Images are in apply order, nil entries are ignored. The owner is the
+// image named in `owners`, if any, or else it is chosen by `policy`.
+// Under the "fail" policy, images colliding with an earlier one are
+// returned with the corresponding error.
+func resolveCollisions(images []*plannedImage, policy CollisionPolicy, owners map[string]string) ([]AssetCollision, map[string]error) {
+	if policy == "" {
+		policy = CollisionPolicyFirstWins
+	}
+
+	type claim struct {
+		image int
+		asset string
+	}
+	claims := map[string][]claim{}
+	targets := []string{}
+	for i, pi := range images {
+		if pi == nil {
+			continue
+		}
+		for _, g := range pi.groups {
+			for _, op := range g.ops {
+				if op.Kind == JournalDir {
+					continue
+				}
+				cl, ok := claims[op.Target]
+				if !ok {
+					targets = append(targets, op.Target)
+				}
+				// Duplicates within the same image are not collisions
+				if len(cl) > 0 && cl[len(cl)-1].image == i {
+					continue
+				}
+				claims[op.Target] = append(cl, claim{i, assetKey(g.assetGroup, op)})
+			}
+		}
+	}
+
+	collisions := []AssetCollision{}
+	failed := map[string]error{}
+	dropped := map[int]map[string]bool{}
+	for _, target := range targets {
+		cl := claims[target]
+		if len(cl) < 2 {
+			continue
+		}
+		col := AssetCollision{
+			Asset:  cl[0].asset,
+			Target: target,
+			Images: make([]string, 0, len(cl)),
+		}
+		for _, c := range cl {
+			col.Images = append(col.Images, images[c.image].name)
+		}
+
+		owner := -1
+		if name, ok := owners[col.Asset]; ok {
+			for _, c := range cl {
+				if images[c.image].name == name {
+					owner = c.image
+				}
+			}
+			if owner < 0 {
+				logrus.WithFields(logrus.Fields{
+					"asset":  col.Asset,
+					"owner":  name,
+					"images": col.Images,
+				}).Warn("asset owner does not ship this asset, ignoring")
+			} else {
+				col.Resolution = collisionResolutionOwner
+			}
+		}
+		if owner < 0 {
+			col.Resolution = string(policy)
+			switch policy {
+			case CollisionPolicyLastWins:
+				owner = cl[len(cl)-1].image
+			case CollisionPolicyFail:
+				owner = cl[0].image
+				for _, c := range cl[1:] {
+					name := images[c.image].name
+					if _, ok := failed[name]; !ok {
+						failed[name] = errors.Errorf("asset %q collides with image %q", col.Asset, col.Images[0])
+					}
+				}
+			default:
+				owner = cl[0].image
+			}
+		}
+		col.Owner = images[owner].name
+
+		for _, c := range cl {
+			if c.image == owner {
+				continue
+			}
+			if dropped[c.image] == nil {
+				dropped[c.image] = map[string]bool{}
+			}
+			dropped[c.image][target] = true
+		}
+		collisions = append(collisions, col)
+	}
+
+	for i, targets := range dropped {
+		for g := range images[i].groups {
+			group := &images[i].groups[g]
+			ops := make([]assetOp, 0, len(group.ops))
+			for _, op := range group.ops {
+				if op.Kind != JournalDir && targets[op.Target] {
+					continue
+				}
+				ops = append(ops, op)
+			}
+			group.ops = ops
+		}
+	}
+
+	return collisions, failed
+}
+
+// clone returns a copy of `pi` whose propagation steps can be dropped
+// by resolveCollisions without affecting the original.
+func (pi *plannedImage) clone() *plannedImage {
+	if pi == nil {
+		return nil
+	}
+	c := *pi
+	c.groups = append([]plannedGroup(nil), pi.groups...)
+	return &c
+}
+
+// reassignCollisions resolves collisions again among `unresolved` images
+// (as planned before resolveCollisions), leaving out the `failed` ones.
+// It is used when the owner of some assets fails to apply, so that they
+// are taken from another image instead. Remaining images are returned
+// with their new propagation steps.
+func reassignCollisions(unresolved []*plannedImage, failed map[string]bool, policy CollisionPolicy, owners map[string]string) ([]*plannedImage, []AssetCollision, map[string]error) {
+	remaining := make([]*plannedImage, 0, len(unresolved))
+	for _, pi := range unresolved {
+		if pi == nil || failed[pi.name] {
+			continue
+		}
+		remaining = append(remaining, pi.clone())
+	}
+	collisions, collided := resolveCollisions(remaining, policy, owners)
+	return remaining, collisions, collided
+}
+
+// gainedGroups returns the propagation steps in `updated` which are not
+// in `current`, by asset group.
+func gainedGroups(current, updated *plannedImage) []plannedGroup {
+	have := map[string]bool{}
+	for _, g := range current.groups {
+		for _, op := range g.ops {
+			have[op.Target] = true
+		}
+	}
+
+	gained := []plannedGroup{}
+	for _, g := range updated.groups {
+		ops := []assetOp{}
+		for _, op := range g.ops {
+			if !have[op.Target] {
+				ops = append(ops, op)
+			}
+		}
+		if len(ops) > 0 {
+			gained = append(gained, plannedGroup{g.assetGroup, ops})
+		}
+	}
+	return gained
+}
+
+// ownsCollision checks whether image `name` owns any of `collisions`.
+func ownsCollision(collisions []AssetCollision, name string) bool {
+	for _, col := range collisions {
+		if col.Owner == name {
+			return true
+		}
+	}
+	return false
+}
+
+// upperAssetOwners returns the asset owners declared by the upper profile.
+func upperAssetOwners(applyCfg *ApplyConfig) (map[string]string, error) {
+	profilePath, err := upperProfilePath(applyCfg)
+	if err != nil || profilePath == "" {
+		return nil, err
+	}
+	return ReadProfileAssetOwners(profilePath)
+}
+
+// upperUnitOverrides returns the unit enablement overrides declared by
+// the upper profile, by image name.
+func upperUnitOverrides(applyCfg *ApplyConfig) (map[string]map[string]bool, error) {
+	profilePath, err := upperProfilePath(applyCfg)
+	if err != nil || profilePath == "" {
+		return nil, err
+	}
+	return ReadProfileUnitOverrides(profilePath)
+}
+
+// upperVerityRootHashes returns the dm-verity root hashes declared by
+// the upper profile, by image name.
+func upperVerityRootHashes(applyCfg *ApplyConfig) (map[string]string, error) {
+	profilePath, err := upperProfilePath(applyCfg)
+	if err != nil || profilePath == "" {
+		return nil, err
+	}
+	return ReadProfileVerityRootHashes(profilePath)
+}
+
+// upperProfilePath returns the path of the upper profile, if any.
+func upperProfilePath(applyCfg *ApplyConfig) (string, error) {
+	if applyCfg.UpperProfile == "" {
+		return "", nil
+	}
+	localProfiles, err := ListProfiles(applyCfg.ProfileDirs())
+	if err != nil {
+		return "", errors.Wrap(err, "profiles listing failed")
+	}
+	profilePath, ok := localProfiles[applyCfg.UpperProfile]
+	if !ok {
+		return "", errors.Errorf("profile %q not found", applyCfg.UpperProfile)
+	}
+	return profilePath, nil
+}
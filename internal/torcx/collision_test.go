@@ -0,0 +1,185 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveCollisions(t *testing.T) {
+	binGroup := assetGroup{kind: "bin", dir: "/run/torcx/bin", bins: true}
+	runcOp := func(image string) assetOp {
+		return assetOp{JournalSymlink, "/" + image + "/runc", "/run/torcx/bin/runc", "/" + image + "/runc"}
+	}
+	planned := func(names ...string) []*plannedImage {
+		images := []*plannedImage{}
+		for _, name := range names {
+			ops := []assetOp{runcOp(name)}
+			images = append(images, &plannedImage{name: name, groups: []plannedGroup{{binGroup, ops}}})
+		}
+		return images
+	}
+
+	testCases := []struct {
+		desc   string
+		policy CollisionPolicy
+		owners map[string]string
+
+		owner      string
+		resolution string
+		failed     []string
+	}{
+		{
+			desc:       "default",
+			owner:      "a",
+			resolution: "first-wins",
+		},
+		{
+			desc:       "last-wins",
+			policy:     CollisionPolicyLastWins,
+			owner:      "c",
+			resolution: "last-wins",
+		},
+		{
+			desc:       "fail",
+			policy:     CollisionPolicyFail,
+			owner:      "a",
+			resolution: "fail",
+			failed:     []string{"b", "c"},
+		},
+		{
+			desc:       "owner overrides fail",
+			policy:     CollisionPolicyFail,
+			owners:     map[string]string{"bin/runc": "b"},
+			owner:      "b",
+			resolution: "owner",
+		},
+		{
+			desc:       "unknown owner",
+			owners:     map[string]string{"bin/runc": "z"},
+			owner:      "a",
+			resolution: "first-wins",
+		},
+	}
+
+	for _, tt := range testCases {
+		images := planned("a", "b", "c")
+		collisions, failed := resolveCollisions(images, tt.policy, tt.owners)
+
+		expCollisions := []AssetCollision{{
+			Asset:      "bin/runc",
+			Target:     "/run/torcx/bin/runc",
+			Images:     []string{"a", "b", "c"},
+			Owner:      tt.owner,
+			Resolution: tt.resolution,
+		}}
+		if !reflect.DeepEqual(collisions, expCollisions) {
+			t.Errorf("%s: expected %#v, got %#v", tt.desc, expCollisions, collisions)
+		}
+		if len(failed) != len(tt.failed) {
+			t.Errorf("%s: expected failed images %v, got %v", tt.desc, tt.failed, failed)
+		}
+		for _, name := range tt.failed {
+			if _, ok := failed[name]; !ok {
+				t.Errorf("%s: expected image %q to fail", tt.desc, name)
+			}
+		}
+		for _, im := range images {
+			ops := im.groups[0].ops
+			if im.name == tt.owner && !reflect.DeepEqual(ops, []assetOp{runcOp(im.name)}) {
+				t.Errorf("%s: owner %q lost its asset", tt.desc, im.name)
+			}
+			if im.name != tt.owner && len(ops) != 0 {
+				t.Errorf("%s: image %q kept a contested asset", tt.desc, im.name)
+			}
+		}
+	}
+}
+
+func TestReassignCollisions(t *testing.T) {
+	binGroup := assetGroup{kind: "bin", dir: "/run/torcx/bin", bins: true}
+	op := func(image, name string) assetOp {
+		return assetOp{JournalSymlink, "/" + image + "/" + name, "/run/torcx/bin/" + name, "/" + image + "/" + name}
+	}
+	planned := func() []*plannedImage {
+		return []*plannedImage{
+			{name: "a", groups: []plannedGroup{{binGroup, []assetOp{op("a", "runc"), op("a", "ctr")}}}},
+			{name: "b", groups: []plannedGroup{{binGroup, []assetOp{op("b", "runc")}}}},
+			{name: "c", groups: []plannedGroup{{binGroup, []assetOp{op("c", "runc")}}}},
+		}
+	}
+
+	testCases := []struct {
+		desc   string
+		policy CollisionPolicy
+		failed map[string]bool
+
+		owner string
+	}{
+		{
+			desc:   "first-wins, owner failed",
+			failed: map[string]bool{"a": true},
+			owner:  "b",
+		},
+		{
+			desc:   "last-wins, owner failed",
+			policy: CollisionPolicyLastWins,
+			failed: map[string]bool{"c": true},
+			owner:  "b",
+		},
+		{
+			desc:   "fail, owner failed",
+			policy: CollisionPolicyFail,
+			failed: map[string]bool{"a": true},
+			owner:  "b",
+		},
+	}
+
+	for _, tt := range testCases {
+		unresolved := planned()
+		current := planned()
+		resolveCollisions(current, tt.policy, nil)
+
+		remaining, collisions, _ := reassignCollisions(unresolved, tt.failed, tt.policy, nil)
+		if len(remaining) != 2 {
+			t.Fatalf("%s: expected 2 remaining images, got %d", tt.desc, len(remaining))
+		}
+		if len(collisions) != 1 || collisions[0].Owner != tt.owner {
+			t.Errorf("%s: expected owner %q, got %#v", tt.desc, tt.owner, collisions)
+		}
+		if len(unresolved[1].groups[0].ops) != 1 {
+			t.Errorf("%s: unresolved plans modified", tt.desc)
+		}
+
+		for _, pi := range remaining {
+			var cur *plannedImage
+			for _, c := range current {
+				if c.name == pi.name {
+					cur = c
+				}
+			}
+			gained := gainedGroups(cur, pi)
+			if pi.name == tt.owner {
+				expected := []plannedGroup{{binGroup, []assetOp{op(pi.name, "runc")}}}
+				if !reflect.DeepEqual(gained, expected) {
+					t.Errorf("%s: expected %q to gain %#v, got %#v", tt.desc, pi.name, expected, gained)
+				}
+			} else if len(gained) != 0 {
+				t.Errorf("%s: expected %q to gain nothing, got %#v", tt.desc, pi.name, gained)
+			}
+		}
+	}
+}
@@ -45,6 +45,21 @@ func ValidateCommonConfig(commonCfg *CommonConfig) error {
 			return errors.Errorf("non absolute store path %q", p)
 		}
 	}
+	if err := commonCfg.CollisionPolicy.Validate(); err != nil {
+		return err
+	}
+	if err := commonCfg.ApplyMode.Validate(); err != nil {
+		return err
+	}
+	if err := commonCfg.SignaturePolicy.Validate(); err != nil {
+		return err
+	}
+	if commonCfg.OverlayTarget != "" && !filepath.IsAbs(commonCfg.OverlayTarget) {
+		return errors.Errorf("non-absolute overlay_target %q", commonCfg.OverlayTarget)
+	}
+	if _, err := commonCfg.RetryPolicy(); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -76,6 +91,7 @@ func ReadCommonConfig(cfgPath string, commonCfg *CommonConfig) error {
 	logrus.WithFields(logrus.Fields{
 		"path": cfgPath,
 	}).Debug("common config file read")
+	commonCfg.ConfigPath = cfgPath
 
 	// Populate with non-empty settings
 	if fileCfg.Value.BaseDir != "" {
@@ -90,6 +106,33 @@ func ReadCommonConfig(cfgPath string, commonCfg *CommonConfig) error {
 	if len(fileCfg.Value.StorePaths) > 0 {
 		commonCfg.StorePaths = append(commonCfg.StorePaths, fileCfg.Value.StorePaths...)
 	}
+	if fileCfg.Value.CollisionPolicy != "" {
+		commonCfg.CollisionPolicy = fileCfg.Value.CollisionPolicy
+	}
+	if fileCfg.Value.ApplyMode != "" {
+		commonCfg.ApplyMode = fileCfg.Value.ApplyMode
+	}
+	if fileCfg.Value.OverlayTarget != "" {
+		commonCfg.OverlayTarget = fileCfg.Value.OverlayTarget
+	}
+	if fileCfg.Value.UnpackCache {
+		commonCfg.UnpackCache = true
+	}
+	if fileCfg.Value.SignaturePolicy != "" {
+		commonCfg.SignaturePolicy = fileCfg.Value.SignaturePolicy
+	}
+	if fileCfg.Value.FetchRetries != nil {
+		commonCfg.FetchRetries = fileCfg.Value.FetchRetries
+	}
+	if fileCfg.Value.FetchBackoff != "" {
+		commonCfg.FetchBackoff = fileCfg.Value.FetchBackoff
+	}
+	if fileCfg.Value.FetchMaxBackoff != "" {
+		commonCfg.FetchMaxBackoff = fileCfg.Value.FetchMaxBackoff
+	}
+	if fileCfg.Value.FetchTimeout != "" {
+		commonCfg.FetchTimeout = fileCfg.Value.FetchTimeout
+	}
 
 	return nil
 }
@@ -98,7 +141,7 @@ func ReadCommonConfig(cfgPath string, commonCfg *CommonConfig) error {
 func RuntimeConfigPath() string {
 	cfgPath, err := procConfigPath()
 	if err != nil {
-		cfgPath = defaultCfgPath
+		cfgPath = DefaultConfigPath
 	}
 	return cfgPath
 }
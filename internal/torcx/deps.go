@@ -0,0 +1,222 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// providesName checks whether image `pi` provides `name`, either as its
+// own name or as one of its `provides` entries.
+func providesName(pi *plannedImage, name string) bool {
+	if pi.name == name {
+		return true
+	}
+	for _, p := range pi.deps.Provides {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// conflictsWith returns the first name provided by `b` which `a` conflicts with.
+func conflictsWith(a, b *plannedImage) (string, bool) {
+	for _, c := range a.deps.Conflicts {
+		if providesName(b, c) {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// resolveDependencies orders images so that each one comes after all the
+// images providing its requirements, otherwise keeping profile order.
+// Images conflicting with an earlier one, with unmet requirements, or in a
+// dependency cycle are returned with the corresponding error.
+// The returned order covers all images: nil and failed entries come last.
+func resolveDependencies(images []*plannedImage) ([]int, map[string]error) {
+	failed := map[string]error{}
+	active := func(i int) bool {
+		if images[i] == nil {
+			return false
+		}
+		_, ok := failed[images[i].name]
+		return !ok
+	}
+	providers := func(name string, self int) []int {
+		res := []int{}
+		for j := range images {
+			if j != self && active(j) && providesName(images[j], name) {
+				res = append(res, j)
+			}
+		}
+		return res
+	}
+
+	// Conflicting images: the later one in profile order fails
+	for i := range images {
+		for j := 0; j < i && active(i); j++ {
+			if !active(j) {
+				continue
+			}
+			if c, ok := conflictsWith(images[i], images[j]); ok {
+				failed[images[i].name] = errors.Errorf("conflicts with %q, provided by image %q", c, images[j].name)
+			} else if c, ok := conflictsWith(images[j], images[i]); ok {
+				failed[images[i].name] = errors.Errorf("provides %q, conflicting with image %q", c, images[j].name)
+			}
+		}
+	}
+
+	// Unmet requirements, cascading to dependent images
+	for changed := true; changed; {
+		changed = false
+		for i := range images {
+			if !active(i) {
+				continue
+			}
+			for _, req := range images[i].deps.Requires {
+				if len(providers(req, i)) == 0 {
+					failed[images[i].name] = errors.Errorf("requirement %q not satisfied", req)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	// Stable topological sort, always picking the first ready image
+	order := make([]int, 0, len(images))
+	placed := make([]bool, len(images))
+	for progress := true; progress; {
+		progress = false
+		for i := range images {
+			if placed[i] || !active(i) {
+				continue
+			}
+			ready := true
+			for _, req := range images[i].deps.Requires {
+				for _, j := range providers(req, i) {
+					if !placed[j] {
+						ready = false
+					}
+				}
+			}
+			if ready {
+				order = append(order, i)
+				placed[i] = true
+				progress = true
+				break
+			}
+		}
+	}
+	for i := range images {
+		if active(i) && !placed[i] {
+			failed[images[i].name] = errors.New("dependency cycle")
+		}
+	}
+
+	for i := range images {
+		if !placed[i] {
+			order = append(order, i)
+		}
+	}
+	return order, failed
+}
+
+// unmetRequirement returns an error for the first requirement of `pi`
+// not provided by any of the `applied` images, e.g. as all its providers
+// failed to apply after dependencies were resolved.
+func unmetRequirement(pi *plannedImage, applied []*plannedImage) error {
+	for _, req := range pi.deps.Requires {
+		met := false
+		for _, a := range applied {
+			if a != pi && providesName(a, req) {
+				met = true
+				break
+			}
+		}
+		if !met {
+			return errors.Errorf("requirement %q not satisfied, no image providing it was applied", req)
+		}
+	}
+	return nil
+}
+
+// ProfileReport describes how images in a profile relate to each other.
+type ProfileReport struct {
+	// Order lists image names in apply order
+	Order []string
+	// Unsatisfied maps images to their unsatisfied constraint
+	Unsatisfied map[string]error
+	// Collisions lists assets shipped by more than one image
+	Collisions []AssetCollision
+}
+
+// InspectProfile checks dependencies and asset collisions between `images`,
+// by inspecting their archives. Missing images are skipped. Archives which
+// cannot be inspected without mounting them only provide their own name.
+// `owners` and `unitOverrides` are as declared by the profile.
+func InspectProfile(applyCfg *ApplyConfig, storeCache *StoreCache, images []Image, owners map[string]string, unitOverrides map[string]map[string]bool) (*ProfileReport, error) {
+	if applyCfg == nil {
+		return nil, errors.New("missing apply configuration")
+	}
+	if storeCache == nil {
+		return nil, errors.New("missing store cache")
+	}
+
+	planned := make([]*plannedImage, len(images))
+	for i, im := range images {
+		logFields := logrus.Fields{
+			"image":     im.Name,
+			"reference": im.Reference,
+		}
+		archive, err := storeCache.ArchiveFor(im)
+		if err != nil {
+			continue
+		}
+		imageRoot := filepath.Join(applyCfg.RunUnpackDir(), im.Name)
+		fsys, err := inspectArchive(archive, imageRoot)
+		if err != nil {
+			logrus.WithFields(logFields).Warn("skipping manifest checks: ", err)
+			planned[i] = &plannedImage{name: im.Name}
+			continue
+		}
+		pi, err := planImageManifest(applyCfg, fsys, im.Name, imageRoot, unitOverrides[im.Name])
+		if err != nil {
+			return nil, errors.Wrapf(err, "image %s:%s", im.Name, im.Reference)
+		}
+		planned[i] = pi
+	}
+
+	order, unsatisfied := resolveDependencies(planned)
+	report := &ProfileReport{
+		Order:       make([]string, 0, len(order)),
+		Unsatisfied: unsatisfied,
+	}
+	ordered := make([]*plannedImage, 0, len(order))
+	for _, i := range order {
+		report.Order = append(report.Order, images[i].Name)
+		if _, ok := unsatisfied[images[i].Name]; !ok {
+			ordered = append(ordered, planned[i])
+		}
+	}
+	report.Collisions, _ = resolveCollisions(ordered, applyCfg.CollisionPolicy, owners)
+
+	return report, nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestResolveDependencies(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		images []*plannedImage
+
+		order  []string
+		failed []string
+	}{
+		{
+			desc: "profile order",
+			images: []*plannedImage{
+				{name: "a"},
+				{name: "b"},
+			},
+			order: []string{"a", "b"},
+		},
+		{
+			desc: "requirement reorders",
+			images: []*plannedImage{
+				{name: "docker", deps: Dependencies{Requires: []string{"containerd"}}},
+				{name: "toolbox"},
+				{name: "containerd"},
+			},
+			order: []string{"toolbox", "containerd", "docker"},
+		},
+		{
+			desc: "provides",
+			images: []*plannedImage{
+				{name: "kubelet", deps: Dependencies{Requires: []string{"container-runtime"}}},
+				{name: "docker", deps: Dependencies{Provides: []string{"container-runtime"}}},
+			},
+			order: []string{"docker", "kubelet"},
+		},
+		{
+			desc: "unmet requirement cascades",
+			images: []*plannedImage{
+				{name: "kubelet", deps: Dependencies{Requires: []string{"docker"}}},
+				{name: "docker", deps: Dependencies{Requires: []string{"containerd"}}},
+				{name: "toolbox"},
+			},
+			order:  []string{"toolbox", "kubelet", "docker"},
+			failed: []string{"docker", "kubelet"},
+		},
+		{
+			desc: "conflicts",
+			images: []*plannedImage{
+				{name: "docker-ce", deps: Dependencies{Provides: []string{"docker"}}},
+				{name: "docker", deps: Dependencies{Conflicts: []string{"docker-ce"}}},
+				{name: "kubelet", deps: Dependencies{Conflicts: []string{"rkt"}}},
+				{name: "rkt"},
+			},
+			order:  []string{"docker-ce", "kubelet", "docker", "rkt"},
+			failed: []string{"docker", "rkt"},
+		},
+		{
+			desc: "cycle",
+			images: []*plannedImage{
+				{name: "a", deps: Dependencies{Requires: []string{"b"}}},
+				{name: "b", deps: Dependencies{Requires: []string{"a"}}},
+				nil,
+				{name: "c"},
+			},
+			order:  []string{"c", "a", "b", ""},
+			failed: []string{"a", "b"},
+		},
+	}
+
+	for _, tt := range testCases {
+		order, failed := resolveDependencies(tt.images)
+
+		names := []string{}
+		for _, i := range order {
+			name := ""
+			if tt.images[i] != nil {
+				name = tt.images[i].name
+			}
+			names = append(names, name)
+		}
+		if !reflect.DeepEqual(names, tt.order) {
+			t.Errorf("%s: expected order %v, got %v", tt.desc, tt.order, names)
+		}
+
+		failedNames := []string{}
+		for name := range failed {
+			failedNames = append(failedNames, name)
+		}
+		sort.Strings(failedNames)
+		if len(failedNames) != len(tt.failed) || (len(tt.failed) > 0 && !reflect.DeepEqual(failedNames, tt.failed)) {
+			t.Errorf("%s: expected failed %v, got %v", tt.desc, tt.failed, failed)
+		}
+	}
+}
+
+func TestUnmetRequirement(t *testing.T) {
+	runc := &plannedImage{name: "runc-1", deps: Dependencies{Provides: []string{"runc"}}}
+	containerd := &plannedImage{name: "containerd"}
+	docker := &plannedImage{name: "docker", deps: Dependencies{Requires: []string{"runc", "containerd"}}}
+
+	testCases := []struct {
+		desc    string
+		image   *plannedImage
+		applied []*plannedImage
+		isErr   bool
+	}{
+		{"all applied", docker, []*plannedImage{runc, containerd}, false},
+		{"provider failed", docker, []*plannedImage{containerd}, true},
+		{"nothing applied", docker, nil, true},
+		{"no requirements", containerd, nil, false},
+	}
+
+	for _, tt := range testCases {
+		err := unmetRequirement(tt.image, tt.applied)
+		if tt.isErr != (err != nil) {
+			t.Errorf("%s: unexpected error %v", tt.desc, err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ArchiveDigestSuffix is the file suffix of digest sidecars, stored
+// next to image archives in the store.
+const ArchiveDigestSuffix = ".digest"
+
+// DigestPath returns the path of the digest sidecar for an archive.
+func DigestPath(archivePath string) string {
+	return archivePath + ArchiveDigestSuffix
+}
+
+// parseHash parses a hash in the `<algorithm>-<hex>` format used by remotes.
+func parseHash(hash string) (digest.Digest, error) {
+	d, err := digest.Parse(strings.Replace(strings.TrimSpace(hash), "-", ":", 1))
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid hash %q", hash)
+	}
+	return d, nil
+}
+
+// formatHash formats a digest in the `<algorithm>-<hex>` format used by remotes.
+func formatHash(d digest.Digest) string {
+	return strings.Replace(d.String(), ":", "-", 1)
+}
+
+// WriteArchiveDigest atomically writes the digest sidecar for the archive
+// at `archivePath`.
+func WriteArchiveDigest(archivePath string, d digest.Digest) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(archivePath), ".digest")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName)
+	defer tmpFile.Close()
+
+	if _, err := io.WriteString(tmpFile, formatHash(d)+"\n"); err != nil {
+		return errors.Wrapf(err, "failed to write %s", tmpName)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close %s", tmpName)
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return errors.Wrapf(err, "failed to chmod %s", tmpName)
+	}
+	sidecar := DigestPath(archivePath)
+	if err := os.Rename(tmpName, sidecar); err != nil {
+		return errors.Wrapf(err, "failed to save %s", sidecar)
+	}
+	return nil
+}
+
+// readArchiveDigest reads the digest sidecar for the archive at
+// `archivePath`. It returns an empty digest if there is none.
+func readArchiveDigest(archivePath string) (digest.Digest, error) {
+	b, err := ioutil.ReadFile(DigestPath(archivePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return parseHash(string(b))
+}
+
+// verifyArchive checks `archive` against its digest sidecar, returning
+// the verified digest. Archives without a sidecar are an error if `require`
+// is set, and are otherwise not verified. The sidecar detects corrupted
+// archives, not tampered ones: anyone able to replace the archive can
+// replace it too. Pinned archives are read from the same file they are
+// unpacked from.
+func verifyArchive(archive Archive, require bool) (digest.Digest, error) {
+	archivePath := archive.Filepath
+	d, err := readArchiveDigest(archivePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read digest for %s", archivePath)
+	}
+	if d == "" {
+		if require {
+			return "", errors.Errorf("no digest for %s", archivePath)
+		}
+		if archive.Format == ArchiveFormatOCI {
+			// Layout directories cannot carry a sidecar
+			logrus.WithField("path", archivePath).Debug("archive digest not verified")
+		} else {
+			logrus.WithField("path", archivePath).Warn("no digest for archive, skipping verification")
+		}
+		return "", nil
+	}
+
+	fp, err := archive.open()
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	verifier := d.Verifier()
+	if _, err := io.Copy(verifier, bufio.NewReader(fp)); err != nil {
+		return "", errors.Wrapf(err, "failed to read %s", archivePath)
+	}
+	if !verifier.Verified() {
+		return "", errors.Errorf("mismatching digest for %s, expected %s", archivePath, formatHash(d))
+	}
+	return d, nil
+}
+
+// ImportArchive copies the image archive at `srcPath` into the store
+// directory `storeDir`, along with its digest sidecar. If `hash` is not
+// empty, the archive must match it. It returns the path of the imported archive.
+func ImportArchive(srcPath string, storeDir string, hash string) (string, error) {
+	fileName := filepath.Base(srcPath)
+	switch ArchiveFormatFor(fileName) {
+	case ArchiveFormatUnknown:
+		return "", errors.Errorf("invalid extension for image archive %s", fileName)
+	case ArchiveFormatOCI:
+		return "", errors.Errorf("cannot import OCI layout directory %s, use an oci-archive", fileName)
+	}
+	targetPath := filepath.Join(storeDir, fileName)
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	tmpFile, err := ioutil.TempFile(storeDir, ".importimg")
+	if err != nil {
+		return "", err
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName)
+	defer tmpFile.Close()
+
+	var expected digest.Digest
+	digester := digest.SHA512.Digester()
+	if hash != "" {
+		if expected, err = parseHash(hash); err != nil {
+			return "", err
+		}
+		digester = expected.Algorithm().Digester()
+	}
+	wr := io.MultiWriter(tmpFile, digester.Hash())
+	if _, err := io.Copy(wr, bufio.NewReader(src)); err != nil {
+		return "", errors.Wrapf(err, "failed to copy %s", srcPath)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return "", errors.Wrapf(err, "failed to close %s", tmpName)
+	}
+	if err := os.Chmod(tmpName, 0755); err != nil {
+		return "", errors.Wrapf(err, "failed to chmod %s", tmpName)
+	}
+
+	d := digester.Digest()
+	if expected != "" && d != expected {
+		return "", errors.Errorf("mismatching hash for %s", srcPath)
+	}
+	if err := WriteArchiveDigest(targetPath, d); err != nil {
+		return "", err
+	}
+	sig, err := ioutil.ReadFile(SignaturePath(srcPath))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := writeSignature(targetPath, sig); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpName, targetPath); err != nil {
+		return "", errors.Wrapf(err, "failed to save %s", targetPath)
+	}
+	return targetPath, nil
+}
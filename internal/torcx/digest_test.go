@@ -0,0 +1,89 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportVerifyArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_test_digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srcPath := filepath.Join(dir, "foo:1.torcx.tgz")
+	if err := ioutil.WriteFile(srcPath, []byte("foo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	storeDir := filepath.Join(dir, "store")
+	if err := os.Mkdir(storeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// No sidecar, nothing to verify unless required
+	if d, err := verifyArchive(Archive{Filepath: srcPath}, false); err != nil || d != "" {
+		t.Fatalf("unexpected verification of %s: %q, %v", srcPath, d, err)
+	}
+	if _, err := verifyArchive(Archive{Filepath: srcPath}, true); err == nil {
+		t.Fatalf("expected verification failure for %s without digest", srcPath)
+	}
+
+	fooHash := "sha512-f7fbba6e0636f890e56fbbf3283e524c6fa3204ae298382d624741d0dc6638326e282c41be5e4254d8820772c5518a2c5a8c0c7f7eda19594a7eb539453e1ed7"
+	if _, err := ImportArchive(srcPath, storeDir, "sha512-00"); err == nil {
+		t.Fatal("expected import failure with an invalid hash")
+	}
+	if _, err := ImportArchive(srcPath, storeDir, "sha512-"+strings.Repeat("0", 128)); err == nil {
+		t.Fatal("expected import failure with a mismatching hash")
+	}
+	archivePath, err := ImportArchive(srcPath, storeDir, fooHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := Archive{Filepath: archivePath, Format: ArchiveFormatTgz}
+
+	d, err := verifyArchive(archive, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatHash(d) != fooHash {
+		t.Fatalf("expected digest %s, got %s", fooHash, d)
+	}
+
+	// A pinned archive keeps being read from the same file once replaced
+	if err := archive.pin(); err != nil {
+		t.Fatal(err)
+	}
+	defer archive.unpin()
+	if err := ioutil.WriteFile(srcPath, []byte("bar"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(srcPath, archivePath); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := verifyArchive(archive, true); err != nil {
+			t.Fatalf("pinned archive, read #%d: %v", i, err)
+		}
+	}
+	archive.unpin()
+	if _, err := verifyArchive(archive, true); err == nil {
+		t.Fatal("expected verification failure for a corrupted archive")
+	}
+}
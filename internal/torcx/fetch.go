@@ -0,0 +1,176 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// DefaultRetryPolicy is used for settings missing from the config file.
+	DefaultRetryPolicy = RetryPolicy{
+		Retries:    5,
+		Backoff:    1 * time.Second,
+		MaxBackoff: 30 * time.Second,
+		Timeout:    10 * time.Minute,
+	}
+)
+
+// RetryPolicy selects how failed fetches from remotes are retried.
+type RetryPolicy struct {
+	// Retries is the maximum number of retries after a failed attempt
+	Retries int
+	// Backoff is the delay before the first retry, doubled on each retry
+	Backoff time.Duration
+	// MaxBackoff caps the delay between retries
+	MaxBackoff time.Duration
+	// Timeout bounds fetching all remote manifests and images, as a whole
+	Timeout time.Duration
+}
+
+// Validate checks that the policy settings are in range.
+func (rp RetryPolicy) Validate() error {
+	if rp.Retries < 0 {
+		return errors.Errorf("negative fetch retries %d", rp.Retries)
+	}
+	if rp.Backoff < 0 {
+		return errors.Errorf("negative fetch backoff %s", rp.Backoff)
+	}
+	if rp.MaxBackoff < 0 {
+		return errors.Errorf("negative fetch max backoff %s", rp.MaxBackoff)
+	}
+	if rp.Timeout <= 0 {
+		return errors.Errorf("non-positive fetch timeout %s", rp.Timeout)
+	}
+	return nil
+}
+
+// RetryPolicy returns the retry policy for fetching from remotes, from
+// the config file settings and defaults.
+func (cc *CommonConfig) RetryPolicy() (RetryPolicy, error) {
+	rp := DefaultRetryPolicy
+	if cc.FetchRetries != nil {
+		rp.Retries = *cc.FetchRetries
+	}
+	durations := []struct {
+		name  string
+		value string
+		dest  *time.Duration
+	}{
+		{"fetch_backoff", cc.FetchBackoff, &rp.Backoff},
+		{"fetch_max_backoff", cc.FetchMaxBackoff, &rp.MaxBackoff},
+		{"fetch_timeout", cc.FetchTimeout, &rp.Timeout},
+	}
+	for _, d := range durations {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil {
+			return rp, errors.Wrapf(err, "invalid %s", d.name)
+		}
+		*d.dest = parsed
+	}
+	return rp, rp.Validate()
+}
+
+// delay returns how long to wait before retry number `retry` (from 1),
+// growing exponentially up to MaxBackoff. Half of the delay is jittered,
+// so that hosts failing together do not retry in lockstep.
+func (rp RetryPolicy) delay(retry int, rnd *rand.Rand) time.Duration {
+	d := rp.Backoff
+	for i := 1; i < retry && d < rp.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > rp.MaxBackoff {
+		d = rp.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rnd.Int63n(int64(d-half)+1))
+}
+
+// retry calls `fetch` until it succeeds, fails with a permanent error,
+// retries are exhausted or `ctx` expires. The last fetch error is returned.
+func (rp RetryPolicy) retry(ctx context.Context, logFields logrus.Fields, fetch func() error) error {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for attempt := 1; ; attempt++ {
+		err := fetch()
+		if err == nil {
+			return nil
+		}
+		if isPermanent(err) {
+			return err
+		}
+		if attempt > rp.Retries || ctx.Err() != nil {
+			return errors.Wrapf(err, "giving up after %d attempts", attempt)
+		}
+
+		delay := rp.delay(attempt, rnd)
+		logrus.WithFields(logFields).WithFields(logrus.Fields{
+			"attempt": attempt,
+			"delay":   delay,
+			"error":   err,
+		}).Warn("fetch failed, retrying")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return errors.Wrapf(err, "giving up after %d attempts", attempt)
+		}
+	}
+}
+
+// permanentError marks fetch errors which are not worth retrying.
+type permanentError struct {
+	error
+}
+
+// permanent marks `err` as not worth retrying.
+func permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// isPermanent checks whether `err` is marked as not worth retrying.
+func isPermanent(err error) bool {
+	_, ok := errors.Cause(err).(permanentError)
+	return ok
+}
+
+// checkResponse turns unsuccessful HTTP responses into errors. Client
+// errors are permanent, except for timeouts and rate limiting.
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	err := errors.Errorf("GET %s: %s", resp.Request.URL, resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return err
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return permanent(err)
+	}
+	return err
+}
@@ -0,0 +1,260 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCommonConfigRetryPolicy(t *testing.T) {
+	zero, negative := 0, -1
+
+	testCases := []struct {
+		desc     string
+		cfg      CommonConfig
+		expected RetryPolicy
+		isErr    bool
+	}{
+		{
+			"defaults",
+			CommonConfig{},
+			DefaultRetryPolicy,
+			false,
+		},
+		{
+			"no retries",
+			CommonConfig{FetchRetries: &zero, FetchTimeout: "5m"},
+			RetryPolicy{Retries: 0, Backoff: time.Second, MaxBackoff: 30 * time.Second, Timeout: 5 * time.Minute},
+			false,
+		},
+		{
+			"backoff",
+			CommonConfig{FetchBackoff: "250ms", FetchMaxBackoff: "2s"},
+			RetryPolicy{Retries: 5, Backoff: 250 * time.Millisecond, MaxBackoff: 2 * time.Second, Timeout: 10 * time.Minute},
+			false,
+		},
+		{
+			"negative retries",
+			CommonConfig{FetchRetries: &negative},
+			RetryPolicy{},
+			true,
+		},
+		{
+			"invalid duration",
+			CommonConfig{FetchBackoff: "soon"},
+			RetryPolicy{},
+			true,
+		},
+		{
+			"zero timeout",
+			CommonConfig{FetchTimeout: "0s"},
+			RetryPolicy{},
+			true,
+		},
+	}
+
+	for _, tt := range testCases {
+		rp, err := tt.cfg.RetryPolicy()
+		if tt.isErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %#v", tt.desc, rp)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+		if rp != tt.expected {
+			t.Errorf("%s: expected %#v, got %#v", tt.desc, tt.expected, rp)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	rp := RetryPolicy{Backoff: time.Second, MaxBackoff: 10 * time.Second}
+	rnd := rand.New(rand.NewSource(1))
+
+	testCases := []struct {
+		retry int
+		max   time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+
+	for _, tt := range testCases {
+		for i := 0; i < 10; i++ {
+			d := rp.delay(tt.retry, rnd)
+			if d < tt.max/2 || d > tt.max {
+				t.Errorf("retry %d: expected delay in [%s, %s], got %s", tt.retry, tt.max/2, tt.max, d)
+			}
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	rp := RetryPolicy{Retries: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, Timeout: time.Minute}
+	transient := errors.New("connection reset")
+
+	testCases := []struct {
+		desc     string
+		failures int
+		err      error
+		attempts int
+		isErr    bool
+	}{
+		{"success", 0, nil, 1, false},
+		{"transient", 2, transient, 3, false},
+		{"exhausted", 10, transient, 4, true},
+		{"permanent", 10, permanent(errors.New("mismatching hash")), 1, true},
+		{"wrapped permanent", 10, errors.Wrap(permanent(errors.New("not found")), "fetching"), 1, true},
+	}
+
+	for _, tt := range testCases {
+		attempts := 0
+		err := rp.retry(context.Background(), logrus.Fields{}, func() error {
+			attempts++
+			if attempts <= tt.failures {
+				return tt.err
+			}
+			return nil
+		})
+		if tt.isErr != (err != nil) {
+			t.Errorf("%s: unexpected error %v", tt.desc, err)
+		}
+		if attempts != tt.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", tt.desc, tt.attempts, attempts)
+		}
+	}
+
+	// The last fetch error is reported once the deadline expires
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	rp = RetryPolicy{Retries: 1000, Backoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond, Timeout: time.Minute}
+	err := rp.retry(ctx, logrus.Fields{}, func() error {
+		return transient
+	})
+	if errors.Cause(err) != transient {
+		t.Errorf("expected %q, got %v", transient, err)
+	}
+}
+
+func TestFetchManifestStatus(t *testing.T) {
+	statuses := map[string]int{
+		"/ok":        http.StatusOK,
+		"/missing":   http.StatusNotFound,
+		"/throttled": http.StatusTooManyRequests,
+		"/broken":    http.StatusInternalServerError,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[r.URL.Path])
+		w.Write([]byte("manifest"))
+	}))
+	defer srv.Close()
+
+	testCases := []struct {
+		path      string
+		isErr     bool
+		permanent bool
+	}{
+		{"/ok", false, false},
+		{"/missing", true, true},
+		{"/throttled", true, false},
+		{"/broken", true, false},
+	}
+
+	for _, tt := range testCases {
+		manifest, err := fetchManifest(context.Background(), srv.URL+tt.path)
+		if tt.isErr != (err != nil) {
+			t.Errorf("%s: unexpected error %v", tt.path, err)
+		}
+		if isPermanent(err) != tt.permanent {
+			t.Errorf("%s: expected permanent %t, got %v", tt.path, tt.permanent, err)
+		}
+		if err == nil && manifest != "manifest" {
+			t.Errorf("%s: expected manifest, got %q", tt.path, manifest)
+		}
+	}
+}
+
+func TestFetchSignature(t *testing.T) {
+	statuses := map[string]int{
+		"/signed.torcx.tgz.asc":   http.StatusOK,
+		"/unsigned.torcx.tgz.asc": http.StatusNotFound,
+		"/broken.torcx.tgz.asc":   http.StatusInternalServerError,
+	}
+	var mu sync.Mutex
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		w.WriteHeader(statuses[r.URL.Path])
+		w.Write([]byte("signature"))
+	}))
+	defer srv.Close()
+
+	testCases := []struct {
+		policy   SignaturePolicy
+		name     string
+		sig      string
+		isErr    bool
+		requests int
+	}{
+		{SignaturePolicyVerify, "signed", "signature", false, 1},
+		{SignaturePolicyVerify, "unsigned", "", false, 1},
+		{SignaturePolicyVerify, "broken", "", false, 3},
+		{SignaturePolicyRequire, "signed", "signature", false, 1},
+		{SignaturePolicyRequire, "unsigned", "", false, 1},
+		{SignaturePolicyRequire, "broken", "", true, 3},
+	}
+
+	for _, tt := range testCases {
+		rc := RemotesCache{
+			Retry:           RetryPolicy{Retries: 2, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, Timeout: time.Minute},
+			SignaturePolicy: tt.policy,
+		}
+		archiveURL, err := url.Parse(srv.URL + "/" + tt.name + ".torcx.tgz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = map[string]int{}
+		sig, err := rc.fetchSignature(context.Background(), archiveURL)
+		if tt.isErr != (err != nil) {
+			t.Errorf("%s, %s: unexpected error %v", tt.policy, tt.name, err)
+		}
+		if string(sig) != tt.sig {
+			t.Errorf("%s, %s: expected signature %q, got %q", tt.policy, tt.name, tt.sig, sig)
+		}
+		if n := requests["/"+tt.name+".torcx.tgz.asc"]; n != tt.requests {
+			t.Errorf("%s, %s: expected %d requests, got %d", tt.policy, tt.name, tt.requests, n)
+		}
+	}
+}
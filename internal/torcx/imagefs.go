@@ -0,0 +1,236 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// imageFS provides read-only access to the content of an image.
+// All paths are host paths, anchored at the image root directory.
+type imageFS interface {
+	// Stat returns file info for `name`, following symlinks.
+	Stat(name string) (os.FileInfo, error)
+	// Readlink returns the destination of the symlink `name`.
+	Readlink(name string) (string, error)
+	// ReadFile returns the content of the file `name`.
+	ReadFile(name string) ([]byte, error)
+	// Walk walks the tree rooted at `root`, like filepath.Walk.
+	Walk(root string, walkFn filepath.WalkFunc) error
+}
+
+// hostFS is an imageFS for images already unpacked or mounted on the host.
+type hostFS struct{}
+
+func (hostFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (hostFS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+func (hostFS) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (hostFS) Walk(root string, walkFn filepath.WalkFunc) error {
+	return filepath.Walk(root, walkFn)
+}
+
+// tarFS is an imageFS indexing the headers of a tar archive, as if it
+// was unpacked at `root`. Only the content of torcx metadata and systemd
+// presets is retained.
+type tarFS struct {
+	root     string
+	headers  map[string]*tar.Header
+	children map[string][]string
+	contents map[string][]byte
+}
+
+// newTarFS indexes all entries from a tar reader, anchoring them at `root`.
+func newTarFS(tr *tar.Reader, root string) (*tarFS, error) {
+	if tr == nil {
+		return nil, errors.New("invalid tar reader")
+	}
+	tfs := &tarFS{
+		root:     filepath.Clean(root),
+		headers:  map[string]*tar.Header{},
+		children: map[string][]string{},
+		contents: map[string][]byte{},
+	}
+	metaDir := filepath.Join(tfs.root, filepath.Dir(manifestPath))
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Clean before joining to remove all .. elements
+		path := filepath.Join(tfs.root, filepath.Clean("/"+hdr.Name))
+		if path == tfs.root {
+			continue
+		}
+		tfs.addParents(path)
+		if _, ok := tfs.headers[path]; !ok {
+			parent := filepath.Dir(path)
+			tfs.children[parent] = append(tfs.children[parent], filepath.Base(path))
+		}
+		tfs.headers[path] = hdr
+
+		if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+			if filepath.Dir(path) == metaDir || strings.HasSuffix(path, ".preset") {
+				b, err := ioutil.ReadAll(tr)
+				if err != nil {
+					return nil, errors.Wrapf(err, "reading %q", hdr.Name)
+				}
+				tfs.contents[path] = b
+			}
+		}
+	}
+
+	for _, names := range tfs.children {
+		sort.Strings(names)
+	}
+	return tfs, nil
+}
+
+// addParents synthesizes missing parent directories for `path`.
+func (tfs *tarFS) addParents(path string) {
+	parent := filepath.Dir(path)
+	if parent == tfs.root || !strings.HasPrefix(parent, tfs.root) {
+		return
+	}
+	if _, ok := tfs.headers[parent]; ok {
+		return
+	}
+	tfs.addParents(parent)
+	tfs.headers[parent] = &tar.Header{
+		Name:     strings.TrimPrefix(parent, tfs.root),
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		ModTime:  time.Now(),
+	}
+	grandParent := filepath.Dir(parent)
+	tfs.children[grandParent] = append(tfs.children[grandParent], filepath.Base(parent))
+}
+
+// lstat returns file info for `name`, without following symlinks.
+func (tfs *tarFS) lstat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	if name == tfs.root {
+		hdr := &tar.Header{Name: "/", Typeflag: tar.TypeDir, Mode: 0755}
+		return hdr.FileInfo(), nil
+	}
+	hdr, ok := tfs.headers[name]
+	if !ok {
+		return nil, &os.PathError{Op: "lstat", Path: name, Err: os.ErrNotExist}
+	}
+	return hdr.FileInfo(), nil
+}
+
+func (tfs *tarFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+	// Follow symlinks within the image, with a bounded number of hops
+	for i := 0; i < 40; i++ {
+		hdr, ok := tfs.headers[name]
+		if !ok || hdr.Typeflag != tar.TypeSymlink {
+			return tfs.lstat(name)
+		}
+		dest := hdr.Linkname
+		if filepath.IsAbs(dest) {
+			name = filepath.Join(tfs.root, dest)
+		} else {
+			name = filepath.Join(filepath.Dir(name), dest)
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: errors.New("too many levels of symbolic links")}
+}
+
+func (tfs *tarFS) Readlink(name string) (string, error) {
+	hdr, ok := tfs.headers[filepath.Clean(name)]
+	if !ok {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: os.ErrNotExist}
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		return "", &os.PathError{Op: "readlink", Path: name, Err: errors.New("not a symlink")}
+	}
+	return hdr.Linkname, nil
+}
+
+func (tfs *tarFS) ReadFile(name string) ([]byte, error) {
+	name = filepath.Clean(name)
+	if _, err := tfs.Stat(name); err != nil {
+		return nil, err
+	}
+	b, ok := tfs.contents[name]
+	if !ok {
+		return nil, errors.Errorf("content of %q not available in archive index", name)
+	}
+	return b, nil
+}
+
+func (tfs *tarFS) Walk(root string, walkFn filepath.WalkFunc) error {
+	root = filepath.Clean(root)
+	info, err := tfs.lstat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	err = tfs.walk(root, info, walkFn)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walk recursively descends `path`, mimicking filepath.Walk semantics.
+func (tfs *tarFS) walk(path string, info os.FileInfo, walkFn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return walkFn(path, info, nil)
+	}
+
+	if err := walkFn(path, info, nil); err != nil {
+		return err
+	}
+	for _, name := range tfs.children[path] {
+		child := filepath.Join(path, name)
+		childInfo, err := tfs.lstat(child)
+		if err != nil {
+			if err := walkFn(child, childInfo, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		err = tfs.walk(child, childInfo, walkFn)
+		if err != nil {
+			if !childInfo.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
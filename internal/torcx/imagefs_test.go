@@ -0,0 +1,111 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestTarFSPlan(t *testing.T) {
+	manifest := `{"kind": "image-manifest-v0", "value": {"bin": ["/usr/bin"], "units": ["/lib/systemd/system/foo.service", "/lib/systemd/system/multi-user.target.wants"], "sysctl": ["/usr/lib/sysctl.d/50-foo.conf"]}}`
+	entries := []struct {
+		hdr     tar.Header
+		content string
+	}{
+		{tar.Header{Name: "./.torcx/manifest.json", Typeflag: tar.TypeReg}, manifest},
+		{tar.Header{Name: "./usr/bin/foo", Typeflag: tar.TypeReg}, "#!"},
+		{tar.Header{Name: "./usr/bin/sub/bar", Typeflag: tar.TypeReg}, "#!"},
+		{tar.Header{Name: "./lib/systemd/system/foo.service", Typeflag: tar.TypeReg}, "[Unit]"},
+		{tar.Header{Name: "./lib/systemd/system/multi-user.target.wants/", Typeflag: tar.TypeDir}, ""},
+		{tar.Header{Name: "./lib/systemd/system/multi-user.target.wants/foo.service", Typeflag: tar.TypeSymlink, Linkname: "../foo.service"}, ""},
+		{tar.Header{Name: "./usr/lib/sysctl.d/50-foo.conf", Typeflag: tar.TypeReg}, "net.ipv4.ip_forward = 1"},
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Mode = 0755
+		hdr.Size = int64(len(e.content))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	root := "/run/torcx/unpack/foo"
+	tfs, err := newTarFS(tar.NewReader(&buf), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	applyCfg := &ApplyConfig{CommonConfig: CommonConfig{RunDir: "/run/torcx"}}
+	assets, err := retrieveAssets(applyCfg, tfs, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groups := assetGroups(applyCfg, assets)
+	binOps, err := planAssets(tfs, root, groups[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expBins := []assetOp{
+		{JournalSymlink, root + "/usr/bin/foo", "/run/torcx/bin/foo", root + "/usr/bin/foo"},
+		{JournalSymlink, root + "/usr/bin/sub/bar", "/run/torcx/bin/bar", root + "/usr/bin/sub/bar"},
+	}
+	if !reflect.DeepEqual(binOps, expBins) {
+		t.Fatalf("expected %#v, got %#v", expBins, binOps)
+	}
+
+	unitOps, err := planAssets(tfs, root, groups[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expUnits := []assetOp{
+		{JournalDir, "", "/run/systemd/system", ""},
+		{JournalFile, root + "/lib/systemd/system/foo.service", "/run/systemd/system/foo.service", ""},
+		{JournalDir, root + "/lib/systemd/system/multi-user.target.wants", "/run/systemd/system/multi-user.target.wants", ""},
+		{JournalSymlink, root + "/lib/systemd/system/multi-user.target.wants/foo.service", "/run/systemd/system/multi-user.target.wants/foo.service", "../foo.service"},
+	}
+	if !reflect.DeepEqual(unitOps, expUnits) {
+		t.Fatalf("expected %#v, got %#v", expUnits, unitOps)
+	}
+
+	var sysctlGroup assetGroup
+	for _, g := range groups {
+		if g.kind == "sysctl" {
+			sysctlGroup = g
+		}
+	}
+	sysctlOps, err := planAssets(tfs, root, sysctlGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expSysctl := []assetOp{
+		{JournalDir, "", "/run/sysctl.d", ""},
+		{JournalFile, root + "/usr/lib/sysctl.d/50-foo.conf", "/run/sysctl.d/50-foo.conf", ""},
+	}
+	if !reflect.DeepEqual(sysctlOps, expSysctl) {
+		t.Fatalf("expected %#v, got %#v", expSysctl, sysctlOps)
+	}
+}
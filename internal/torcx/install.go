@@ -0,0 +1,188 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// presetRule is a single `enable` or `disable` line from a preset file.
+type presetRule struct {
+	enable  bool
+	pattern string
+}
+
+// readPresets parses all preset files listed in `paths` (files or
+// directories, relative to the image root), ordered by file name.
+func readPresets(fsys imageFS, imageRoot string, paths []string) ([]presetRule, error) {
+	files := []string{}
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		walkFn := func(inPath string, inInfo os.FileInfo, inErr error) error {
+			if inErr != nil {
+				return nil
+			}
+			if inInfo.Mode().IsRegular() && strings.HasSuffix(inPath, ".preset") {
+				files = append(files, filepath.Clean(inPath))
+			}
+			return nil
+		}
+		if err := fsys.Walk(filepath.Join(imageRoot, p), walkFn); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+
+	rules := []presetRule{}
+	for _, f := range files {
+		b, err := fsys.ReadFile(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading preset %q", f)
+		}
+		sc := bufio.NewScanner(bytes.NewReader(b))
+		for sc.Scan() {
+			fields := strings.Fields(sc.Text())
+			if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+				continue
+			}
+			switch fields[0] {
+			case "enable":
+				rules = append(rules, presetRule{true, fields[1]})
+			case "disable":
+				rules = append(rules, presetRule{false, fields[1]})
+			default:
+				logrus.WithFields(logrus.Fields{
+					"preset": f,
+					"line":   sc.Text(),
+				}).Debug("skipped unknown preset rule")
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, errors.Wrapf(err, "reading preset %q", f)
+		}
+	}
+	return rules, nil
+}
+
+// presetEnabled returns whether `unit` is enabled by the first matching
+// preset rule, and whether any rule matched.
+func presetEnabled(rules []presetRule, unit string) (bool, bool) {
+	for _, r := range rules {
+		if ok, _ := filepath.Match(r.pattern, unit); ok {
+			return r.enable, true
+		}
+	}
+	return false, false
+}
+
+// unitLinkDest returns the relative symlink destination for a unit
+// enabled in a `.wants` or `.requires` directory. Instances point to
+// their template unit.
+func unitLinkDest(unit string) string {
+	if at := strings.Index(unit, "@"); at >= 0 {
+		if dot := strings.LastIndex(unit, "."); dot > at+1 {
+			unit = unit[:at+1] + unit[dot:]
+		}
+	}
+	return "../" + unit
+}
+
+// planInstall computes the `.wants` and `.requires` symlinks enabling the
+// units listed in `installs`, within `unitsDir`. Units are enabled unless
+// disabled by presets shipped by the image. Entries in `overrides`, by unit
+// name, take precedence over both.
+func planInstall(fsys imageFS, imageRoot string, unitsDir string, installs []UnitInstall, presetPaths []string, overrides map[string]bool) ([]assetOp, error) {
+	if len(installs) == 0 && len(overrides) == 0 {
+		return nil, nil
+	}
+	if unitsDir == "" {
+		return nil, errors.New("missing host units directory")
+	}
+
+	rules, err := readPresets(fsys, imageRoot, presetPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	ops := []assetOp{}
+	dirs := map[string]bool{}
+	installed := map[string]bool{}
+	for _, inst := range installs {
+		if inst.Unit == "" || strings.ContainsRune(inst.Unit, '/') {
+			return nil, errors.Errorf("invalid unit name %q", inst.Unit)
+		}
+		installed[inst.Unit] = true
+
+		enabled := true
+		reason := "default"
+		if en, ok := presetEnabled(rules, inst.Unit); ok {
+			enabled, reason = en, "preset"
+		}
+		if en, ok := overrides[inst.Unit]; ok {
+			enabled, reason = en, "profile"
+		}
+		if !enabled {
+			logrus.WithFields(logrus.Fields{
+				"unit":   inst.Unit,
+				"reason": reason,
+			}).Debug("unit not enabled")
+			continue
+		}
+
+		links := []struct {
+			targets []string
+			suffix  string
+		}{
+			{inst.WantedBy, ".wants"},
+			{inst.RequiredBy, ".requires"},
+		}
+		for _, l := range links {
+			for _, target := range l.targets {
+				if target == "" || strings.ContainsRune(target, '/') {
+					return nil, errors.Errorf("invalid target unit name %q", target)
+				}
+				dir := filepath.Join(unitsDir, target+l.suffix)
+				if !dirs[dir] {
+					ops = append(ops, assetOp{Kind: JournalDir, Target: dir})
+					dirs[dir] = true
+				}
+				ops = append(ops, assetOp{
+					Kind:     JournalSymlink,
+					Target:   filepath.Join(dir, inst.Unit),
+					LinkDest: unitLinkDest(inst.Unit),
+				})
+			}
+		}
+	}
+
+	for unit := range overrides {
+		if !installed[unit] {
+			logrus.WithField("unit", unit).Warn("enablement override for a unit not installed by image, ignoring")
+		}
+	}
+	return ops, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPlanInstall(t *testing.T) {
+	preset := "# vendor defaults\ndisable debug-*.service\nenable *\n"
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range []struct{ name, content string }{
+		{"./usr/lib/systemd/system-preset/50-foo.preset", preset},
+	} {
+		hdr := tar.Header{Name: e.name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(e.content))}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	root := "/run/torcx/unpack/foo"
+	tfs, err := newTarFS(tar.NewReader(&buf), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	presets := []string{"/usr/lib/systemd/system-preset"}
+	unitsDir := "/run/systemd/system"
+
+	testCases := []struct {
+		desc      string
+		installs  []UnitInstall
+		overrides map[string]bool
+
+		ops []assetOp
+	}{
+		{
+			desc: "wanted and required",
+			installs: []UnitInstall{
+				{Unit: "foo.socket", WantedBy: []string{"sockets.target"}, RequiredBy: []string{"foo.service"}},
+			},
+			ops: []assetOp{
+				{JournalDir, "", unitsDir + "/sockets.target.wants", ""},
+				{JournalSymlink, "", unitsDir + "/sockets.target.wants/foo.socket", "../foo.socket"},
+				{JournalDir, "", unitsDir + "/foo.service.requires", ""},
+				{JournalSymlink, "", unitsDir + "/foo.service.requires/foo.socket", "../foo.socket"},
+			},
+		},
+		{
+			desc: "instance",
+			installs: []UnitInstall{
+				{Unit: "foo@bar.service", WantedBy: []string{"multi-user.target"}},
+			},
+			ops: []assetOp{
+				{JournalDir, "", unitsDir + "/multi-user.target.wants", ""},
+				{JournalSymlink, "", unitsDir + "/multi-user.target.wants/foo@bar.service", "../foo@.service"},
+			},
+		},
+		{
+			desc: "disabled by preset",
+			installs: []UnitInstall{
+				{Unit: "debug-foo.service", WantedBy: []string{"multi-user.target"}},
+			},
+			ops: []assetOp{},
+		},
+		{
+			desc: "profile overrides",
+			installs: []UnitInstall{
+				{Unit: "debug-foo.service", WantedBy: []string{"multi-user.target"}},
+				{Unit: "foo.service", WantedBy: []string{"multi-user.target"}},
+			},
+			overrides: map[string]bool{"debug-foo.service": true, "foo.service": false},
+			ops: []assetOp{
+				{JournalDir, "", unitsDir + "/multi-user.target.wants", ""},
+				{JournalSymlink, "", unitsDir + "/multi-user.target.wants/debug-foo.service", "../debug-foo.service"},
+			},
+		},
+	}
+
+	for _, tt := range testCases {
+		ops, err := planInstall(tfs, root, unitsDir, tt.installs, presets, tt.overrides)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(ops, tt.ops) {
+			t.Errorf("%s: expected %#v, got %#v", tt.desc, tt.ops, ops)
+		}
+	}
+
+	if _, err := planInstall(tfs, root, unitsDir, []UnitInstall{{Unit: "../foo.service"}}, nil, nil); err == nil {
+		t.Error("expected error on invalid unit name")
+	}
+}
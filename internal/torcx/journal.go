@@ -0,0 +1,364 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/coreos/torcx/pkg/verity"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ApplyJournalV0K - apply journal kind, v0
+	ApplyJournalV0K = "torcx-apply-journal-v0"
+
+	// JournalUnpack marks a directory holding an unpacked image
+	JournalUnpack = "unpack"
+	// JournalMount marks a mountpoint holding a mounted image
+	JournalMount = "mount"
+	// JournalDir marks a directory created on the host
+	JournalDir = "dir"
+	// JournalFile marks a regular file created on the host
+	JournalFile = "file"
+	// JournalSymlink marks a symlink created on the host
+	JournalSymlink = "symlink"
+	// JournalVerity marks a dm-verity device, by name
+	JournalVerity = "verity"
+)
+
+// ApplyJournalV0JSON holds the JSON apply journal (version 0).
+type ApplyJournalV0JSON struct {
+	Kind  string         `json:"kind"`
+	Value ApplyJournalV0 `json:"value"`
+}
+
+// ApplyJournalV0 contains an ordered list of journal entries.
+type ApplyJournalV0 struct {
+	Entries []JournalEntryV0 `json:"entries"`
+}
+
+// JournalEntryV0 records a single filesystem change performed on
+// behalf of an image.
+type JournalEntryV0 struct {
+	Image string `json:"image"`
+	Kind  string `json:"kind"`
+	Path  string `json:"path"`
+}
+
+// applyJournal keeps track of all filesystem changes performed while
+// applying images, persisting them to disk after each change.
+type applyJournal struct {
+	path    string
+	mu      sync.Mutex
+	entries []JournalEntryV0
+}
+
+// journalTx is a handle to record changes for a single image.
+type journalTx struct {
+	journal *applyJournal
+	image   string
+}
+
+// newApplyJournal creates an empty journal, backed by the file at `path`.
+func newApplyJournal(path string) (*applyJournal, error) {
+	if path == "" {
+		return nil, errors.New("missing journal path")
+	}
+	j := &applyJournal{
+		path:    path,
+		entries: []JournalEntryV0{},
+	}
+	if err := j.flush(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// openApplyJournal loads the existing journal at `path`, so that
+// further changes are appended to the recorded ones.
+func openApplyJournal(path string) (*applyJournal, error) {
+	if path == "" {
+		return nil, errors.New("missing journal path")
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc ApplyJournalV0JSON
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, errors.Wrapf(err, "decoding %q", path)
+	}
+	if doc.Kind != ApplyJournalV0K {
+		return nil, errors.Errorf("unknown apply journal kind %q", doc.Kind)
+	}
+	j := &applyJournal{
+		path:    path,
+		entries: doc.Value.Entries,
+	}
+	if j.entries == nil {
+		j.entries = []JournalEntryV0{}
+	}
+	return j, nil
+}
+
+// begin returns a transaction handle for the image named `image`.
+func (j *applyJournal) begin(image string) *journalTx {
+	return &journalTx{
+		journal: j,
+		image:   image,
+	}
+}
+
+// flush atomically writes the current journal content to disk.
+// Callers must hold the journal lock.
+func (j *applyJournal) flush() error {
+	doc := ApplyJournalV0JSON{
+		Kind: ApplyJournalV0K,
+		Value: ApplyJournalV0{
+			Entries: j.entries,
+		},
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(j.path), ".journal")
+	if err != nil {
+		return errors.Wrap(err, "creating journal")
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName)
+	defer tmpFile.Close()
+
+	if _, err := tmpFile.Write(b); err != nil {
+		return errors.Wrapf(err, "writing %q", tmpName)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.Wrapf(err, "closing %q", tmpName)
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, j.path)
+}
+
+// record appends a new change for this image to the journal.
+// It is a no-op on a nil transaction.
+func (tx *journalTx) record(kind string, path string) error {
+	if tx == nil {
+		return nil
+	}
+	tx.journal.mu.Lock()
+	defer tx.journal.mu.Unlock()
+
+	entry := JournalEntryV0{
+		Image: tx.image,
+		Kind:  kind,
+		Path:  path,
+	}
+	tx.journal.entries = append(tx.journal.entries, entry)
+	return tx.journal.flush()
+}
+
+// drop removes the most recent change for this image matching `kind`
+// and `path` from the journal. It is a no-op on a nil transaction.
+func (tx *journalTx) drop(kind string, path string) error {
+	if tx == nil {
+		return nil
+	}
+	tx.journal.mu.Lock()
+	defer tx.journal.mu.Unlock()
+
+	entries := tx.journal.entries
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Image == tx.image && entries[i].Kind == kind && entries[i].Path == path {
+			tx.journal.entries = append(entries[:i:i], entries[i+1:]...)
+			return tx.journal.flush()
+		}
+	}
+	return nil
+}
+
+// create records a change and then performs it via `fn`, so that a
+// crash in between never leaves an untracked path behind. If `fn`
+// fails, nothing has been created and the change is dropped again.
+func (tx *journalTx) create(kind string, path string, fn func() error) error {
+	if err := tx.record(kind, path); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		if dropErr := tx.drop(kind, path); dropErr != nil {
+			logrus.WithField("path", path).Warn("failed to drop journal entry: ", dropErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// createFile creates a new regular file at `path`, recording it first.
+// It fails if `path` already exists.
+func (tx *journalTx) createFile(path string) (*os.File, error) {
+	var fp *os.File
+	err := tx.create(JournalFile, path, func() error {
+		var err error
+		fp, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating %q", path)
+	}
+	return fp, nil
+}
+
+// mkdirAll creates directory `path` along with any missing parents,
+// recording each created directory first.
+func (tx *journalTx) mkdirAll(path string) error {
+	missing := []string{}
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		fi, err := os.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return errors.Errorf("%q is not a directory", dir)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		missing = append(missing, dir)
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		dir := missing[i]
+		err := tx.create(JournalDir, dir, func() error {
+			return os.Mkdir(dir, 0755)
+		})
+		if err != nil && !os.IsExist(err) {
+			return errors.Wrapf(err, "error creating directory %q", dir)
+		}
+	}
+	return nil
+}
+
+// rollback reverts all changes recorded for this image, most recent first,
+// and drops them from the journal. Entries which failed to revert are kept,
+// so that reverting them can be retried.
+func (tx *journalTx) rollback() error {
+	if tx == nil {
+		return nil
+	}
+	tx.journal.mu.Lock()
+	defer tx.journal.mu.Unlock()
+
+	kept := []JournalEntryV0{}
+	undo := []JournalEntryV0{}
+	for _, entry := range tx.journal.entries {
+		if entry.Image == tx.image {
+			undo = append(undo, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+
+	failed, lastErr := revertEntries(undo)
+
+	tx.journal.entries = append(kept, failed...)
+	if err := tx.journal.flush(); err != nil {
+		return err
+	}
+	return lastErr
+}
+
+// rollbackAll reverts all recorded changes, most recent first.
+// Entries which failed to revert are kept in the journal, so that
+// reverting them can be retried.
+func (j *applyJournal) rollbackAll() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	failed, lastErr := revertEntries(j.entries)
+
+	j.entries = failed
+	if err := j.flush(); err != nil {
+		return err
+	}
+	return lastErr
+}
+
+// revertEntries reverts all `entries`, most recent first, returning
+// the ones which failed (in journal order) and the last error.
+func revertEntries(entries []JournalEntryV0) ([]JournalEntryV0, error) {
+	failed := []JournalEntryV0{}
+	var lastErr error
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := revertEntry(entries[i]); err != nil {
+			lastErr = err
+			failed = append([]JournalEntryV0{entries[i]}, failed...)
+			logrus.WithFields(logrus.Fields{
+				"image": entries[i].Image,
+				"kind":  entries[i].Kind,
+				"path":  entries[i].Path,
+			}).Error("failed to revert: ", err)
+		}
+	}
+	return failed, lastErr
+}
+
+// revertEntry undoes the filesystem change described by a journal entry.
+func revertEntry(entry JournalEntryV0) error {
+	if entry.Path == "" {
+		return nil
+	}
+
+	var err error
+	switch entry.Kind {
+	case JournalFile, JournalSymlink:
+		err = os.Remove(entry.Path)
+	case JournalDir:
+		// Directories may be shared with other images, only remove if empty
+		err = os.Remove(entry.Path)
+		if err != nil && !os.IsNotExist(err) {
+			logrus.WithField("path", entry.Path).Debug("directory not removed: ", err)
+			err = nil
+		}
+	case JournalUnpack:
+		err = os.RemoveAll(entry.Path)
+	case JournalMount:
+		err = unix.Unmount(entry.Path, 0)
+		if err == unix.EINVAL {
+			// Not a mountpoint anymore
+			err = nil
+		}
+	case JournalVerity:
+		err = verity.Remove(entry.Path)
+	default:
+		return errors.Errorf("unknown journal entry kind %q", entry.Kind)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "reverting %s %q", entry.Kind, entry.Path)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJournalRollback(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "torcx_journal_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	imageRoot := filepath.Join(tmpDir, "unpack", "foo")
+	if err := os.MkdirAll(filepath.Join(imageRoot, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"foo", "bar"} {
+		if err := ioutil.WriteFile(filepath.Join(imageRoot, "bin", name), []byte{}, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	binDir := filepath.Join(tmpDir, "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Pre-existing asset, not owned by the image
+	if err := ioutil.WriteFile(filepath.Join(binDir, "bar"), []byte{}, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	journalPath := filepath.Join(tmpDir, "journal.json")
+	journal, err := newApplyJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := journal.begin("other")
+	if err := other.record(JournalFile, filepath.Join(tmpDir, "other")); err != nil {
+		t.Fatal(err)
+	}
+	tx := journal.begin("foo")
+	ops, err := planBinAsset(hostFS{}, binDir, filepath.Join(imageRoot, "bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := propagateAssets(tx, ops, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(binDir, "foo")); err != nil {
+		t.Fatalf("expected propagated binary: %s", err)
+	}
+	if len(journal.entries) != 2 {
+		t.Fatalf("expected 2 journal entries, got %#v", journal.entries)
+	}
+
+	if err := tx.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(binDir, "foo")); !os.IsNotExist(err) {
+		t.Fatalf("expected binary to be removed, got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(binDir, "bar")); err != nil {
+		t.Fatalf("expected pre-existing binary to be kept: %s", err)
+	}
+
+	b, err := ioutil.ReadFile(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc ApplyJournalV0JSON
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Kind != ApplyJournalV0K {
+		t.Fatalf("expected kind %q, got %q", ApplyJournalV0K, doc.Kind)
+	}
+	if len(doc.Value.Entries) != 1 || doc.Value.Entries[0].Image != "other" {
+		t.Fatalf("expected only unrelated entries to be kept, got %#v", doc.Value.Entries)
+	}
+}
+
+func TestJournalRollbackKeepsFailed(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "torcx_journal_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// A non-empty directory recorded as a file cannot be removed
+	stuck := filepath.Join(tmpDir, "stuck")
+	if err := os.MkdirAll(filepath.Join(stuck, "content"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	removed := filepath.Join(tmpDir, "removed")
+	if err := ioutil.WriteFile(removed, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := newApplyJournal(filepath.Join(tmpDir, "journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := journal.begin("foo")
+	for _, path := range []string{stuck, removed} {
+		if err := tx.record(JournalFile, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tx.rollback(); err == nil {
+		t.Fatal("expected rollback failure")
+	}
+	if _, err := os.Lstat(removed); !os.IsNotExist(err) {
+		t.Errorf("expected file to be removed, got %v", err)
+	}
+	reopened, err := openApplyJournal(journal.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.entries) != 1 || reopened.entries[0].Path != stuck {
+		t.Fatalf("expected only the failed entry to be kept, got %#v", reopened.entries)
+	}
+}
+
+func TestJournalCreate(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "torcx_journal_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	journal, err := newApplyJournal(filepath.Join(tmpDir, "journal.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := journal.begin("foo")
+
+	dir := filepath.Join(tmpDir, "a", "b")
+	if err := tx.mkdirAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := tx.createFile(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Close()
+
+	// Existing paths are neither overwritten nor recorded
+	if _, err := tx.createFile(filepath.Join(dir, "file")); err == nil {
+		t.Error("expected failure creating an existing file")
+	}
+	if err := tx.mkdirAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []JournalEntryV0{
+		{Image: "foo", Kind: JournalDir, Path: filepath.Join(tmpDir, "a")},
+		{Image: "foo", Kind: JournalDir, Path: dir},
+		{Image: "foo", Kind: JournalFile, Path: filepath.Join(dir, "file")},
+	}
+	if !reflect.DeepEqual(journal.entries, expected) {
+		t.Fatalf("expected %#v, got %#v", expected, journal.entries)
+	}
+
+	if err := tx.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(tmpDir, "a")); !os.IsNotExist(err) {
+		t.Errorf("expected parent directory to be removed, got %v", err)
+	}
+}
@@ -15,6 +15,8 @@
 package torcx
 
 const (
+	// ProfileManifestV2K - profile manifest kind, v2
+	ProfileManifestV2K = "profile-manifest-v2"
 	// ProfileManifestV1K - profile manifest kind, v1
 	ProfileManifestV1K = "profile-manifest-v1"
 	// ProfileManifestV0K - profile manifest kind, v0
@@ -23,8 +25,40 @@ const (
 	RemoteManifestV0K = "remote-manifest-v0"
 	// RemoteContentsV1K - remote contents kind, v1
 	RemoteContentsV1K = "torcx-remote-contents-v1"
+	// StoreTrustV0K - store trust manifest kind, v0
+	StoreTrustV0K = "torcx-store-trust-v0"
 )
 
+// * Profile manifest version 2: added "asset_owners", "apply_mode" and "optional".
+
+// ProfileManifestV2JSON holds JSON profile manifest (version 2).
+type ProfileManifestV2JSON struct {
+	Kind  string   `json:"kind"`
+	Value ImagesV2 `json:"value"`
+}
+
+// ImagesV2 contains an array of image entries, and the owners of
+// assets shipped by multiple images.
+type ImagesV2 struct {
+	Images []ImageV2 `json:"images"`
+	// AssetOwners maps an asset (e.g. "bin/runc") to the image owning it
+	AssetOwners map[string]string `json:"asset_owners,omitempty"`
+	// ApplyMode overrides the configured apply mode
+	ApplyMode ApplyMode `json:"apply_mode,omitempty"`
+}
+
+// ImageV2 describes and addon image within a v2 profile.
+type ImageV2 struct {
+	Name      string `json:"name"`
+	Reference string `json:"reference"`
+	Remote    string `json:"remote"`
+	Optional  bool   `json:"optional,omitempty"`
+	// Enable overrides the enablement of units shipped by the image
+	Enable map[string]bool `json:"enable,omitempty"`
+	// VerityRootHash is the dm-verity root hash of a squashfs archive
+	VerityRootHash string `json:"verity_root_hash,omitempty"`
+}
+
 // * Profile manifest version 1: added "remote".
 
 // ProfileManifestV1JSON holds JSON profile manifest (version 1).
@@ -110,4 +144,19 @@ type RemoteVersionV1 struct {
 	Hash     string `json:"hash"`
 	Location string `json:"location"`
 	Version  string `json:"version"`
+	// VerityRootHash is the dm-verity root hash of a squashfs archive
+	VerityRootHash string `json:"verity_root_hash,omitempty"`
+}
+
+// * Store trust manifest version 0: initial version.
+
+// StoreTrustV0JSON holds a JSON store trust manifest (version 0).
+type StoreTrustV0JSON struct {
+	Kind  string       `json:"kind"`
+	Value StoreTrustV0 `json:"value"`
+}
+
+// StoreTrustV0 lists keys trusted to sign archives in local stores.
+type StoreTrustV0 struct {
+	Keys []RemoteKeyV0 `json:"keys"`
 }
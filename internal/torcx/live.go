@@ -0,0 +1,358 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	sdbus "github.com/coreos/go-systemd/dbus"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// imageDiff lists the changes needed to go from the applied images
+// to the target ones.
+type imageDiff struct {
+	removed []Image
+	added   []Image
+	kept    []Image
+}
+
+// diffImages compares applied images with target ones, by name and
+// reference. An image whose reference changed is both removed and added.
+// Removed images keep the applied order, the others the target one.
+func diffImages(applied []Image, target []Image) imageDiff {
+	appliedRefs := make(map[string]string, len(applied))
+	for _, im := range applied {
+		appliedRefs[im.Name] = im.Reference
+	}
+	targetRefs := make(map[string]string, len(target))
+	for _, im := range target {
+		targetRefs[im.Name] = im.Reference
+	}
+
+	diff := imageDiff{}
+	for _, im := range applied {
+		if ref, ok := targetRefs[im.Name]; !ok || ref != im.Reference {
+			diff.removed = append(diff.removed, im)
+		}
+	}
+	for _, im := range target {
+		if ref, ok := appliedRefs[im.Name]; ok && ref == im.Reference {
+			diff.kept = append(diff.kept, im)
+		} else {
+			diff.added = append(diff.added, im)
+		}
+	}
+	return diff
+}
+
+// imageUnits returns the names of systemd units propagated by an image,
+// as reported in its apply status. Drop-ins and enablement symlinks
+// are not units on their own.
+func imageUnits(st ImageStatusV0) []string {
+	units := []string{}
+	seen := map[string]bool{}
+	for _, asset := range st.Assets {
+		if asset.Type != "units" || asset.Kind == JournalDir {
+			continue
+		}
+		dir := filepath.Base(filepath.Dir(asset.Target))
+		if strings.HasSuffix(dir, ".d") || strings.HasSuffix(dir, ".wants") || strings.HasSuffix(dir, ".requires") {
+			continue
+		}
+		name := filepath.Base(asset.Target)
+		if !seen[name] {
+			seen[name] = true
+			units = append(units, name)
+		}
+	}
+	return units
+}
+
+// unitName returns the name of the systemd unit affected by the unit
+// asset at `target`: the unit itself, or the one a drop-in applies to.
+// Enablement symlinks do not affect any unit on their own.
+func unitName(target string) string {
+	dir := filepath.Base(filepath.Dir(target))
+	switch {
+	case strings.HasSuffix(dir, ".wants"), strings.HasSuffix(dir, ".requires"):
+		return ""
+	case strings.HasSuffix(dir, ".d"):
+		return strings.TrimSuffix(dir, ".d")
+	}
+	return filepath.Base(target)
+}
+
+// plannedUnits returns the names of systemd units which planned assets
+// would create or override with drop-ins.
+func plannedUnits(groups []plannedGroup) []string {
+	units := []string{}
+	seen := map[string]bool{}
+	for _, group := range groups {
+		if group.kind != "units" {
+			continue
+		}
+		for _, op := range group.ops {
+			if op.Kind == JournalDir {
+				continue
+			}
+			if name := unitName(op.Target); name != "" && !seen[name] {
+				seen[name] = true
+				units = append(units, name)
+			}
+		}
+	}
+	return units
+}
+
+// ApplyProfileLive re-applies the configured profiles on a running system,
+// after they have been applied and sealed at boot. Images not in the
+// target profiles anymore are torn down, new ones are applied, then the
+// system state is sealed again and systemd reloaded.
+// Removing images whose units are active is refused, unless `force` is
+// set: in that case units are stopped first. The same goes for new images
+// shipping units (or drop-ins) for active units of kept images.
+func ApplyProfileLive(applyCfg *ApplyConfig, force bool) error {
+	if applyCfg == nil {
+		return errors.New("missing apply configuration")
+	}
+	if applyCfg.Root != "" {
+		return errors.New("live apply is not supported on an alternate root")
+	}
+
+	seal, err := applyCfg.CurrentSeal()
+	if err != nil {
+		return errors.Wrap(err, "reading sealed state")
+	}
+	if seal.ApplyMode == ApplyModeOverlay || applyCfg.ApplyMode == ApplyModeOverlay {
+		return errors.New("live apply is not supported in overlay mode")
+	}
+	// Units go where they went at boot, i.e. the generator directory
+	if seal.UnitsDir != "" {
+		applyCfg.Dirs.Units = seal.UnitsDir
+	}
+	prevStatus, err := ReadApplyStatus(applyCfg.RunStatus())
+	if err != nil {
+		return errors.Wrap(err, "reading apply status")
+	}
+	applied, err := ReadProfilePath(applyCfg.RunProfile())
+	if err != nil {
+		return errors.Wrap(err, "reading sealed profile")
+	}
+	target, err := mergeProfiles(applyCfg)
+	if err != nil {
+		return err
+	}
+
+	diff := diffImages(applied, target)
+	if len(diff.removed) == 0 && len(diff.added) == 0 {
+		logrus.Info("applied images are up to date")
+		return nil
+	}
+	for _, im := range diff.removed {
+		logrus.WithFields(logrus.Fields{
+			"image":     im.Name,
+			"reference": im.Reference,
+		}).Debug("image to be removed")
+	}
+	for _, im := range diff.added {
+		logrus.WithFields(logrus.Fields{
+			"image":     im.Name,
+			"reference": im.Reference,
+		}).Debug("image to be added")
+	}
+
+	statuses := map[string]ImageStatusV0{}
+	for _, st := range prevStatus.Value.Images {
+		if st.Success {
+			statuses[st.Name] = st
+		}
+	}
+
+	conn, err := sdbus.NewSystemdConnection()
+	if err != nil {
+		return errors.Wrap(err, "connecting to systemd")
+	}
+	defer conn.Close()
+
+	units := []string{}
+	for _, im := range diff.removed {
+		units = append(units, imageUnits(statuses[im.Name])...)
+	}
+	active, err := activeUnits(conn, units)
+	if err != nil {
+		return errors.Wrap(err, "querying unit states")
+	}
+	if len(active) > 0 {
+		if !force {
+			return errors.Errorf("refusing to remove images with active units: %s", strings.Join(active, ", "))
+		}
+		if err := stopUnits(conn, active); err != nil {
+			return err
+		}
+	}
+
+	// The unpack directory is remounted read-only when sealing
+	unpackDir := applyCfg.RunUnpackDir()
+	if err := unix.Mount(unpackDir, unpackDir, "", unix.MS_REMOUNT, ""); err != nil {
+		return errors.Wrap(err, "failed to remount read-write")
+	}
+
+	journal, err := openApplyJournal(applyCfg.RunJournal())
+	if os.IsNotExist(err) {
+		journal, err = newApplyJournal(applyCfg.RunJournal())
+	}
+	if err != nil {
+		return errors.Wrap(err, "journal setup")
+	}
+
+	status := ApplyStatusV0{
+		LowerProfiles: []string{},
+		UpperProfile:  applyCfg.UpperProfile,
+		StartTime:     time.Now(),
+		Images:        []ImageStatusV0{},
+	}
+	if len(applyCfg.LowerProfiles) > 0 {
+		status.LowerProfiles = applyCfg.LowerProfiles
+	}
+
+	// Tear down in reverse order, dependent images first
+	var applyErr error
+	for i := len(diff.removed) - 1; i >= 0; i-- {
+		im := diff.removed[i]
+		logFields := logrus.Fields{
+			"image":     im.Name,
+			"reference": im.Reference,
+		}
+		if err := journal.begin(im.Name).rollback(); err != nil {
+			logrus.WithFields(logFields).Error("failed to remove image: ", err)
+			applyErr = errors.Wrapf(err, "removing image %q", im.Name)
+			continue
+		}
+		logrus.WithFields(logFields).Info("image removed")
+	}
+
+	keptUnits := map[string]bool{}
+	installed := make(map[string]string, len(diff.kept))
+	for _, im := range diff.kept {
+		for _, unit := range imageUnits(statuses[im.Name]) {
+			keptUnits[unit] = true
+		}
+		st, ok := statuses[im.Name]
+		if !ok {
+			st = newImageStatus(im)
+			st.Success = true
+		}
+		if st.ImageRoot == "" {
+			st.ImageRoot = filepath.Join(unpackDir, im.Name)
+		}
+		installed[im.Name] = st.ImageRoot
+		status.Images = append(status.Images, st)
+	}
+
+	// New images must not change active units of kept images under their feet
+	guard := func(im Image, units []string) error {
+		overridden := []string{}
+		for _, unit := range units {
+			if keptUnits[unit] {
+				overridden = append(overridden, unit)
+			}
+		}
+		active, err := activeUnits(conn, overridden)
+		if err != nil {
+			return errors.Wrap(err, "querying unit states")
+		}
+		if len(active) == 0 {
+			return nil
+		}
+		if !force {
+			return errors.Errorf("refusing to override active units of kept images: %s", strings.Join(active, ", "))
+		}
+		return stopUnits(conn, active)
+	}
+
+	images := []Image{}
+	if len(target) > 0 {
+		var err error
+		images, err = applyImages(applyCfg, journal, target, installed, guard, &status)
+		if err != nil {
+			applyErr = err
+		}
+	}
+	if err := writeRunProfile(applyCfg, images); err != nil && applyErr == nil {
+		applyErr = err
+	}
+
+	status.EndTime = time.Now()
+	status.Success = applyErr == nil
+	if applyErr != nil {
+		status.Error = applyErr.Error()
+	}
+	if err := writeApplyStatus(applyCfg.RunStatus(), status); err != nil {
+		logrus.WithField("path", applyCfg.RunStatus()).Error("failed to write apply status: ", err)
+		if applyErr == nil {
+			applyErr = err
+		}
+	}
+
+	if err := SealSystemState(applyCfg, applyErr); err != nil {
+		return errors.Wrap(err, "sealing system state failed")
+	}
+	if err := conn.Reload(); err != nil {
+		return errors.Wrap(err, "reloading systemd")
+	}
+	return applyErr
+}
+
+// activeUnits returns the units among `units` which are not inactive.
+func activeUnits(conn *sdbus.Conn, units []string) ([]string, error) {
+	if len(units) == 0 {
+		return nil, nil
+	}
+	states, err := conn.ListUnitsByNames(units)
+	if err != nil {
+		return nil, err
+	}
+
+	active := []string{}
+	for _, st := range states {
+		switch st.ActiveState {
+		case "inactive", "failed":
+		default:
+			active = append(active, st.Name)
+		}
+	}
+	return active, nil
+}
+
+// stopUnits stops all `units`, waiting for each stop job to complete.
+func stopUnits(conn *sdbus.Conn, units []string) error {
+	for _, unit := range units {
+		done := make(chan string, 1)
+		if _, err := conn.StopUnit(unit, "replace", done); err != nil {
+			return errors.Wrapf(err, "stopping %s", unit)
+		}
+		if result := <-done; result != "done" {
+			return errors.Errorf("stopping %s: job %s", unit, result)
+		}
+		logrus.WithField("unit", unit).Info("unit stopped")
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffImages(t *testing.T) {
+	foo := Image{Name: "foo", Reference: "1"}
+	bar := Image{Name: "bar", Reference: "1"}
+	bar2 := Image{Name: "bar", Reference: "2"}
+	baz := Image{Name: "baz", Reference: "1"}
+
+	testCases := []struct {
+		desc    string
+		applied []Image
+		target  []Image
+		diff    imageDiff
+	}{
+		{
+			"unchanged",
+			[]Image{foo, bar},
+			[]Image{foo, bar},
+			imageDiff{kept: []Image{foo, bar}},
+		},
+		{
+			"added and removed",
+			[]Image{foo, bar},
+			[]Image{bar, baz},
+			imageDiff{removed: []Image{foo}, added: []Image{baz}, kept: []Image{bar}},
+		},
+		{
+			"reference changed",
+			[]Image{foo, bar},
+			[]Image{foo, bar2},
+			imageDiff{removed: []Image{bar}, added: []Image{bar2}, kept: []Image{foo}},
+		},
+		{
+			"nothing applied",
+			nil,
+			[]Image{foo},
+			imageDiff{added: []Image{foo}},
+		},
+	}
+
+	for _, tt := range testCases {
+		diff := diffImages(tt.applied, tt.target)
+		if !reflect.DeepEqual(diff, tt.diff) {
+			t.Errorf("%s: expected %#v, got %#v", tt.desc, tt.diff, diff)
+		}
+	}
+}
+
+func TestImageUnits(t *testing.T) {
+	st := ImageStatusV0{
+		Assets: []AssetEntry{
+			{Type: "bin", Kind: JournalSymlink, Target: "/run/torcx/bin/foo"},
+			{Type: "units", Kind: JournalDir, Target: "/run/systemd/system"},
+			{Type: "units", Kind: JournalFile, Target: "/run/systemd/system/foo.service"},
+			{Type: "units", Kind: assetTemplate, Target: "/run/systemd/system/foo.socket"},
+			{Type: "units", Kind: JournalFile, Target: "/run/systemd/system/foo.service.d/10-env.conf"},
+			{Type: "units", Kind: JournalSymlink, Target: "/run/systemd/system/multi-user.target.wants/foo.service"},
+			{Type: "units", Kind: JournalSymlink, Target: "/run/systemd/system/foo-alias.service"},
+		},
+	}
+	expected := []string{"foo.service", "foo.socket", "foo-alias.service"}
+
+	if units := imageUnits(st); !reflect.DeepEqual(units, expected) {
+		t.Fatalf("expected %v, got %v", expected, units)
+	}
+}
+
+func TestPlannedUnits(t *testing.T) {
+	groups := []plannedGroup{
+		{
+			assetGroup: assetGroup{kind: "bin"},
+			ops:        []assetOp{{Kind: JournalSymlink, Target: "/run/torcx/bin/foo"}},
+		},
+		{
+			assetGroup: assetGroup{kind: "units"},
+			ops: []assetOp{
+				{Kind: JournalDir, Target: "/run/systemd/system/bar.service.d"},
+				{Kind: JournalFile, Target: "/run/systemd/system/bar.service.d/10-env.conf"},
+				{Kind: JournalFile, Target: "/run/systemd/system/foo.service"},
+				{Kind: assetTemplate, Target: "/run/systemd/system/foo.service.d/20-path.conf"},
+			},
+		},
+		{
+			assetGroup: assetGroup{kind: "units", desc: "unit enablement"},
+			ops:        []assetOp{{Kind: JournalSymlink, Target: "/run/systemd/system/multi-user.target.wants/baz.service"}},
+		},
+	}
+	expected := []string{"bar.service", "foo.service"}
+
+	if units := plannedUnits(groups); !reflect.DeepEqual(units, expected) {
+		t.Fatalf("expected %v, got %v", expected, units)
+	}
+}
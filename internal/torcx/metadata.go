@@ -24,6 +24,8 @@ import (
 
 // ReadMetadata returns metadata regarding the currently running profile,
 // as read from the metadata file
+//
+// Deprecated: use CommonConfig.CurrentSeal, which also reads the JSON seal document.
 func ReadMetadata(fusePath string) (map[string]string, error) {
 	meta := make(map[string]string)
 
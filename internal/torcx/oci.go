@@ -0,0 +1,342 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	pkgtar "github.com/coreos/torcx/pkg/tar"
+)
+
+const (
+	ociLayoutFile = "oci-layout"
+	ociIndexFile  = "index.json"
+	// ociMaxMetadataSize caps the size of index and manifest blobs
+	ociMaxMetadataSize = 4 * 1024 * 1024
+
+	ociMediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	ociMediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	ociMediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar"
+
+	// ociRefNameAnnotation names a manifest in an image index
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+	// ociTorcxManifestAnnotation carries a torcx image manifest, used
+	// when the flattened image has no /.torcx/manifest.json
+	ociTorcxManifestAnnotation = "com.coreos.torcx.manifest"
+)
+
+// ociDescriptor references a blob in an OCI image layout.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      digest.Digest     `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		Architecture string `json:"architecture"`
+		OS           string `json:"os"`
+	} `json:"platform,omitempty"`
+}
+
+// ociIndex is the entry point of an OCI image layout.
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociManifest describes the layers of an OCI image.
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// ociLayout gives access to the files of an OCI image layout, either a
+// directory or a tarball.
+type ociLayout interface {
+	open(name string) (io.ReadCloser, error)
+	Close() error
+}
+
+// ociDirLayout is an OCI image layout directory.
+type ociDirLayout string
+
+func (dir ociDirLayout) open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(dir), filepath.FromSlash(name)))
+}
+
+func (dir ociDirLayout) Close() error {
+	return nil
+}
+
+// ociTarLayout is an OCI image layout packed in an uncompressed tarball,
+// read in place from the offsets of its entries.
+type ociTarLayout struct {
+	fp      archiveFile
+	entries map[string]*io.SectionReader
+}
+
+func openOCITarLayout(archive Archive) (*ociTarLayout, error) {
+	archivePath := archive.Filepath
+	fp, err := archive.open()
+	if err != nil {
+		return nil, err
+	}
+	layout := &ociTarLayout{fp, map[string]*io.SectionReader{}}
+
+	tr := tar.NewReader(fp)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fp.Close()
+			return nil, errors.Wrapf(err, "indexing %q", archivePath)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		// The tar reader does not buffer, file data starts right here
+		offset, err := fp.Seek(0, io.SeekCurrent)
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		layout.entries[name] = io.NewSectionReader(fp, offset, hdr.Size)
+	}
+	return layout, nil
+}
+
+func (layout *ociTarLayout) open(name string) (io.ReadCloser, error) {
+	sr, ok := layout.entries[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(io.NewSectionReader(sr, 0, sr.Size())), nil
+}
+
+func (layout *ociTarLayout) Close() error {
+	return layout.fp.Close()
+}
+
+// openOCILayout opens the OCI image layout of an archive.
+func openOCILayout(archive Archive) (ociLayout, error) {
+	var layout ociLayout
+	switch archive.Format {
+	case ArchiveFormatOCI:
+		layout = ociDirLayout(archive.Filepath)
+	case ArchiveFormatOCIArchive:
+		tl, err := openOCITarLayout(archive)
+		if err != nil {
+			return nil, err
+		}
+		layout = tl
+	default:
+		return nil, errors.Errorf("%q is not an OCI format", archive.Format)
+	}
+
+	rc, err := layout.open(ociLayoutFile)
+	if err != nil {
+		layout.Close()
+		return nil, errors.Wrapf(err, "%q is not an OCI image layout", archive.Filepath)
+	}
+	rc.Close()
+	return layout, nil
+}
+
+// openBlob opens the blob for a descriptor, verifying its content
+// against the descriptor digest as it is read.
+func openBlob(layout ociLayout, desc ociDescriptor) (*verifiedBlob, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid blob digest %q", desc.Digest)
+	}
+	name := path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Hex())
+	rc, err := layout.open(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening blob %s", desc.Digest)
+	}
+	verifier := desc.Digest.Verifier()
+	return &verifiedBlob{
+		Reader:   io.TeeReader(io.LimitReader(rc, desc.Size), verifier),
+		rc:       rc,
+		verifier: verifier,
+		desc:     desc,
+	}, nil
+}
+
+// verifiedBlob reads a blob, checking its size and digest with verify.
+type verifiedBlob struct {
+	io.Reader
+	rc       io.ReadCloser
+	verifier digest.Verifier
+	desc     ociDescriptor
+}
+
+// verify consumes the rest of the blob, and checks it was not altered.
+func (vb *verifiedBlob) verify() error {
+	if _, err := io.Copy(ioutil.Discard, vb.Reader); err != nil {
+		return err
+	}
+	// Extra data past the descriptor size counts as an alteration
+	if n, _ := vb.rc.Read(make([]byte, 1)); n > 0 || !vb.verifier.Verified() {
+		return errors.Errorf("mismatching content for blob %s", vb.desc.Digest)
+	}
+	return nil
+}
+
+func (vb *verifiedBlob) Close() error {
+	return vb.rc.Close()
+}
+
+// readBlobJSON reads and decodes a small metadata blob.
+func readBlobJSON(layout ociLayout, desc ociDescriptor, v interface{}) error {
+	if desc.Size > ociMaxMetadataSize {
+		return errors.Errorf("blob %s is too large", desc.Digest)
+	}
+	blob, err := openBlob(layout, desc)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	b, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return err
+	}
+	if err := blob.verify(); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// selectOCIManifest picks the image manifest for `reference` in an index.
+// A manifest named after the reference wins, otherwise the first one
+// for the host platform is used.
+func selectOCIManifest(index ociIndex, reference string) (ociDescriptor, error) {
+	var candidates []ociDescriptor
+	for _, desc := range index.Manifests {
+		if desc.MediaType != ociMediaTypeManifest {
+			continue
+		}
+		if desc.Annotations[ociRefNameAnnotation] == reference {
+			return desc, nil
+		}
+		if desc.Platform != nil && (desc.Platform.OS != runtime.GOOS || desc.Platform.Architecture != runtime.GOARCH) {
+			continue
+		}
+		candidates = append(candidates, desc)
+	}
+	if len(candidates) == 0 {
+		return ociDescriptor{}, errors.Errorf("no image manifest for reference %q", reference)
+	}
+	return candidates[0], nil
+}
+
+// unpackOCI flattens the layers of an OCI image into `targetDir`.
+func unpackOCI(archive Archive, targetDir string) error {
+	layout, err := openOCILayout(archive)
+	if err != nil {
+		return err
+	}
+	defer layout.Close()
+
+	rc, err := layout.open(ociIndexFile)
+	if err != nil {
+		return errors.Wrap(err, "opening image index")
+	}
+	var index ociIndex
+	err = json.NewDecoder(io.LimitReader(rc, ociMaxMetadataSize)).Decode(&index)
+	rc.Close()
+	if err != nil {
+		return errors.Wrap(err, "parsing image index")
+	}
+
+	desc, err := selectOCIManifest(index, archive.Reference)
+	if err != nil {
+		return err
+	}
+	var manifest ociManifest
+	if err := readBlobJSON(layout, desc, &manifest); err != nil {
+		return errors.Wrapf(err, "reading image manifest %s", desc.Digest)
+	}
+
+	untarCfg := pkgtar.ExtractCfg{}.Default()
+	untarCfg.Whiteouts = true
+	for _, layer := range manifest.Layers {
+		if err := unpackOCILayer(layout, layer, targetDir, untarCfg); err != nil {
+			return errors.Wrapf(err, "unpacking layer %s", layer.Digest)
+		}
+	}
+
+	torcxManifest := manifest.Annotations[ociTorcxManifestAnnotation]
+	if torcxManifest == "" {
+		return nil
+	}
+	manifestFile := filepath.Join(targetDir, manifestPath)
+	if _, err := os.Lstat(manifestFile); err == nil {
+		return nil
+	}
+	logrus.WithField("image", archive.Name).Debug("using image manifest from OCI annotation")
+	if err := os.MkdirAll(filepath.Dir(manifestFile), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestFile, []byte(torcxManifest), 0644)
+}
+
+// unpackOCILayer applies a single layer on top of `targetDir`.
+func unpackOCILayer(layout ociLayout, layer ociDescriptor, targetDir string, cfg pkgtar.ExtractCfg) error {
+	var format ArchiveFormat
+	switch strings.TrimPrefix(layer.MediaType, ociMediaTypeLayer) {
+	case "":
+	case "+gzip":
+		format = ArchiveFormatTgz
+	case "+zstd":
+		format = ArchiveFormatTarZstd
+	default:
+		return errors.Errorf("unsupported layer media type %q", layer.MediaType)
+	}
+
+	blob, err := openBlob(layout, layer)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	var r io.Reader = blob
+	if format != ArchiveFormatUnknown {
+		dr, err := decompressTarball(blob, format)
+		if err != nil {
+			return err
+		}
+		defer dr.Close()
+		r = dr
+	}
+	if err := pkgtar.Untar(tar.NewReader(r), targetDir, cfg); err != nil {
+		return err
+	}
+	return blob.verify()
+}
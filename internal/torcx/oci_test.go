@@ -0,0 +1,174 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// writeOCITestLayout writes an OCI image layout with two layers, the
+// second one removing a file from the first, to `dir` and to `tarPath`.
+func writeOCITestLayout(t *testing.T, dir, tarPath string) {
+	files := map[string][]byte{
+		ociLayoutFile: []byte(`{"imageLayoutVersion": "1.0.0"}`),
+	}
+	addBlob := func(mediaType string, b []byte) ociDescriptor {
+		d := digest.FromBytes(b)
+		files[filepath.Join("blobs", "sha256", d.Hex())] = b
+		return ociDescriptor{MediaType: mediaType, Digest: d, Size: int64(len(b))}
+	}
+	layer := func(entries map[string]string) []byte {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, content := range entries {
+			hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	if _, err := gw.Write(layer(map[string]string{"foo": "1", "bar": "2"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		Layers: []ociDescriptor{
+			addBlob(ociMediaTypeLayer+"+gzip", gzBuf.Bytes()),
+			addBlob(ociMediaTypeLayer, layer(map[string]string{".wh.bar": "", "baz": "3"})),
+		},
+		Annotations: map[string]string{
+			ociTorcxManifestAnnotation: `{"kind": "image-manifest-v0", "value": {}}`,
+		},
+	}
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := addBlob(ociMediaTypeManifest, b)
+	desc.Annotations = map[string]string{ociRefNameAnnotation: "1"}
+	if b, err = json.Marshal(ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{desc}}); err != nil {
+		t.Fatal(err)
+	}
+	files[ociIndexFile] = b
+
+	fp, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	tw := tar.NewWriter(fp)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		hdr := &tar.Header{Name: "./" + name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnpackOCI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_test_oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	image := Image{Name: "foo", Reference: "1"}
+	layoutDir := filepath.Join(dir, "foo:1.torcx.oci")
+	tarPath := filepath.Join(dir, "foo:1.torcx.oci-archive")
+	writeOCITestLayout(t, layoutDir, tarPath)
+
+	archives := []Archive{
+		{Image: image, Filepath: layoutDir, Format: ArchiveFormatOCI},
+		{Image: image, Filepath: tarPath, Format: ArchiveFormatOCIArchive},
+	}
+	for i, archive := range archives {
+		target := filepath.Join(dir, "rootfs", string(archive.Format))
+		if err := os.MkdirAll(target, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := unpackOCI(archive, target); err != nil {
+			t.Errorf("#%d: %v", i, err)
+			continue
+		}
+		for _, p := range []string{"foo", "baz", manifestPath} {
+			if _, err := os.Stat(filepath.Join(target, p)); err != nil {
+				t.Errorf("#%d: expected %q: %v", i, p, err)
+			}
+		}
+		for _, p := range []string{"bar", ".wh.bar"} {
+			if _, err := os.Stat(filepath.Join(target, p)); err == nil {
+				t.Errorf("#%d: unexpected %q", i, p)
+			}
+		}
+	}
+
+	// Tamper with the first layer blob
+	blobs, err := filepath.Glob(filepath.Join(layoutDir, "blobs", "sha256", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blob := range blobs {
+		b, err := ioutil.ReadFile(blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) > 2 && b[0] == 0x1f && b[1] == 0x8b {
+			if err := ioutil.WriteFile(blob, append(b, 0), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	target := filepath.Join(dir, "rootfs", "tampered")
+	if err := os.MkdirAll(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unpackOCI(archives[0], target); err == nil {
+		t.Error("expected failure for a tampered layer")
+	}
+}
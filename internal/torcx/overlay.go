@@ -0,0 +1,150 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// ApplyMode selects how image contents are exposed on the host.
+type ApplyMode string
+
+const (
+	// ApplyModeSymlink only propagates assets listed in image manifests
+	ApplyModeSymlink ApplyMode = "symlink"
+	// ApplyModeOverlay additionally stacks image roots over OverlayTarget
+	ApplyModeOverlay ApplyMode = "overlay"
+
+	// DefaultOverlayTarget is the default directory extended in overlay mode
+	DefaultOverlayTarget = "/usr"
+)
+
+// Validate checks that the apply mode is a known one. An empty mode
+// stands for the default one (symlink).
+func (am ApplyMode) Validate() error {
+	switch am {
+	case "", ApplyModeSymlink, ApplyModeOverlay:
+		return nil
+	}
+	return errors.Errorf("unknown apply mode %q, must be one of %q, %q",
+		am, ApplyModeSymlink, ApplyModeOverlay)
+}
+
+// OverlayStatus reports the overlay mounted in overlay mode.
+type OverlayStatus struct {
+	Target string `json:"target"`
+	// Layers are image directories stacked over target, topmost first
+	Layers []string `json:"layers"`
+}
+
+// overlayTarget returns the directory extended in overlay mode, as seen
+// from within the root directory (and from within image roots).
+func (cc *CommonConfig) overlayTarget() string {
+	if cc.OverlayTarget != "" {
+		return cc.OverlayTarget
+	}
+	return DefaultOverlayTarget
+}
+
+// ProfileApplyMode returns the apply mode selected by the profile `name`,
+// or the configured one if the profile does not select any.
+func ProfileApplyMode(commonCfg *CommonConfig, name string) (ApplyMode, error) {
+	if commonCfg == nil {
+		return "", errors.New("missing common configuration")
+	}
+	if name == "" {
+		return commonCfg.ApplyMode, nil
+	}
+
+	localProfiles, err := ListProfiles(commonCfg.ProfileDirs())
+	if err != nil {
+		return "", errors.Wrap(err, "profiles listing failed")
+	}
+	profilePath, ok := localProfiles[name]
+	if !ok {
+		return "", errors.Errorf("profile %q not found", name)
+	}
+	value, err := readProfileV2Value(profilePath)
+	if err != nil {
+		return "", err
+	}
+	if value == nil || value.ApplyMode == "" {
+		return commonCfg.ApplyMode, nil
+	}
+	if err := value.ApplyMode.Validate(); err != nil {
+		return "", errors.Wrapf(err, "profile %q", name)
+	}
+	return value.ApplyMode, nil
+}
+
+// mountOverlay stacks the `target` directories of all image roots
+// read-only over the overlay target, later images taking precedence.
+// It returns nil if no image ships content for the target.
+func mountOverlay(applyCfg *ApplyConfig, tx *journalTx, imageRoots []string) (*OverlayStatus, error) {
+	// Image roots mirror the root directory: layers are looked up by
+	// the target path within the root, mounted over on the host
+	target := applyCfg.overlayTarget()
+	mountpoint := applyCfg.RootPath(target)
+	layers, err := overlayLayers(imageRoots, target)
+	if err != nil {
+		return nil, err
+	}
+	if len(layers) == 0 {
+		logrus.WithField("target", mountpoint).Debug("no overlay layers")
+		return nil, nil
+	}
+	if strings.ContainsAny(mountpoint, ":,") {
+		return nil, errors.Errorf("invalid overlay target %q", mountpoint)
+	}
+
+	// Without an upper directory, the overlay is read-only
+	lowerDirs := strings.Join(append(layers, mountpoint), ":")
+	if err := tx.record(JournalMount, mountpoint); err != nil {
+		return nil, err
+	}
+	if err := unix.Mount("overlay", mountpoint, "overlay", unix.MS_RDONLY, "lowerdir="+lowerDirs); err != nil {
+		return nil, errors.Wrapf(err, "failed to mount overlay on %q", mountpoint)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"target": mountpoint,
+		"layers": layers,
+	}).Debug("overlay mounted")
+	return &OverlayStatus{Target: mountpoint, Layers: layers}, nil
+}
+
+// overlayLayers returns the `target` directories of all image roots
+// which have one, topmost (i.e. last image) first.
+func overlayLayers(imageRoots []string, target string) ([]string, error) {
+	layers := []string{}
+	for i := len(imageRoots) - 1; i >= 0; i-- {
+		dir := filepath.Join(imageRoots[i], target)
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		if strings.ContainsAny(dir, ":,") {
+			return nil, errors.Errorf("invalid overlay layer path %q", dir)
+		}
+		layers = append(layers, dir)
+	}
+	return layers, nil
+}
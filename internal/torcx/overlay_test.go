@@ -0,0 +1,85 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOverlayLayers(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "torcx_overlay_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	unpackDir := filepath.Join(tmpDir, "sysroot", "run", "torcx", "unpack")
+	for _, dir := range []string{"a/usr/bin", "b/etc", "c/usr/lib"} {
+		if err := os.MkdirAll(filepath.Join(unpackDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	imageRoots := []string{
+		filepath.Join(unpackDir, "a"),
+		filepath.Join(unpackDir, "b"),
+		filepath.Join(unpackDir, "c"),
+	}
+
+	testCases := []struct {
+		desc string
+		cfg  CommonConfig
+
+		mountpoint string
+		layers     []string
+	}{
+		{
+			"host",
+			CommonConfig{},
+			"/usr",
+			[]string{filepath.Join(unpackDir, "c", "usr"), filepath.Join(unpackDir, "a", "usr")},
+		},
+		{
+			"alternate root",
+			CommonConfig{Root: filepath.Join(tmpDir, "sysroot")},
+			filepath.Join(tmpDir, "sysroot", "usr"),
+			[]string{filepath.Join(unpackDir, "c", "usr"), filepath.Join(unpackDir, "a", "usr")},
+		},
+		{
+			"alternate root, custom target",
+			CommonConfig{Root: filepath.Join(tmpDir, "sysroot"), OverlayTarget: "/etc"},
+			filepath.Join(tmpDir, "sysroot", "etc"),
+			[]string{filepath.Join(unpackDir, "b", "etc")},
+		},
+	}
+
+	for _, tt := range testCases {
+		target := tt.cfg.overlayTarget()
+		if mountpoint := tt.cfg.RootPath(target); mountpoint != tt.mountpoint {
+			t.Errorf("%s: expected mountpoint %q, got %q", tt.desc, tt.mountpoint, mountpoint)
+		}
+		layers, err := overlayLayers(imageRoots, target)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(layers, tt.layers) {
+			t.Errorf("%s: expected layers %v, got %v", tt.desc, tt.layers, layers)
+		}
+	}
+}
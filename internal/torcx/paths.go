@@ -16,6 +16,7 @@ package torcx
 
 import (
 	"path/filepath"
+	"strings"
 )
 
 const (
@@ -32,9 +33,11 @@ const (
 	OemProfilesDir = OemDir + "profiles"
 	// OemRemotesDir is the OEM remotes path
 	OemRemotesDir = OemDir + "remotes"
+	// OemTrustDir is the OEM store trust path
+	OemTrustDir = OemDir + "trust"
 
-	// defaultCfgPath is the default path for common torcx config
-	defaultCfgPath = DefaultConfDir + "config.json"
+	// DefaultConfigPath is the default path for common torcx config
+	DefaultConfigPath = DefaultConfDir + "config.json"
 )
 
 // VendorRemotesDir is the vendor remotes path
@@ -53,6 +56,14 @@ func VendorProfilesDir(usrMountpoint string) string {
 	return filepath.Join(usrMountpoint, "share", "torcx", "profiles")
 }
 
+// VendorTrustDir is the vendor store trust path
+func VendorTrustDir(usrMountpoint string) string {
+	if usrMountpoint == "" {
+		usrMountpoint = VendorUsrDir
+	}
+	return filepath.Join(usrMountpoint, "share", "torcx", "trust")
+}
+
 // VendorStoreDir is the vendor store path
 func VendorStoreDir(usrMountpoint string) string {
 	if usrMountpoint == "" {
@@ -61,11 +72,51 @@ func VendorStoreDir(usrMountpoint string) string {
 	return filepath.Join(usrMountpoint, "share", "torcx", "store")
 }
 
+// RootPath returns `path` within the configured root directory, if any.
+func (cc *CommonConfig) RootPath(path string) string {
+	if cc == nil || cc.Root == "" {
+		return path
+	}
+	return filepath.Join(cc.Root, path)
+}
+
+// RootRelative returns the host `path` as seen from within the configured
+// root directory, i.e. once it is booted. This is the form used for paths
+// written in the seal, in templates and in symlink destinations.
+// Paths outside of the root are returned unchanged.
+func (cc *CommonConfig) RootRelative(path string) string {
+	if cc == nil || cc.Root == "" {
+		return path
+	}
+	rel, err := filepath.Rel(cc.Root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return path
+	}
+	return filepath.Join("/", rel)
+}
+
+// SealFilePath is the path where metadata are written once the system
+// has been sealed.
+func (cc *CommonConfig) SealFilePath() string {
+	return cc.RootPath(SealPath)
+}
+
+// SealJSONFilePath is the path of the JSON seal document, next to the
+// metadata file.
+func (cc *CommonConfig) SealJSONFilePath() string {
+	return cc.SealFilePath() + ".json"
+}
+
 // RunUnpackDir is the directory where root filesystems are unpacked.
 func (cc *CommonConfig) RunUnpackDir() string {
 	return filepath.Join(cc.RunDir, "unpack")
 }
 
+// UnpackCacheDir is the directory where tarball archives are persistently unpacked.
+func (cc *CommonConfig) UnpackCacheDir() string {
+	return filepath.Join(cc.BaseDir, "unpack-cache")
+}
+
 // RunBinDir is the directory where binaries are symlinked.
 func (cc *CommonConfig) RunBinDir() string {
 	return filepath.Join(cc.RunDir, "bin")
@@ -75,7 +126,7 @@ func (cc *CommonConfig) RunBinDir() string {
 func (cc *CommonConfig) ProfileDirs() []string {
 	return []string{
 		VendorProfilesDir(cc.UsrDir),
-		OemProfilesDir,
+		cc.RootPath(OemProfilesDir),
 		cc.UserProfileDir(),
 	}
 }
@@ -85,6 +136,16 @@ func (cc *CommonConfig) RunProfile() string {
 	return filepath.Join(cc.RunDir, "profile.json")
 }
 
+// RunStatus is the file where the outcome of apply is reported.
+func (cc *CommonConfig) RunStatus() string {
+	return filepath.Join(cc.RunDir, "status.json")
+}
+
+// RunJournal is the file where changes performed by apply are recorded.
+func (cc *CommonConfig) RunJournal() string {
+	return filepath.Join(cc.RunDir, "journal.json")
+}
+
 // UserStorePath is the path where user-fetched archives are written.
 // An optional target version can be specified for versioned user store.
 func (cc *CommonConfig) UserStorePath(version string) string {
@@ -111,13 +172,22 @@ func (cc *CommonConfig) RemotesDirs() []string {
 	if cc != nil {
 		dirs = append(dirs, VendorRemotesDir(cc.UsrDir))
 	}
-	dirs = append(dirs, OemRemotesDir)
+	dirs = append(dirs, cc.RootPath(OemRemotesDir))
 	if cc != nil {
 		dirs = append(dirs, filepath.Join(cc.ConfDir, "remotes"))
 	}
 	return dirs
 }
 
+// TrustDirs returns the list of directories where we look for store trust manifests.
+func (cc *CommonConfig) TrustDirs() []string {
+	return []string{
+		VendorTrustDir(cc.UsrDir),
+		cc.RootPath(OemTrustDir),
+		filepath.Join(cc.ConfDir, "trust"),
+	}
+}
+
 // VendorOsReleasePath returns the path to vendor os-release file
 // for the specific OS partition mounted at `usrMountpoint`.
 func VendorOsReleasePath(usrMountpoint string) string {
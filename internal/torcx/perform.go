@@ -15,18 +15,18 @@
 package torcx
 
 import (
-	"archive/tar"
 	"bufio"
-	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/coreos/torcx/internal/third_party/docker/pkg/loopback"
-	pkgtar "github.com/coreos/torcx/pkg/tar"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sys/unix"
@@ -55,16 +55,66 @@ func ApplyProfile(applyCfg *ApplyConfig) error {
 		return errors.Wrap(err, "profile setup")
 	}
 
+	status := ApplyStatusV0{
+		LowerProfiles: []string{},
+		UpperProfile:  applyCfg.UpperProfile,
+		StartTime:     time.Now(),
+		Images:        []ImageStatusV0{},
+	}
+	if len(applyCfg.LowerProfiles) > 0 {
+		status.LowerProfiles = applyCfg.LowerProfiles
+	}
+
+	err = applyProfile(applyCfg, &status)
+
+	status.EndTime = time.Now()
+	status.Success = err == nil
+	if err != nil {
+		status.Error = err.Error()
+	}
+	if werr := writeApplyStatus(applyCfg.RunStatus(), status); werr != nil {
+		logrus.WithField("path", applyCfg.RunStatus()).Error("failed to write apply status: ", werr)
+		if err == nil {
+			err = werr
+		}
+	}
+	return err
+}
+
+// applyProfile merges and applies all configured profiles, reporting
+// per-image outcomes in `status`.
+func applyProfile(applyCfg *ApplyConfig, status *ApplyStatusV0) error {
 	images, err := mergeProfiles(applyCfg)
 	if err != nil {
 		return err
 	}
+	applied := images
+	var applyErr error
 	if len(images) > 0 {
-		if err := applyImages(applyCfg, images); err != nil {
-			return err
+		journal, err := newApplyJournal(applyCfg.RunJournal())
+		if err != nil {
+			return errors.Wrap(err, "journal setup")
 		}
+		applied, applyErr = applyImages(applyCfg, journal, images, nil, nil, status)
+	}
+
+	// The run profile only lists successfully applied images
+	if err := writeRunProfile(applyCfg, applied); err != nil {
+		return err
+	}
+	if applyErr != nil {
+		return applyErr
 	}
 
+	logrus.WithFields(logrus.Fields{
+		"upper profile":  applyCfg.UpperProfile,
+		"sealed profile": applyCfg.RunProfile(),
+	}).Debug("profile applied")
+	return nil
+}
+
+// writeRunProfile writes the list of applied images to RunProfile.
+func writeRunProfile(applyCfg *ApplyConfig, images []Image) error {
 	runProfile := ProfileManifestV0JSON{
 		Kind:  ProfileManifestV0K,
 		Value: ImagesToJSONV0(images),
@@ -82,128 +132,434 @@ func ApplyProfile(applyCfg *ApplyConfig) error {
 		return errors.Wrapf(err, "writing %q", applyCfg.RunProfile())
 	}
 
-	err = os.Chmod(applyCfg.RunProfile(), 0444)
-	if err != nil {
-		return err
-	}
+	return os.Chmod(applyCfg.RunProfile(), 0444)
+}
 
-	logrus.WithFields(logrus.Fields{
-		"upper profile":  applyCfg.UpperProfile,
-		"sealed profile": applyCfg.RunProfile(),
-	}).Debug("profile applied")
-	return nil
+// unpackedImage is the outcome of unpacking a single image.
+type unpackedImage struct {
+	tx        *journalTx
+	status    ImageStatusV0
+	imageRoot string
+	err       error
 }
 
-// applyImages unpacks and propagates assets from a list of images.
-func applyImages(applyCfg *ApplyConfig, images []Image) error {
+// unitGuard checks that an image may propagate assets for the given
+// systemd units, e.g. because they are not in use.
+type unitGuard func(im Image, units []string) error
+
+// applyImages unpacks and propagates assets from a list of images,
+// returning the successfully applied ones.
+// Each image is applied as a transaction: if any step fails, all changes
+// performed on its behalf are reverted. Failures of optional images are
+// only logged, while failures of required images make apply fail.
+// Images are unpacked in parallel, while assets are propagated one image
+// at a time, in profile order adjusted for dependencies between images.
+// Images in `installed` are already applied, rooted at the given directory:
+// they are only taken into account for dependencies and collisions.
+// If set, `guard` is checked before propagating units from other images.
+func applyImages(applyCfg *ApplyConfig, journal *applyJournal, images []Image, installed map[string]string, guard unitGuard, status *ApplyStatusV0) ([]Image, error) {
 	if applyCfg == nil {
-		return errors.New("missing apply configuration")
+		return nil, errors.New("missing apply configuration")
+	}
+	if status == nil {
+		return nil, errors.New("missing apply status")
 	}
 
 	storeCache, err := NewStoreCache(applyCfg.StorePaths)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Unpack all images, continuing on error
-	failedImages := []Image{}
+	owners, err := upperAssetOwners(applyCfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading asset owners")
+	}
+	unitOverrides, err := upperUnitOverrides(applyCfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading unit enablement overrides")
+	}
+	trust, err := LoadStoreTrust(&applyCfg.CommonConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading store trust")
+	}
+	rootHashes, err := upperVerityRootHashes(applyCfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading verity root hashes")
+	}
 
-	for _, im := range images {
-		// Some log fields we keep using
-		logFields := logrus.Fields{
-			"image":     im.Name,
-			"reference": im.Reference,
+	// Cache entries may be in use by already applied images
+	if applyCfg.UnpackCache && len(installed) == 0 {
+		if err := evictUnpackCache(applyCfg); err != nil {
+			logrus.Warn("unpack cache eviction failed: ", err)
 		}
+	}
+
+	unpacked := unpackImages(applyCfg, &storeCache, trust, rootHashes, journal, images, installed)
 
-		archive, err := storeCache.ArchiveFor(im)
+	planned := make([]*plannedImage, len(images))
+	for i, im := range images {
+		res := &unpacked[i]
+		if res.err != nil {
+			continue
+		}
+		pi, err := planImageManifest(applyCfg, hostFS{}, im.Name, res.imageRoot, unitOverrides[im.Name])
 		if err != nil {
-			logrus.WithFields(logFields).Error(err)
-			failedImages = append(failedImages, im)
+			logrus.WithFields(logrus.Fields{
+				"image":     im.Name,
+				"reference": im.Reference,
+			}).Error(err)
+			res.err = err
 			continue
 		}
-
-		var imageRoot string
-		switch archive.Format {
-		case ArchiveFormatTgz:
-			imageRoot, err = unpackTgz(applyCfg, archive.Filepath, im.Name)
-		case ArchiveFormatSquashfs:
-			imageRoot, err = mountSquashfs(applyCfg, archive.Filepath, im.Name)
-		default:
-			err = fmt.Errorf("unrecognized format for archive: %q", archive)
+		planned[i] = pi
+	}
+
+	order, unsatisfied := resolveDependencies(planned)
+	ordered := make([]*plannedImage, 0, len(order))
+	for _, i := range order {
+		if err, ok := unsatisfied[images[i].Name]; ok {
+			logrus.WithFields(logrus.Fields{
+				"image":     images[i].Name,
+				"reference": images[i].Reference,
+			}).Error("unsatisfied dependencies: ", err)
+			unpacked[i].err = errors.Wrap(err, "unsatisfied dependencies")
+			continue
 		}
-		if err != nil {
-			failedImages = append(failedImages, im)
-			logrus.WithFields(logFields).Error("failed to unpack: ", err)
+		ordered = append(ordered, planned[i])
+	}
+
+	// Keep full plans, to resolve collisions again if an owner fails
+	unresolved := make([]*plannedImage, 0, len(ordered))
+	for _, pi := range ordered {
+		unresolved = append(unresolved, pi.clone())
+	}
+	collisions, collided := resolveCollisions(ordered, applyCfg.CollisionPolicy, owners)
+	logCollisions(collisions)
+	status.Collisions = collisions
+
+	// Apply all images, continuing on error
+	applied := []Image{}
+	appliedRoots := []string{}
+	appliedPlans := []*plannedImage{}
+	failedRequired, failedOptional := 0, 0
+	failed := map[string]bool{}
+	done := make([]bool, len(images))
+
+	for _, i := range order {
+		im := images[i]
+		res := &unpacked[i]
+		done[i] = true
+		if _, ok := installed[im.Name]; ok {
+			if res.err != nil {
+				logrus.WithFields(logrus.Fields{
+					"image":     im.Name,
+					"reference": im.Reference,
+				}).Warn("applied image left in place: ", res.err)
+			}
+			applied = append(applied, im)
+			appliedRoots = append(appliedRoots, res.imageRoot)
+			if planned[i] != nil {
+				appliedPlans = append(appliedPlans, planned[i])
+			}
 			continue
 		}
-		logFields["path"] = imageRoot
-		logrus.WithFields(logFields).Debug("image unpacked")
-
-		assets, err := retrieveAssets(applyCfg, imageRoot)
-		if err != nil {
-			failedImages = append(failedImages, im)
-			logrus.WithFields(logFields).Error("failed retrieving assets from image: ", err)
+		err := res.err
+		if err == nil {
+			err = collided[im.Name]
+		}
+		if err == nil {
+			// Providers may have failed after dependencies were resolved
+			if err = unmetRequirement(planned[i], appliedPlans); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"image":     im.Name,
+					"reference": im.Reference,
+				}).Error(err)
+			}
+		}
+		if err == nil && guard != nil {
+			if err = guard(im, plannedUnits(planned[i].groups)); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"image":     im.Name,
+					"reference": im.Reference,
+				}).Error(err)
+			}
+		}
+		if err == nil {
+			err = propagateImage(res.tx, im, res.imageRoot, planned[i].groups, templateVars(applyCfg, res.imageRoot), &res.status)
+		}
+		res.status.finish(err)
+		status.Images = append(status.Images, res.status)
+		if err == nil {
+			applied = append(applied, im)
+			appliedRoots = append(appliedRoots, res.imageRoot)
+			appliedPlans = append(appliedPlans, planned[i])
 			continue
 		}
 
-		if len(assets.Binaries) > 0 {
-			if err := propagateBins(applyCfg, imageRoot, assets.Binaries); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Binaries).Error("failed to propagate binaries: ", err)
+		logFields := logrus.Fields{
+			"image":     im.Name,
+			"reference": im.Reference,
+			"optional":  im.Optional,
+		}
+		if im.Optional {
+			failedOptional++
+		} else {
+			failedRequired++
+		}
+		if err := res.tx.rollback(); err != nil {
+			logrus.WithFields(logFields).Error("failed to roll back image: ", err)
+		} else {
+			status.Images[len(status.Images)-1].RolledBack = true
+			logrus.WithFields(logFields).Warn("image rolled back")
+		}
+
+		// Assets owned by the failed image go to another one instead
+		failed[im.Name] = true
+		if !ownsCollision(collisions, im.Name) {
+			continue
+		}
+		var remaining []*plannedImage
+		remaining, collisions, collided = reassignCollisions(unresolved, failed, applyCfg.CollisionPolicy, owners)
+		logrus.WithFields(logFields).Warn("collisions resolved again without failed image")
+		logCollisions(collisions)
+		status.Collisions = collisions
+		for _, pi := range remaining {
+			j := imageIndex(images, pi.name)
+			if j < 0 || planned[j] == nil {
+				continue
+			}
+			if !done[j] {
+				planned[j] = pi
+				continue
+			}
+			if _, ok := installed[pi.name]; ok || failed[pi.name] {
 				continue
 			}
-			logrus.WithFields(logFields).WithField("assets", assets.Binaries).Debug("binaries propagated")
+			gained := gainedGroups(planned[j], pi)
+			planned[j] = pi
+			if len(gained) == 0 {
+				continue
+			}
+			st := imageStatus(status, pi.name)
+			if st == nil {
+				continue
+			}
+			if guard != nil {
+				if err := guard(images[j], plannedUnits(gained)); err != nil {
+					logrus.WithFields(logrus.Fields{
+						"image":     images[j].Name,
+						"reference": images[j].Reference,
+					}).Error("reassigned assets not propagated: ", err)
+					continue
+				}
+			}
+			if err := propagateImage(unpacked[j].tx, images[j], unpacked[j].imageRoot, gained, templateVars(applyCfg, unpacked[j].imageRoot), st); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"image":     images[j].Name,
+					"reference": images[j].Reference,
+				}).Error("failed to propagate reassigned assets: ", err)
+			}
 		}
+	}
 
-		if len(assets.Network) > 0 {
-			if err := propagateNetworkdUnits(applyCfg, imageRoot, assets.Network); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Network).Error("failed to propagate networkd units: ", err)
-				continue
+	if failedOptional > 0 {
+		logrus.Warnf("failed to install %d optional images, skipped", failedOptional)
+	}
+
+	if applyCfg.ApplyMode == ApplyModeOverlay && len(appliedRoots) > 0 {
+		// The overlay is not owned by any single image
+		tx := journal.begin("")
+		overlay, err := mountOverlay(applyCfg, tx, appliedRoots)
+		if err != nil {
+			logrus.Error(err)
+			if err := tx.rollback(); err != nil {
+				logrus.Error("failed to roll back overlay: ", err)
 			}
+			return applied, err
+		}
+		status.Overlay = overlay
+	}
+	if failedRequired > 0 {
+		return applied, fmt.Errorf("failed to install %d required images", failedRequired)
+	}
+
+	return applied, nil
+}
 
-			logrus.WithFields(logFields).WithField("assets", assets.Network).Debug("networkd units propagated")
+// logCollisions reports resolved asset collisions.
+func logCollisions(collisions []AssetCollision) {
+	for _, col := range collisions {
+		logFields := logrus.Fields{
+			"asset":      col.Asset,
+			"images":     col.Images,
+			"owner":      col.Owner,
+			"resolution": col.Resolution,
+		}
+		if col.Resolution == string(CollisionPolicyFail) {
+			logrus.WithFields(logFields).Error("asset collision")
+		} else {
+			logrus.WithFields(logFields).Warn("asset collision")
 		}
+	}
+}
 
-		if len(assets.Units) > 0 {
-			if err := propagateSystemdUnits(applyCfg, imageRoot, assets.Units); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Units).Error("failed to propagate systemd units: ", err)
-				continue
-			}
-			logrus.WithFields(logFields).WithField("assets", assets.Units).Debug("systemd units propagated")
+// imageIndex returns the index of the image named `name`, or -1.
+func imageIndex(images []Image, name string) int {
+	for i, im := range images {
+		if im.Name == name {
+			return i
 		}
+	}
+	return -1
+}
 
-		if len(assets.Sysusers) > 0 {
-			if err := propagateSysusersUnits(applyCfg, imageRoot, assets.Sysusers); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Sysusers).Error("failed to propagate sysusers: ", err)
-				continue
-			}
-			logrus.WithFields(logFields).WithField("assets", assets.Sysusers).Debug("sysusers propagated")
+// imageStatus returns the status of the image named `name`, if reported.
+func imageStatus(status *ApplyStatusV0, name string) *ImageStatusV0 {
+	for i := range status.Images {
+		if status.Images[i].Name == name {
+			return &status.Images[i]
 		}
+	}
+	return nil
+}
 
-		if len(assets.Tmpfiles) > 0 {
-			if err := propagateTmpfilesUnits(applyCfg, imageRoot, assets.Tmpfiles); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.Units).Error("failed to propagate tmpfiles: ", err)
-				continue
+// unpackImages unpacks or mounts all images concurrently, returning
+// results in the same order as `images`. Images in `installed` are
+// not unpacked again.
+func unpackImages(applyCfg *ApplyConfig, storeCache *StoreCache, trust *StoreTrust, rootHashes map[string]string, journal *applyJournal, images []Image, installed map[string]string) []unpackedImage {
+	workers := runtime.NumCPU()
+	if workers > len(images) {
+		workers = len(images)
+	}
+
+	results := make([]unpackedImage, len(images))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				res := &results[i]
+				res.imageRoot, res.err = unpackImage(applyCfg, storeCache, trust, rootHashes[images[i].Name], res.tx, images[i], &res.status)
 			}
-			logrus.WithFields(logFields).WithField("assets", assets.Units).Debug("tmpfiles propagated")
+		}()
+	}
+
+	for i, im := range images {
+		results[i].tx = journal.begin(im.Name)
+		results[i].status = newImageStatus(im)
+		if root, ok := installed[im.Name]; ok {
+			results[i].imageRoot = root
+			continue
 		}
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
 
-		if len(assets.UdevRules) > 0 {
-			if err := propagateUdevRules(applyCfg, imageRoot, assets.UdevRules); err != nil {
-				failedImages = append(failedImages, im)
-				logrus.WithFields(logFields).WithField("assets", assets.UdevRules).Error("failed to propagate udev rules: ", err)
-				continue
+	return results
+}
+
+// unpackImage unpacks or mounts a single image, returning its root
+// directory and recording all changes in the given journal transaction.
+// The archive signature and digest are checked against `trust` first,
+// its policy deciding whether archives without a digest are refused.
+// Squashfs and erofs archives are mounted through dm-verity if a root hash is known,
+// from `rootHash` (set by the profile) or from the store.
+func unpackImage(applyCfg *ApplyConfig, storeCache *StoreCache, trust *StoreTrust, rootHash string, tx *journalTx, im Image, imStatus *ImageStatusV0) (string, error) {
+	// Some log fields we keep using
+	logFields := logrus.Fields{
+		"image":     im.Name,
+		"reference": im.Reference,
+	}
+
+	archive, err := storeCache.ArchiveFor(im)
+	if err != nil {
+		logrus.WithFields(logFields).Error(err)
+		return "", err
+	}
+	imStatus.Archive = archive.Filepath
+	imStatus.Format = archive.Format
+
+	// Verify and unpack the same file, even if the store is updated meanwhile
+	if err := archive.pin(); err != nil {
+		logrus.WithFields(logFields).Error(err)
+		return "", err
+	}
+	defer archive.unpin()
+
+	signed, err := trust.VerifyArchive(archive)
+	if err != nil {
+		logrus.WithFields(logFields).Error("failed to verify signature: ", err)
+		return "", errors.Wrap(err, "failed to verify signature")
+	}
+	imStatus.Signed = signed
+
+	d, err := verifyArchive(archive, trust.Policy == SignaturePolicyRequire)
+	if err != nil {
+		logrus.WithFields(logFields).Error("failed to verify: ", err)
+		return "", errors.Wrap(err, "failed to verify")
+	}
+	imStatus.Verified = d != ""
+	if d != "" {
+		imStatus.Digest = formatHash(d)
+	}
+
+	var imageRoot string
+	switch archive.Format {
+	case ArchiveFormatTgz, ArchiveFormatTarZstd, ArchiveFormatTarXz, ArchiveFormatOCI, ArchiveFormatOCIArchive:
+		// Layout directories have no archive digest to key the cache on
+		if applyCfg.UnpackCache && archive.Format != ArchiveFormatOCI {
+			var rootfs string
+			rootfs, err = prepareCachedTarball(applyCfg, archive, d)
+			if err == nil {
+				imStatus.Cached = true
+				imageRoot, err = mountCachedTarball(applyCfg, tx, rootfs, im.Name)
+				break
 			}
-			logrus.WithFields(logFields).WithField("assets", assets.UdevRules).Debug("udev rules propagated")
+			logrus.WithFields(logFields).Warn("unpack cache unavailable, unpacking to tmpfs: ", err)
 		}
+		imageRoot, err = unpackArchive(applyCfg, tx, archive, im.Name)
+	case ArchiveFormatSquashfs, ArchiveFormatErofs:
+		var root []byte
+		if root, err = verityRootHash(&applyCfg.CommonConfig, archive, im, rootHash); err != nil {
+			break
+		}
+		imStatus.Verity = root != nil
+		imageRoot, err = mountImage(applyCfg, tx, archive, im.Name, root)
+	default:
+		err = fmt.Errorf("unrecognized format for archive %q: %q", archive.Filepath, archive.Format)
+	}
+	if err != nil {
+		logrus.WithFields(logFields).Error("failed to unpack: ", err)
+		return "", errors.Wrap(err, "failed to unpack")
+	}
+	imStatus.ImageRoot = imageRoot
+	logFields["path"] = imageRoot
+	logrus.WithFields(logFields).Debug("image unpacked")
+
+	return imageRoot, nil
+}
+
+// propagateImage propagates planned assets from an unpacked image,
+// recording all changes in the given journal transaction and
+// reporting them in `imStatus`. Templates are expanded with `vars`.
+func propagateImage(tx *journalTx, im Image, imageRoot string, groups []plannedGroup, vars map[string]string, imStatus *ImageStatusV0) error {
+	logFields := logrus.Fields{
+		"image":     im.Name,
+		"reference": im.Reference,
+		"path":      imageRoot,
 	}
 
-	if len(failedImages) > 0 {
-		return fmt.Errorf("failed to install %d images", len(failedImages))
+	for _, group := range groups {
+		ops, err := propagateAssets(tx, group.ops, vars)
+		imStatus.Assets = append(imStatus.Assets, assetEntries(group.kind, ops)...)
+		if err != nil {
+			logrus.WithFields(logFields).WithField("assets", group.entries).Errorf("failed to propagate %s: %s", group.desc, err)
+			return errors.Wrapf(err, "failed to propagate %s", group.desc)
+		}
+		logrus.WithFields(logFields).WithField("assets", group.entries).Debugf("%s propagated", group.desc)
 	}
 
 	return nil
@@ -211,32 +567,32 @@ func applyImages(applyCfg *ApplyConfig, images []Image) error {
 
 // SealSystemState is a one-time-op which seals the current state of the system,
 // after a torcx profile has been applied to it.
-func SealSystemState(applyCfg *ApplyConfig) error {
+// A non-nil `applyErr` records that applying the profile failed.
+func SealSystemState(applyCfg *ApplyConfig, applyErr error) error {
 	if applyCfg == nil {
 		return errors.New("missing apply configuration")
 	}
 
-	dirname := filepath.Dir(SealPath)
+	sealPath := applyCfg.SealFilePath()
+	dirname := filepath.Dir(sealPath)
 	if _, err := os.Stat(dirname); err != nil && os.IsNotExist(err) {
 		if err := os.MkdirAll(dirname, 0755); err != nil {
 			return err
 		}
 	}
 
-	fp, err := os.Create(SealPath)
+	seal := newSeal(applyCfg, applyErr)
+	if err := writeSeal(applyCfg.SealJSONFilePath(), seal); err != nil {
+		return errors.Wrap(err, "writing seal document")
+	}
+
+	fp, err := os.Create(sealPath)
 	if err != nil {
 		return err
 	}
 	defer fp.Close()
 
-	content := []string{
-		fmt.Sprintf("%s=%q", SealLowerProfiles, strings.Join(applyCfg.LowerProfiles, ":")),
-		fmt.Sprintf("%s=%q", SealUpperProfile, applyCfg.UpperProfile),
-		fmt.Sprintf("%s=%q", SealRunProfilePath, applyCfg.RunProfile()),
-		fmt.Sprintf("%s=%q", SealBindir, applyCfg.RunBinDir()),
-		fmt.Sprintf("%s=%q", SealUnpackdir, applyCfg.RunUnpackDir()),
-	}
-
+	content := seal.envLines()
 	for _, line := range content {
 		_, err = fp.WriteString(line + "\n")
 		if err != nil {
@@ -252,7 +608,7 @@ func SealSystemState(applyCfg *ApplyConfig) error {
 	}
 
 	logrus.WithFields(logrus.Fields{
-		"path":    SealPath,
+		"path":    sealPath,
 		"content": content,
 	}).Debug("system state sealed")
 
@@ -297,71 +653,88 @@ func setupPaths(applyCfg *ApplyConfig) error {
 	return nil
 }
 
-// unpackTgz renders a tgz rootfs, returning the target top directory.
-func unpackTgz(applyCfg *ApplyConfig, tgzPath, imageName string) (string, error) {
+// unpackArchive renders a tarball or OCI rootfs, returning the target top directory.
+func unpackArchive(applyCfg *ApplyConfig, tx *journalTx, archive Archive, imageName string) (string, error) {
 	if applyCfg == nil {
 		return "", errors.New("missing apply configuration")
 	}
 
-	if tgzPath == "" || imageName == "" {
+	if archive.Filepath == "" || imageName == "" {
 		return "", errors.New("missing unpack source")
 	}
 
 	topDir := filepath.Join(applyCfg.RunUnpackDir(), imageName)
-	if _, err := os.Stat(topDir); err != nil && os.IsNotExist(err) {
-		if err := os.MkdirAll(topDir, 0755); err != nil {
-			return "", err
-		}
-	}
-
-	fp, err := os.Open(tgzPath)
-	if err != nil {
-		return "", errors.Wrapf(err, "opening %q", tgzPath)
+	if err := tx.record(JournalUnpack, topDir); err != nil {
+		return "", err
 	}
-	defer fp.Close()
-
-	gr, err := gzip.NewReader(fp)
-	if err != nil {
+	if err := os.MkdirAll(topDir, 0755); err != nil {
 		return "", err
 	}
-	defer gr.Close()
 
-	tr := tar.NewReader(gr)
-	untarCfg := pkgtar.ExtractCfg{}.Default()
-	err = pkgtar.ChrootUntar(tr, topDir, untarCfg)
-	if err != nil {
-		return "", errors.Wrapf(err, "unpacking %q", tgzPath)
+	if err := extractArchive(archive, topDir); err != nil {
+		return "", err
 	}
-
 	return topDir, nil
 }
 
-// mountSquashfs mounts a squashfs rootfs, returning the mounted directory.
-func mountSquashfs(applyCfg *ApplyConfig, archivePath, imageName string) (string, error) {
+// mountImage loop-mounts a squashfs or erofs rootfs, returning the mounted directory.
+func mountImage(applyCfg *ApplyConfig, tx *journalTx, archive Archive, imageName string, rootHash []byte) (string, error) {
 	if applyCfg == nil {
 		return "", errors.New("missing apply configuration")
 	}
+	archivePath := archive.Filepath
 
 	if archivePath == "" || imageName == "" {
 		return "", errors.New("missing unpack source")
 	}
 
 	topDir := filepath.Join(applyCfg.RunUnpackDir(), imageName)
-	if _, err := os.Stat(topDir); err != nil && os.IsNotExist(err) {
-		if err := os.MkdirAll(topDir, 0755); err != nil {
-			return "", err
-		}
+	if err := tx.mkdirAll(topDir); err != nil {
+		return "", err
 	}
 
-	loopDev, err := loopback.AttachLoopDevice(archivePath)
+	var (
+		loopDev *os.File
+		err     error
+	)
+	if archive.file != nil {
+		loopDev, err = loopback.AttachLoopDeviceFile(archive.file)
+	} else {
+		loopDev, err = loopback.AttachLoopDevice(archivePath)
+	}
 	if err != nil {
-		return "", err
+		return "", errors.Wrapf(err, "attaching %q", archivePath)
 	}
+	// The mount holds a reference, the device is autocleared once unmounted
 	defer loopDev.Close()
+	mounted := false
+	defer func() {
+		if mounted {
+			return
+		}
+		if err := loopback.DetachLoopDevice(loopDev); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"device": loopDev.Name(),
+				"image":  imageName,
+			}).Warn("failed to detach loop device: ", err)
+		}
+	}()
 
-	if err := unix.Mount(loopDev.Name(), topDir, "squashfs", unix.MS_RDONLY, ""); err != nil {
+	device := loopDev.Name()
+	if rootHash != nil {
+		if device, err = setupVerity(tx, archive, loopDev, imageName, rootHash); err != nil {
+			return "", errors.Wrap(err, "verity setup failed")
+		}
+	}
+
+	// Record the mountpoint first, reverting an unmounted entry is harmless
+	if err := tx.record(JournalMount, topDir); err != nil {
 		return "", err
 	}
+	if err := unix.Mount(device, topDir, string(archive.Format), unix.MS_RDONLY, ""); err != nil {
+		return "", errors.Wrapf(err, "mounting %s", device)
+	}
+	mounted = true
 
 	return topDir, nil
 }
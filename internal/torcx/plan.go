@@ -0,0 +1,218 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ImagePlan describes how an image would be applied.
+type ImagePlan struct {
+	Name      string        `json:"name"`
+	Reference string        `json:"reference"`
+	Remote    string        `json:"remote,omitempty"`
+	Archive   string        `json:"archive,omitempty"`
+	Format    ArchiveFormat `json:"format,omitempty"`
+	ImageRoot string        `json:"image_root,omitempty"`
+	// Inspected is false if assets are unknown, as the archive format
+	// cannot be inspected without mounting or unpacking it
+	Inspected bool         `json:"inspected"`
+	Assets    []AssetEntry `json:"assets"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// notInspectableError is returned for valid archives whose content
+// cannot be listed without mounting or unpacking them.
+type notInspectableError struct {
+	format ArchiveFormat
+}
+
+func (e notInspectableError) Error() string {
+	return fmt.Sprintf("%s archives cannot be inspected without mounting or unpacking them", e.format)
+}
+
+// AssetEntry describes a single host path created when propagating an asset.
+type AssetEntry struct {
+	// Type is the asset type, as named in the image manifest
+	Type string `json:"type"`
+	// Kind is one of "dir", "file", "symlink" or "template"
+	Kind   string `json:"kind"`
+	Source string `json:"source,omitempty"`
+	Target string `json:"target"`
+	// LinkDest is the symlink destination, for "symlink" assets
+	LinkDest string `json:"link_dest,omitempty"`
+}
+
+// assetEntries converts propagation steps for an asset type into AssetEntry.
+func assetEntries(assetType string, ops []assetOp) []AssetEntry {
+	entries := make([]AssetEntry, 0, len(ops))
+	for _, op := range ops {
+		entries = append(entries, AssetEntry{
+			Type:     assetType,
+			Kind:     op.Kind,
+			Source:   op.Source,
+			Target:   op.Target,
+			LinkDest: op.LinkDest,
+		})
+	}
+	return entries
+}
+
+// PlanProfile computes how the configured profiles would be applied,
+// without mounting or writing anything on the system.
+// Images are listed in apply order. Per-image failures are reported in the
+// plan itself, together with assets shipped by more than one image.
+func PlanProfile(applyCfg *ApplyConfig) ([]ImagePlan, []AssetCollision, error) {
+	if applyCfg == nil {
+		return nil, nil, errors.New("missing apply configuration")
+	}
+
+	images, err := mergeProfiles(applyCfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	storeCache, err := NewStoreCache(applyCfg.StorePaths)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	owners, err := upperAssetOwners(applyCfg)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "reading asset owners")
+	}
+	unitOverrides, err := upperUnitOverrides(applyCfg)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "reading unit enablement overrides")
+	}
+
+	plans := make([]ImagePlan, 0, len(images))
+	planned := make([]*plannedImage, len(images))
+	for i, im := range images {
+		plan := ImagePlan{
+			Name:      im.Name,
+			Reference: im.Reference,
+			Remote:    im.Remote,
+			Assets:    []AssetEntry{},
+		}
+		pi, err := planImage(applyCfg, &storeCache, im, unitOverrides[im.Name], &plan)
+		if _, ok := errors.Cause(err).(notInspectableError); ok {
+			logrus.WithFields(logrus.Fields{
+				"image":     im.Name,
+				"reference": im.Reference,
+				"format":    plan.Format,
+			}).Info("image assets not inspectable")
+		} else if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"image":     im.Name,
+				"reference": im.Reference,
+			}).Warn("image would fail to apply: ", err)
+			plan.Error = err.Error()
+		}
+		if pi == nil && plan.Archive != "" {
+			// Archive found but not inspected, it still provides its name
+			pi = &plannedImage{name: im.Name}
+		}
+		planned[i] = pi
+		plans = append(plans, plan)
+	}
+
+	order, unsatisfied := resolveDependencies(planned)
+	ordered := make([]*plannedImage, 0, len(order))
+	for _, i := range order {
+		if err, ok := unsatisfied[images[i].Name]; ok {
+			plans[i].Error = errors.Wrap(err, "unsatisfied dependencies").Error()
+			continue
+		}
+		ordered = append(ordered, planned[i])
+	}
+
+	collisions, collided := resolveCollisions(ordered, applyCfg.CollisionPolicy, owners)
+	orderedPlans := make([]ImagePlan, 0, len(plans))
+	for _, i := range order {
+		plan := plans[i]
+		if err, ok := collided[plan.Name]; ok {
+			plan.Error = err.Error()
+		} else if planned[i] != nil && plan.Error == "" {
+			for _, group := range planned[i].groups {
+				plan.Assets = append(plan.Assets, assetEntries(group.kind, group.ops)...)
+			}
+		}
+		orderedPlans = append(orderedPlans, plan)
+	}
+
+	return orderedPlans, collisions, nil
+}
+
+// planImage fills `plan` with the archive for a single image,
+// returning the propagation steps for its assets.
+func planImage(applyCfg *ApplyConfig, storeCache *StoreCache, im Image, enable map[string]bool, plan *ImagePlan) (*plannedImage, error) {
+	archive, err := storeCache.ArchiveFor(im)
+	if err != nil {
+		return nil, err
+	}
+	plan.Archive = archive.Filepath
+	plan.Format = archive.Format
+
+	imageRoot := filepath.Join(applyCfg.RunUnpackDir(), im.Name)
+	plan.ImageRoot = imageRoot
+
+	fsys, err := inspectArchive(archive, imageRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	pi, err := planImageManifest(applyCfg, fsys, im.Name, imageRoot, enable)
+	if err != nil {
+		return nil, err
+	}
+	plan.Inspected = true
+	return pi, nil
+}
+
+// inspectArchive returns a read-only view on the content of an archive,
+// as if it was unpacked at `imageRoot`.
+func inspectArchive(archive Archive, imageRoot string) (imageFS, error) {
+	switch archive.Format {
+	case ArchiveFormatTgz, ArchiveFormatTarZstd, ArchiveFormatTarXz:
+		fp, err := os.Open(archive.Filepath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "opening %q", archive.Filepath)
+		}
+		defer fp.Close()
+
+		dr, err := decompressTarball(fp, archive.Format)
+		if err != nil {
+			return nil, err
+		}
+		defer dr.Close()
+
+		tfs, err := newTarFS(tar.NewReader(dr), imageRoot)
+		if err != nil {
+			return nil, errors.Wrapf(err, "indexing %q", archive.Filepath)
+		}
+		return tfs, nil
+	case ArchiveFormatSquashfs, ArchiveFormatErofs, ArchiveFormatOCI, ArchiveFormatOCIArchive:
+		return nil, notInspectableError{archive.Format}
+	}
+
+	return nil, errors.Errorf("unrecognized format for archive: %q", archive.Format)
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanImageNotInspectable(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "torcx_plan_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, name := range []string{"sq:1.torcx.squashfs", "ero:1.torcx.erofs", "oci:1.torcx.oci-archive"} {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	applyCfg := &ApplyConfig{CommonConfig: CommonConfig{RunDir: filepath.Join(tmpDir, "run")}}
+	storeCache, err := NewStoreCache([]string{tmpDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		image     Image
+		inspected bool
+		isErr     bool
+	}{
+		{Image{Name: "sq", Reference: "1"}, false, false},
+		{Image{Name: "ero", Reference: "1"}, false, false},
+		{Image{Name: "oci", Reference: "1"}, false, false},
+		{Image{Name: "missing", Reference: "1"}, false, true},
+	}
+
+	for _, tt := range testCases {
+		plan := ImagePlan{}
+		_, err := planImage(applyCfg, &storeCache, tt.image, nil, &plan)
+		if _, ok := err.(notInspectableError); ok {
+			err = nil
+			if plan.Archive == "" {
+				t.Errorf("%s: missing archive in plan", tt.image.Name)
+			}
+		}
+		if tt.isErr != (err != nil) {
+			t.Errorf("%s: unexpected error %v", tt.image.Name, err)
+		}
+		if plan.Inspected != tt.inspected {
+			t.Errorf("%s: expected inspected %t, got %t", tt.image.Name, tt.inspected, plan.Inspected)
+		}
+	}
+}
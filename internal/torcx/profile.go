@@ -31,43 +31,25 @@ import (
 var DefaultLowerProfiles = []string{VendorProfileName, OemProfileName}
 
 // CurrentProfileNames returns the name of the currently running user and vendor profiles
-func CurrentProfileNames() (string, []string, error) {
-	meta, err := ReadMetadata(SealPath)
+func (cc *CommonConfig) CurrentProfileNames() (string, []string, error) {
+	seal, err := cc.CurrentSeal()
 	if err != nil {
 		return "", nil, err
 	}
-	upperProfile, ok := meta[SealUpperProfile]
-	if !ok {
-		return "", nil, errors.New("unable to determine current upper profile name")
-	}
-	lowerString, ok := meta[SealLowerProfiles]
-	if !ok {
-		return "", nil, errors.New("unable to determine current lower profile names")
-	}
-	lowerProfiles := strings.Split(lowerString, ":")
-
-	return upperProfile, lowerProfiles, nil
+	return seal.UpperProfile, seal.LowerProfiles, nil
 }
 
 // CurrentProfilePath returns the path of the currently running profile
-func CurrentProfilePath() (string, error) {
-	var path string
-
-	meta, err := ReadMetadata(SealPath)
+func (cc *CommonConfig) CurrentProfilePath() (string, error) {
+	seal, err := cc.CurrentSeal()
 	if err != nil {
 		return "", err
 	}
-
-	path, ok := meta[SealRunProfilePath]
-	if !ok {
-		return "", errors.New("unable to determine current profile path")
-	}
-
-	if path == "" {
+	if seal.ProfilePath == "" {
 		return "", errors.New("invalid profile path")
 	}
 
-	return path, nil
+	return seal.ProfilePath, nil
 }
 
 // NextProfileName determines which profile will be used for the next apply.
@@ -105,8 +87,8 @@ func (cc *CommonConfig) SetNextProfileName(name string) error {
 }
 
 // ReadCurrentProfile returns the content of the currently running profile
-func ReadCurrentProfile() ([]Image, error) {
-	path, err := CurrentProfilePath()
+func (cc *CommonConfig) ReadCurrentProfile() ([]Image, error) {
+	path, err := cc.CurrentProfilePath()
 	if err != nil {
 		return nil, err
 	}
@@ -153,11 +135,89 @@ func readProfileReader(in io.Reader) ([]Image, error) {
 			return nil, err
 		}
 		return ImagesFromJSONV1(manifest.Value), nil
+	case ProfileManifestV2K:
+		manifest := ProfileManifestV2JSON{
+			Kind: container.Kind,
+		}
+		if err := json.Unmarshal(container.Value, &manifest.Value); err != nil {
+			return nil, err
+		}
+		return ImagesFromJSONV2(manifest.Value), nil
 	}
 
 	return nil, errors.Errorf("unknown profile kind %s", container.Kind)
 }
 
+// ReadProfileAssetOwners returns the asset owners declared by the profile
+// at `path`. Only v2 profiles can declare asset owners.
+func ReadProfileAssetOwners(path string) (map[string]string, error) {
+	value, err := readProfileV2Value(path)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return value.AssetOwners, nil
+}
+
+// ReadProfileUnitOverrides returns the unit enablement overrides declared
+// by the profile at `path`, by image name, if it is a v2 profile.
+func ReadProfileUnitOverrides(path string) (map[string]map[string]bool, error) {
+	value, err := readProfileV2Value(path)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	overrides := map[string]map[string]bool{}
+	for _, im := range value.Images {
+		if len(im.Enable) > 0 {
+			overrides[im.Name] = im.Enable
+		}
+	}
+	return overrides, nil
+}
+
+// ReadProfileVerityRootHashes returns the dm-verity root hashes declared
+// by the profile at `path`, by image name, if it is a v2 profile.
+func ReadProfileVerityRootHashes(path string) (map[string]string, error) {
+	value, err := readProfileV2Value(path)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	hashes := map[string]string{}
+	for _, im := range value.Images {
+		if im.VerityRootHash != "" {
+			hashes[im.Name] = im.VerityRootHash
+		}
+	}
+	return hashes, nil
+}
+
+// readProfileV2Value returns the content of the profile at `path`,
+// or nil if it is not a v2 profile.
+func readProfileV2Value(path string) (*ImagesV2, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var container kindValueJSON
+	err = json.NewDecoder(bufio.NewReader(fp)).Decode(&container)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if container.Kind != ProfileManifestV2K {
+		return nil, nil
+	}
+
+	var value ImagesV2
+	if err := json.Unmarshal(container.Value, &value); err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
 // AddToProfile adds an image to an existing profile.
 func AddToProfile(profilePath string, im Image) error {
 	st, err := os.Stat(profilePath)
@@ -165,7 +225,13 @@ func AddToProfile(profilePath string, im Image) error {
 		return err
 	}
 
-	// Try v1 first
+	// Try v2 first, empty profiles are still written as v1
+	v2Profile, err := getProfileV2(profilePath)
+	if err == nil && st.Size() > 0 {
+		return addToProfileV2(profilePath, st.Mode().Perm(), v2Profile, &im)
+	}
+
+	// Then v1
 	v1Profile, err := getProfileV1(profilePath)
 	if err == nil {
 		return addToProfileV1(profilePath, st.Mode().Perm(), v1Profile, &im)
@@ -208,6 +274,34 @@ func getProfileV0(profilePath string) (ProfileManifestV0JSON, error) {
 	return manifest, nil
 }
 
+// getProfileV2 reads a profile from the given path, returning the unmarshalled
+// JSON (v2) profile manifest.
+func getProfileV2(profilePath string) (ProfileManifestV2JSON, error) {
+	var manifest ProfileManifestV2JSON
+	empty := ProfileManifestV2JSON{
+		Kind: ProfileManifestV2K,
+	}
+
+	b, err := ioutil.ReadFile(profilePath)
+	if err != nil {
+		if err == io.EOF {
+			return empty, nil
+		}
+		return ProfileManifestV2JSON{}, err
+	}
+	if len(b) == 0 {
+		return empty, nil
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return ProfileManifestV2JSON{}, err
+	}
+	if manifest.Kind != ProfileManifestV2K {
+		return manifest, errors.Errorf("expected manifest kind %s, got %s", ProfileManifestV2K, manifest.Kind)
+	}
+
+	return manifest, nil
+}
+
 // getProfileV1 reads a profile from the given path, returning the unmarshalled
 // JSON (v1) profile manifest.
 func getProfileV1(profilePath string) (ProfileManifestV1JSON, error) {
@@ -294,6 +388,42 @@ func addToProfileV1(profilePath string, perm os.FileMode, manifest ProfileManife
 	return ioutil.WriteFile(profilePath, b, perm)
 }
 
+// addToProfileV2 adds an image to the given JSON (v2) profile manifest,
+// and writes it to disk at the given path.
+func addToProfileV2(profilePath string, perm os.FileMode, manifest ProfileManifestV2JSON, im *Image) error {
+	// Update if existing
+	found := false
+	if im == nil {
+		found = true
+	}
+	for idx, mim := range manifest.Value.Images {
+		if found {
+			break
+		}
+		if mim.Name == im.Name {
+			entry := im.ToJSONV2()
+			entry.Optional = mim.Optional
+			entry.Enable = mim.Enable
+			// The root hash only applies to the same archive
+			if mim.Reference == im.Reference {
+				entry.VerityRootHash = mim.VerityRootHash
+			}
+			manifest.Value.Images[idx] = entry
+			found = true
+		}
+	}
+	// Add otherwise
+	if !found {
+		manifest.Value.Images = append(manifest.Value.Images, im.ToJSONV2())
+	}
+
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(profilePath, b, perm)
+}
+
 // ListProfiles returns a list of all available profiles
 func ListProfiles(profileDirs []string) (map[string]string, error) {
 	profiles := map[string]string{}
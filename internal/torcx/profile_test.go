@@ -126,6 +126,51 @@ func TestProfileAdd(t *testing.T) {
 	}
 }
 
+func TestProfileAddV2(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "test-torcx-add-profile-v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	profilePath := tmp.Name()
+	defer os.Remove(profilePath)
+
+	content := `{"kind": "profile-manifest-v2", "value": {"images": [{"name": "toolbox", "reference": "1", "optional": true}], "asset_owners": {"bin/runc": "docker"}}}`
+	if _, err := tmp.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tmp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Updating an optional image keeps it optional
+	if err := AddToProfile(profilePath, Image{Name: "toolbox", Reference: "2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddToProfile(profilePath, Image{Name: "docker", Reference: "17"}); err != nil {
+		t.Fatal(err)
+	}
+
+	images, err := ReadProfilePath(profilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expImages := []Image{
+		{Name: "toolbox", Reference: "2", Optional: true},
+		{Name: "docker", Reference: "17"},
+	}
+	if !reflect.DeepEqual(expImages, images) {
+		t.Fatalf("images do not match with each other.\nexpected:%v\nout:%v\n", expImages, images)
+	}
+
+	owners, err := ReadProfileAssetOwners(profilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owners["bin/runc"] != "docker" {
+		t.Fatalf("expected asset owners to be preserved, got %v", owners)
+	}
+}
+
 func TestMergeImages(t *testing.T) {
 	testCases := []struct {
 		desc  string
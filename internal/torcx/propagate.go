@@ -17,7 +17,6 @@ package torcx
 import (
 	"encoding/json"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -28,146 +27,215 @@ import (
 const (
 	// manifestPath is the well-known location for image manifest
 	manifestPath = "/.torcx/manifest.json"
-	// TODO(lucab): possibly not constant, group all link-time parameter together
 	// systemdDir is the runtime systemd base path
-	systemdDir   = "/run/systemd"
-	sysUsersDir  = "/run/sysusers.d"
-	tmpFilesDir  = "/run/tmpfiles.d"
-	udevRulesDir = "/run/udev/rules.d"
+	systemdDir     = "/run/systemd"
+	sysUsersDir    = "/run/sysusers.d"
+	tmpFilesDir    = "/run/tmpfiles.d"
+	udevRulesDir   = "/run/udev/rules.d"
+	sysctlDir      = "/run/sysctl.d"
+	modulesLoadDir = "/run/modules-load.d"
+	modprobeDir    = "/run/modprobe.d"
+	environmentDir = "/run/environment.d"
+	presetsDir     = "/run/systemd/system-preset"
 )
 
-func retrieveAssets(applyCfg *ApplyConfig, imageRoot string) (*Assets, error) {
+// PropagationDirs are the host directories where assets are propagated.
+// Empty entries stand for the default runtime directories.
+type PropagationDirs struct {
+	Units       string
+	Network     string
+	Sysusers    string
+	Tmpfiles    string
+	UdevRules   string
+	Sysctl      string
+	ModulesLoad string
+	Modprobe    string
+	Environment string
+	Presets     string
+}
+
+// withDefaults returns a copy of `pd` with all empty entries set
+// to the default runtime directories, within `root`. Explicit entries
+// (e.g. the generator output directory passed by systemd) are used
+// as they are.
+func (pd PropagationDirs) withDefaults(root *CommonConfig) PropagationDirs {
+	setDefault := func(dir *string, path string) {
+		if *dir == "" {
+			*dir = root.RootPath(path)
+		}
+	}
+	setDefault(&pd.Units, filepath.Join(systemdDir, "system"))
+	setDefault(&pd.Network, filepath.Join(systemdDir, "network"))
+	setDefault(&pd.Sysusers, sysUsersDir)
+	setDefault(&pd.Tmpfiles, tmpFilesDir)
+	setDefault(&pd.UdevRules, udevRulesDir)
+	setDefault(&pd.Sysctl, sysctlDir)
+	setDefault(&pd.ModulesLoad, modulesLoadDir)
+	setDefault(&pd.Modprobe, modprobeDir)
+	setDefault(&pd.Environment, environmentDir)
+	setDefault(&pd.Presets, presetsDir)
+	return pd
+}
+
+// retrieveAssets reads the image manifest from an image, returning the
+// list of assets to propagate.
+func retrieveAssets(applyCfg *ApplyConfig, fsys imageFS, imageRoot string) (*Assets, error) {
+	manifest, err := retrieveManifest(applyCfg, fsys, imageRoot)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest.Assets, nil
+}
+
+// retrieveManifest reads the image manifest from an image, returning the
+// list of assets to propagate, the image dependencies and unit enablement.
+func retrieveManifest(applyCfg *ApplyConfig, fsys imageFS, imageRoot string) (*ImageManifestV1Value, error) {
 	if applyCfg == nil {
 		return nil, errors.New("missing apply configuration")
 	}
+	if fsys == nil {
+		return nil, errors.New("missing image filesystem")
+	}
 	if imageRoot == "" {
 		return nil, errors.New("missing image top directory")
 	}
-	assets := &Assets{}
 	path := filepath.Join(imageRoot, manifestPath)
-	_, err := os.Stat(path)
+	_, err := fsys.Stat(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// Corner-case: missing manifest, no assets to propagate
-			return assets, nil
+			return &ImageManifestV1Value{}, nil
 		}
 		return nil, err
 	}
 
-	var manifest ImageManifestV0
-	b, err := ioutil.ReadFile(path)
+	b, err := fsys.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	if err := json.Unmarshal(b, &manifest); err != nil {
+	var container kindValueJSON
+	if err := json.Unmarshal(b, &container); err != nil {
 		return nil, err
 	}
+	if len(container.Value) == 0 {
+		return &ImageManifestV1Value{}, nil
+	}
 
-	return &manifest.Value, nil
-}
-
-// propagateNetworkdUnits installs networkd unit files as runtime units (in /run/systemd/network/).
-func propagateNetworkdUnits(applyCfg *ApplyConfig, imageRoot string, units []string) error {
-	ndUnitsDir := filepath.Join(systemdDir, "network")
-	return propagateUnits(applyCfg, imageRoot, units, ndUnitsDir)
-}
+	if container.Kind == ImageManifestV1K {
+		var value ImageManifestV1Value
+		if err := json.Unmarshal(container.Value, &value); err != nil {
+			return nil, err
+		}
+		return &value, nil
+	}
 
-// propagateSystemdUnits installs systemd unit files as runtime units (in /run/systemd/system/).
-func propagateSystemdUnits(applyCfg *ApplyConfig, imageRoot string, units []string) error {
-	sdUnitsDir := filepath.Join(systemdDir, "system")
-	return propagateUnits(applyCfg, imageRoot, units, sdUnitsDir)
+	// Earlier manifests only carry assets
+	var assets Assets
+	if err := json.Unmarshal(container.Value, &assets); err != nil {
+		return nil, err
+	}
+	return &ImageManifestV1Value{Assets: assets}, nil
 }
 
-// propagateSysusersUnits installs sysusers files as runtime configuration (in /run/sysusers.d/).
-func propagateSysusersUnits(applyCfg *ApplyConfig, imageRoot string, units []string) error {
-	return propagateUnits(applyCfg, imageRoot, units, sysUsersDir)
+// assetGroup is a list of assets of the same type, all propagated
+// to the same host directory.
+type assetGroup struct {
+	// kind is the asset type, as named in the image manifest
+	kind string
+	// desc is a human-readable description, used for logging
+	desc string
+	// dir is the host directory where assets are propagated
+	dir string
+	// bins marks binaries, which are symlinked with all intermediate
+	// directories flattened
+	bins bool
+	// entries are the assets paths, relative to the image root
+	// (unit names, for unit enablement)
+	entries []string
 }
 
-// propagateTmpfilesUnits installs tmpfiles files as runtime configuration (in /run/tmpfiles.d/).
-func propagateTmpfilesUnits(applyCfg *ApplyConfig, imageRoot string, units []string) error {
-	return propagateUnits(applyCfg, imageRoot, units, tmpFilesDir)
+// assetGroups returns the propagation settings for all asset types in `assets`.
+func assetGroups(applyCfg *ApplyConfig, assets *Assets) []assetGroup {
+	dirs := applyCfg.Dirs.withDefaults(&applyCfg.CommonConfig)
+	return []assetGroup{
+		{"bin", "binaries", applyCfg.RunBinDir(), true, assets.Binaries},
+		{"network", "networkd units", dirs.Network, false, assets.Network},
+		{"units", "systemd units", dirs.Units, false, assets.Units},
+		{"sysusers", "sysusers", dirs.Sysusers, false, assets.Sysusers},
+		{"tmpfiles", "tmpfiles", dirs.Tmpfiles, false, assets.Tmpfiles},
+		{"udev_rules", "udev rules", dirs.UdevRules, false, assets.UdevRules},
+		{"sysctl", "sysctl settings", dirs.Sysctl, false, assets.Sysctl},
+		{"modules_load", "kernel modules to load", dirs.ModulesLoad, false, assets.ModulesLoad},
+		{"modprobe", "modprobe settings", dirs.Modprobe, false, assets.Modprobe},
+		{"environment", "environment settings", dirs.Environment, false, assets.Environment},
+		{"presets", "systemd presets", dirs.Presets, false, assets.Presets},
+	}
 }
 
-// propagateUdevRules installs udev rules as runtime configuration (in /run/udev/rules.d/).
-func propagateUdevRules(applyCfg *ApplyConfig, imageRoot string, udevRules []string) error {
-	return propagateUnits(applyCfg, imageRoot, udevRules, udevRulesDir)
+// assetOp is a single propagation step, creating `Target` on the host.
+type assetOp struct {
+	// Kind is one of JournalDir, JournalFile, JournalSymlink or assetTemplate
+	Kind string
+	// Source is the path of the asset within the image root
+	Source string
+	// Target is the host path to create
+	Target string
+	// LinkDest is the symlink destination, for JournalSymlink
+	LinkDest string
 }
 
-// propagateUnits installs unit assets as runtime units for systemd/networkd/etc.
-func propagateUnits(applyCfg *ApplyConfig, imageRoot string, units []string, unitsDir string) error {
-	if len(units) <= 0 {
-		// Corner-case: no units to propagate
-		return nil
+// planAssets computes all propagation steps for a group of assets,
+// without touching the host.
+func planAssets(fsys imageFS, imageRoot string, group assetGroup) ([]assetOp, error) {
+	if len(group.entries) <= 0 {
+		// Corner-case: no assets to propagate
+		return nil, nil
 	}
-	if applyCfg == nil {
-		return errors.New("missing apply configuration")
+	if fsys == nil {
+		return nil, errors.New("missing image filesystem")
 	}
 	if imageRoot == "" {
-		return errors.New("missing image top directory")
+		return nil, errors.New("missing image top directory")
 	}
-	if unitsDir == "" {
-		return errors.New("missing image target directory")
+	if group.dir == "" {
+		return nil, errors.New("missing image target directory")
 	}
 
-	if _, err := os.Stat(unitsDir); err != nil {
-		if !os.IsNotExist(err) {
-			return errors.Wrapf(err, "error checking runtime directory %s", unitsDir)
-		}
-		if err := os.MkdirAll(unitsDir, 0755); err != nil {
-			return errors.Wrapf(err, "error creating runtime directory %s", unitsDir)
-		}
+	ops := []assetOp{}
+	if !group.bins {
+		ops = append(ops, assetOp{Kind: JournalDir, Target: group.dir})
 	}
-
-	for _, servEntry := range units {
-		if servEntry == "" {
+	for _, entry := range group.entries {
+		if entry == "" {
 			continue
 		}
-		path := filepath.Join(imageRoot, servEntry)
-		if err := symlinkUnitAsset(applyCfg, unitsDir, path); err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-// propagateBins symlinks binaries from unpacked image to torcx bindir.
-func propagateBins(applyCfg *ApplyConfig, imageRoot string, binaries []string) error {
-	if len(binaries) <= 0 {
-		// Corner-case: no binaries to propagate
-		return nil
-	}
-	if applyCfg == nil {
-		return errors.New("missing apply configuration")
-	}
-	if imageRoot == "" {
-		return errors.New("missing image top directory")
-	}
-
-	for _, binEntry := range binaries {
-		if binEntry == "" {
-			continue
+		path := filepath.Join(imageRoot, entry)
+		var entryOps []assetOp
+		var err error
+		if group.bins {
+			entryOps, err = planBinAsset(fsys, group.dir, path)
+		} else {
+			entryOps, err = planUnitAsset(fsys, group.dir, path)
 		}
-		path := filepath.Join(imageRoot, binEntry)
-		if err := symlinkBinAsset(applyCfg, applyCfg.RunBinDir(), path); err != nil {
-			return err
+		if err != nil {
+			return nil, err
 		}
+		ops = append(ops, entryOps...)
 	}
-	return nil
+	return ops, nil
 }
 
-// flattenBinAssets propagates a single binary or a directory of binaries,
+// planBinAsset propagates a single binary or a directory of binaries,
 // flattening all intermediate directories.
-func symlinkBinAsset(applyCfg *ApplyConfig, binDir string, asset string) error {
-	if applyCfg == nil {
-		return errors.New("missing apply configuration")
-	}
+func planBinAsset(fsys imageFS, binDir string, asset string) ([]assetOp, error) {
 	if asset == "" {
-		return errors.New("missing asset path")
+		return nil, errors.New("missing asset path")
 	}
 	if binDir == "" {
-		return errors.New("missing torcx binary directory")
+		return nil, errors.New("missing torcx binary directory")
 	}
 
+	ops := []assetOp{}
 	walkFn := func(inPath string, inInfo os.FileInfo, inErr error) error {
 		if inErr != nil {
 			return nil
@@ -177,41 +245,43 @@ func symlinkBinAsset(applyCfg *ApplyConfig, binDir string, asset string) error {
 		newName := filepath.Join(binDir, baseName)
 
 		if inInfo.Mode().IsRegular() || inInfo.Mode()&os.ModeSymlink == os.ModeSymlink {
-			if _, err := os.Stat(newName); err == nil {
-				// Do not overwrite previous assets
-				return nil
-			}
-			return os.Symlink(path, newName)
+			ops = append(ops, assetOp{
+				Kind:     JournalSymlink,
+				Source:   path,
+				Target:   newName,
+				LinkDest: path,
+			})
 		}
 		return nil
 	}
 
-	return filepath.Walk(asset, walkFn)
+	if err := fsys.Walk(asset, walkFn); err != nil {
+		return nil, err
+	}
+	return ops, nil
 }
 
-// symlinkUnitAsset propagates a single unit or a directory of units,
+// planUnitAsset propagates a single unit or a directory of units,
 // flattening all but the last intermediate directories.
-func symlinkUnitAsset(applyCfg *ApplyConfig, unitsDir string, asset string) error {
-	if applyCfg == nil {
-		return errors.New("missing apply configuration")
-	}
+func planUnitAsset(fsys imageFS, unitsDir string, asset string) ([]assetOp, error) {
 	if asset == "" {
-		return errors.New("missing asset path")
+		return nil, errors.New("missing asset path")
 	}
 	if unitsDir == "" {
-		return errors.New("missing host units directory")
+		return nil, errors.New("missing host units directory")
 	}
 
 	// If asset is a directory, keep everything below it unflattened
 	topDir := ""
-	fi, err := os.Stat(asset)
+	fi, err := fsys.Stat(asset)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if fi.IsDir() {
 		topDir = filepath.Dir(asset)
 	}
 
+	ops := []assetOp{}
 	walkFn := func(inPath string, inInfo os.FileInfo, inErr error) error {
 		if inErr != nil {
 			return nil
@@ -228,45 +298,134 @@ func symlinkUnitAsset(applyCfg *ApplyConfig, unitsDir string, asset string) erro
 			if inPath != asset {
 				return filepath.SkipDir
 			}
-			_, err := os.Stat(hostPath)
-			if err != nil && os.IsNotExist(err) {
-				return os.MkdirAll(hostPath, 0755)
-			}
-			return err
+			ops = append(ops, assetOp{Kind: JournalDir, Source: path, Target: hostPath})
+			return nil
 		}
 
 		if inInfo.Mode()&os.ModeSymlink == os.ModeSymlink {
 			// This mimics `systemctl enable` behavior, expecting dependency
 			// symlinks to be relative and pointing to units in the parent directory.
-			linkDest, err := os.Readlink(path)
+			linkDest, err := fsys.Readlink(path)
 			if err != nil {
 				return errors.Wrapf(err, "could not read link %q", path)
 			}
-			return os.Symlink(linkDest, hostPath)
+			ops = append(ops, assetOp{
+				Kind:     JournalSymlink,
+				Source:   path,
+				Target:   hostPath,
+				LinkDest: linkDest,
+			})
+			return nil
 		}
 
 		if inInfo.Mode().IsRegular() {
-			if _, err := os.Stat(hostPath); err == nil {
-				// Do not overwrite previous assets
-				return nil
+			ops = append(ops, assetOp{Kind: JournalFile, Source: path, Target: hostPath})
+		}
+		return nil
+	}
+
+	if err := fsys.Walk(asset, walkFn); err != nil {
+		return nil, err
+	}
+	return ops, nil
+}
+
+// propagateAssets performs all propagation steps on the host,
+// recording all changes in the given journal transaction.
+// Existing host paths are never overwritten. Templates are expanded
+// with `vars`. It returns the list of steps which have been actually performed.
+func propagateAssets(tx *journalTx, ops []assetOp, vars map[string]string) ([]assetOp, error) {
+	done := []assetOp{}
+	for _, op := range ops {
+		if _, err := os.Lstat(op.Target); err == nil {
+			// Do not overwrite previous assets
+			continue
+		} else if !os.IsNotExist(err) {
+			return done, errors.Wrapf(err, "error checking %s", op.Target)
+		}
+
+		switch op.Kind {
+		case JournalDir:
+			if err := tx.mkdirAll(op.Target); err != nil {
+				return done, errors.Wrapf(err, "error creating runtime directory %s", op.Target)
 			}
-			fpDst, err := os.Create(hostPath)
+		case JournalSymlink:
+			err := tx.create(JournalSymlink, op.Target, func() error {
+				return os.Symlink(op.LinkDest, op.Target)
+			})
 			if err != nil {
-				return errors.Wrapf(err, "error creating %q", hostPath)
+				return done, err
 			}
-			defer fpDst.Close()
-			fpSrc, err := os.Open(path)
-			if err != nil {
-				return errors.Wrapf(err, "error opening %q", path)
+		case JournalFile:
+			if err := copyAsset(tx, op.Source, op.Target); err != nil {
+				return done, err
 			}
-			defer fpSrc.Close()
-			if _, err := io.Copy(fpDst, fpSrc); err != nil {
-				return errors.Wrapf(err, "error copying to %q", hostPath)
+		case assetTemplate:
+			if err := copyTemplate(tx, op.Source, op.Target, vars); err != nil {
+				return done, err
 			}
+		default:
+			return done, errors.Errorf("unknown propagation step %q", op.Kind)
+		}
+		done = append(done, op)
+	}
+	return done, nil
+}
+
+// copyAsset copies a single file from an image to the host.
+func copyAsset(tx *journalTx, srcPath string, hostPath string) error {
+	fpDst, err := tx.createFile(hostPath)
+	if err != nil {
+		return err
+	}
+	defer fpDst.Close()
+	fpSrc, err := os.Open(srcPath)
+	if err != nil {
+		return errors.Wrapf(err, "error opening %q", srcPath)
+	}
+	defer fpSrc.Close()
+	if _, err := io.Copy(fpDst, fpSrc); err != nil {
+		return errors.Wrapf(err, "error copying to %q", hostPath)
+	}
+	return nil
+}
+
+// RestoreGeneratedUnits re-creates the units of applied images which were
+// propagated to the generator directory `unitsDir`. Systemd empties it
+// before running generators again on each reload.
+func RestoreGeneratedUnits(applyCfg *ApplyConfig, unitsDir string) error {
+	if applyCfg == nil {
+		return errors.New("missing apply configuration")
+	}
+	doc, err := ReadApplyStatus(applyCfg.RunStatus())
+	if err != nil {
+		if os.IsNotExist(err) {
 			return nil
 		}
-		return nil
+		return err
 	}
 
-	return filepath.Walk(asset, walkFn)
+	prefix := filepath.Clean(unitsDir) + string(filepath.Separator)
+	for _, st := range doc.Value.Images {
+		if !st.Success {
+			continue
+		}
+		ops := []assetOp{}
+		for _, asset := range st.Assets {
+			if asset.Type != "units" || !strings.HasPrefix(asset.Target, prefix) {
+				continue
+			}
+			ops = append(ops, assetOp{
+				Kind:     asset.Kind,
+				Source:   asset.Source,
+				Target:   asset.Target,
+				LinkDest: asset.LinkDest,
+			})
+		}
+		// Restored paths are already recorded in the journal
+		if _, err := propagateAssets(nil, ops, templateVars(applyCfg, st.ImageRoot)); err != nil {
+			return errors.Wrapf(err, "restoring units of image %q", st.Name)
+		}
+	}
+	return nil
 }
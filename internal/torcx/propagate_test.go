@@ -0,0 +1,157 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPropagationDirsWithDefaults(t *testing.T) {
+	testCases := []struct {
+		desc string
+		root string
+		dirs PropagationDirs
+
+		units   string
+		network string
+	}{
+		{
+			"defaults",
+			"",
+			PropagationDirs{},
+			"/run/systemd/system",
+			"/run/systemd/network",
+		},
+		{
+			"alternate root",
+			"/sysroot",
+			PropagationDirs{},
+			"/sysroot/run/systemd/system",
+			"/sysroot/run/systemd/network",
+		},
+		{
+			"generator directory",
+			"",
+			PropagationDirs{Units: "/run/systemd/generator"},
+			"/run/systemd/generator",
+			"/run/systemd/network",
+		},
+		{
+			"generator directory, alternate root",
+			"/sysroot",
+			PropagationDirs{Units: "/run/systemd/generator"},
+			"/run/systemd/generator",
+			"/sysroot/run/systemd/network",
+		},
+	}
+
+	for _, tt := range testCases {
+		dirs := tt.dirs.withDefaults(&CommonConfig{Root: tt.root})
+		if dirs.Units != tt.units {
+			t.Errorf("%s: expected units in %q, got %q", tt.desc, tt.units, dirs.Units)
+		}
+		if dirs.Network != tt.network {
+			t.Errorf("%s: expected network in %q, got %q", tt.desc, tt.network, dirs.Network)
+		}
+	}
+}
+
+func TestRestoreGeneratedUnits(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "torcx_propagate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	root := filepath.Join(tmpDir, "unpack", "foo")
+	unitsSrc := filepath.Join(root, "lib", "systemd", "system")
+	if err := os.MkdirAll(unitsSrc, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(unitsSrc, "foo.service"), []byte("ExecStart=${TORCX_IMAGE_ROOT}/bin/foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	genDir := filepath.Join(tmpDir, "generator")
+	otherDir := filepath.Join(tmpDir, "system")
+	if err := os.MkdirAll(genDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	applyCfg := &ApplyConfig{CommonConfig: CommonConfig{RunDir: filepath.Join(tmpDir, "run")}}
+	if err := os.MkdirAll(applyCfg.RunDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing applied yet
+	if err := RestoreGeneratedUnits(applyCfg, genDir); err != nil {
+		t.Fatal(err)
+	}
+
+	status := ApplyStatusV0{
+		StartTime: time.Now(),
+		Images: []ImageStatusV0{
+			{
+				Name:      "foo",
+				ImageRoot: root,
+				Success:   true,
+				Assets: []AssetEntry{
+					{Type: "units", Kind: JournalDir, Target: genDir},
+					{Type: "units", Kind: assetTemplate, Source: filepath.Join(unitsSrc, "foo.service"), Target: filepath.Join(genDir, "foo.service")},
+					{Type: "units", Kind: JournalDir, Target: filepath.Join(genDir, "multi-user.target.wants")},
+					{Type: "units", Kind: JournalSymlink, Target: filepath.Join(genDir, "multi-user.target.wants", "foo.service"), LinkDest: "../foo.service"},
+					{Type: "units", Kind: JournalFile, Source: filepath.Join(unitsSrc, "foo.service"), Target: filepath.Join(otherDir, "foo.service")},
+				},
+			},
+			{
+				Name:    "bar",
+				Success: false,
+				Assets: []AssetEntry{
+					{Type: "units", Kind: JournalFile, Source: filepath.Join(unitsSrc, "foo.service"), Target: filepath.Join(genDir, "bar.service")},
+				},
+			},
+		},
+	}
+	if err := writeApplyStatus(applyCfg.RunStatus(), status); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RestoreGeneratedUnits(applyCfg, genDir); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(genDir, "foo.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "ExecStart=" + root + "/bin/foo\n"; string(b) != expected {
+		t.Errorf("expected %q, got %q", expected, string(b))
+	}
+	dest, err := os.Readlink(filepath.Join(genDir, "multi-user.target.wants", "foo.service"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dest != "../foo.service" {
+		t.Errorf("expected link to %q, got %q", "../foo.service", dest)
+	}
+	for _, path := range []string{filepath.Join(otherDir, "foo.service"), filepath.Join(genDir, "bar.service")} {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %q not to be restored, got %v", path, err)
+		}
+	}
+}
@@ -30,7 +30,6 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
-	"time"
 
 	"github.com/euank/gotmpl"
 	"github.com/northbright/ctx/ctxcopy"
@@ -120,8 +119,14 @@ func (r *Remote) loadKeyrings(baseDir string) ([]openpgp.KeyRing, error) {
 		return nil, errors.New("empty remote URL template")
 	}
 
+	return loadArmoredKeyrings(baseDir, r.ArmoredKeys)
+}
+
+// loadArmoredKeyrings loads ASCII-armored keyrings from `paths`,
+// relative to `baseDir`.
+func loadArmoredKeyrings(baseDir string, paths []string) ([]openpgp.KeyRing, error) {
 	keyrings := []openpgp.KeyRing{}
-	for _, k := range r.ArmoredKeys {
+	for _, k := range paths {
 		path := filepath.Join(baseDir, k)
 		fp, err := os.Open(path)
 		if err != nil {
@@ -182,15 +187,24 @@ type RemotesCache struct {
 	Contents      map[string]RemoteContents
 	Paths         map[string]string
 	UsrMountpoint string
+	// Retry selects how failed fetches are retried
+	Retry RetryPolicy
+	// SignaturePolicy selects whether archive signatures must be fetched
+	SignaturePolicy SignaturePolicy
+	// Manifests holds the contents manifests as fetched, signature included
+	Manifests map[string]string
 }
 
-// NewRemotesCache constructs a new RemotesCache
-func NewRemotesCache(ctx context.Context, usrMountpoint string, baseDirs []string, remotesFilter []string) (*RemotesCache, error) {
+// NewRemotesCache constructs a new RemotesCache, fetching remote manifests
+// with the given retry policy.
+func NewRemotesCache(ctx context.Context, usrMountpoint string, baseDirs []string, remotesFilter []string, retry RetryPolicy) (*RemotesCache, error) {
 	rc := RemotesCache{
 		Configs:       map[string]Remote{},
 		Contents:      map[string]RemoteContents{},
+		Manifests:     map[string]string{},
 		Paths:         map[string]string{},
 		UsrMountpoint: usrMountpoint,
+		Retry:         retry,
 	}
 
 	// Process all remote base directories and cache all remotes found.
@@ -231,50 +245,29 @@ func NewRemotesCache(ctx context.Context, usrMountpoint string, baseDirs []strin
 
 	// Download and verify remote manifests.
 	for name, path := range rc.Paths {
-		fp, err := os.Open(path)
+		remote, keyrings, err := loadRemote(name, path)
 		if err != nil {
 			return nil, err
 		}
-		defer fp.Close()
-		bufrd := bufio.NewReader(fp)
-		var jm RemoteManifestV0JSON
-		if err := json.NewDecoder(bufrd).Decode(&jm); err != nil {
-			return nil, errors.Wrapf(err, "failed to decode %s", name)
-		}
-		if jm.Kind != RemoteManifestV0K {
-			return nil, errors.Errorf("invalid manifest kind: %s", jm.Kind)
-		}
-		remote := RemoteFromJSONV0(jm.Value)
-		rc.Configs[name] = remote
+		rc.Configs[name] = *remote
 		url, err := remote.contentsURL(rc.UsrMountpoint)
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to evaluate URL for %s", name)
 		}
-		keyrings, err := remote.loadKeyrings(filepath.Dir(path))
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to load keyrings for %s", name)
-		}
 		var manifest string
 		switch url.Scheme {
 		case "https", "http":
-			tries := 0
-			for {
-				tries++
-				tmpManifest, err := fetchManifest(ctx, url.String())
-				ctxErr := ctx.Err()
-				if err == nil && ctxErr == nil {
-					manifest = tmpManifest
-					break
-				}
-				if ctxErr != nil {
-					return nil, ctxErr
-				}
-				logrus.WithFields(logrus.Fields{
-					"attempt": tries,
-					"name":    name,
-					"error":   err,
-				}).Error("failed to fetch contents manifest")
-				time.Sleep(8 * time.Second)
+			logFields := logrus.Fields{
+				"name": name,
+				"url":  url,
+			}
+			err := rc.Retry.retry(ctx, logFields, func() error {
+				var err error
+				manifest, err = fetchManifest(ctx, url.String())
+				return err
+			})
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to fetch contents manifest for %s", name)
 			}
 		case "file":
 			path := strings.TrimPrefix(url.String(), "file://")
@@ -296,6 +289,7 @@ func NewRemotesCache(ctx context.Context, usrMountpoint string, baseDirs []strin
 			return nil, errors.Wrapf(err, "failed to decode contents for %s", name)
 		}
 		rc.Contents[name] = *contents
+		rc.Manifests[name] = manifest
 
 		logrus.WithFields(logrus.Fields{
 			"name": name,
@@ -312,38 +306,76 @@ func NewRemotesCache(ctx context.Context, usrMountpoint string, baseDirs []strin
 	return &rc, nil
 }
 
+// loadRemote decodes the manifest at `path` for the remote `name`,
+// along with its keyrings.
+func loadRemote(name string, path string) (*Remote, []openpgp.KeyRing, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer fp.Close()
+	bufrd := bufio.NewReader(fp)
+	var jm RemoteManifestV0JSON
+	if err := json.NewDecoder(bufrd).Decode(&jm); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to decode %s", name)
+	}
+	if jm.Kind != RemoteManifestV0K {
+		return nil, nil, errors.Errorf("invalid manifest kind: %s", jm.Kind)
+	}
+	remote := RemoteFromJSONV0(jm.Value)
+	keyrings, err := remote.loadKeyrings(filepath.Dir(path))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to load keyrings for %s", name)
+	}
+	return &remote, keyrings, nil
+}
+
+// remoteManifestPath returns the path of the manifest for the remote
+// `name`, as found in `baseDirs` (later ones taking precedence), or an
+// empty string if there is none.
+func remoteManifestPath(baseDirs []string, name string) string {
+	found := ""
+	for _, dir := range baseDirs {
+		path := filepath.Join(dir, name, "remote.json")
+		if _, err := os.Stat(path); err == nil {
+			found = path
+		}
+	}
+	return found
+}
+
 // CheckAvailable checks if a given Image is available in the configured remote.
 // On success, it returns the full evaluated base URL for the remote and
-// the relative image location.
-func (rc *RemotesCache) CheckAvailable(im Image) (*url.URL, *url.URL, string, error) {
+// the relative image location, with its remote metadata.
+func (rc *RemotesCache) CheckAvailable(im Image) (*url.URL, *url.URL, RemoteVersion, error) {
 	if im.Remote == "" {
-		return nil, nil, "", nil
+		return nil, nil, RemoteVersion{}, nil
 	}
 	if rc == nil {
-		return nil, nil, "", errors.New("nil RemotesCache")
+		return nil, nil, RemoteVersion{}, errors.New("nil RemotesCache")
 	}
 
 	contents, ok := rc.Contents[im.Remote]
 	if !ok {
-		return nil, nil, "", errors.Errorf("manifest for remote %s not found: %s", im.Remote, rc)
+		return nil, nil, RemoteVersion{}, errors.Errorf("manifest for remote %s not found: %v", im.Remote, rc)
 	}
 	config, ok := rc.Configs[im.Remote]
 	if !ok {
-		return nil, nil, "", errors.Errorf("manifest for remote %s not found: %s", im.Remote, rc)
+		return nil, nil, RemoteVersion{}, errors.Errorf("manifest for remote %s not found: %v", im.Remote, rc)
 	}
 	baseURL, err := config.evaluateURL(rc.UsrMountpoint)
 	if err != nil {
-		return nil, nil, "", errors.Wrapf(err, "failed to evaluate URL for %s", im.Remote)
+		return nil, nil, RemoteVersion{}, errors.Wrapf(err, "failed to evaluate URL for %s", im.Remote)
 	}
-	location, hash, err := contents.CheckAvailable(im)
+	location, version, err := contents.CheckAvailable(im)
 	if err != nil {
-		return nil, nil, "", errors.Wrapf(err, "inspecting remote %s", im.Remote)
+		return nil, nil, RemoteVersion{}, errors.Wrapf(err, "inspecting remote %s", im.Remote)
 	}
 	if location == nil {
-		return nil, nil, "", nil
+		return nil, nil, RemoteVersion{}, nil
 	}
 
-	return baseURL, location, hash, nil
+	return baseURL, location, version, nil
 }
 
 func verifyManifest(manifestName string, manifest string, keyrings []openpgp.KeyRing) (string, error) {
@@ -389,7 +421,7 @@ func fetchManifest(ctx context.Context, urlRaw string) (string, error) {
 	var manifest bytes.Buffer
 	req, err := http.NewRequest("GET", urlRaw, nil)
 	if err != nil {
-		return "", err
+		return "", permanent(err)
 	}
 
 	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
@@ -397,6 +429,9 @@ func fetchManifest(ctx context.Context, urlRaw string) (string, error) {
 		return "", err
 	}
 	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return "", err
+	}
 	buf := make([]byte, 32*1024)
 	if err := ctxcopy.Copy(ctx, &manifest, resp.Body, buf); err != nil {
 		return "", err
@@ -428,18 +463,18 @@ func decodeContents(manifest string) (*RemoteContents, error) {
 }
 
 // CheckAvailable checks if a given Image is available in the configured remote.
-// On success, it returns its location (anchored at `base_url`).
-func (rcs *RemoteContents) CheckAvailable(im Image) (*url.URL, string, error) {
+// On success, it returns its location (anchored at `base_url`) and remote metadata.
+func (rcs *RemoteContents) CheckAvailable(im Image) (*url.URL, RemoteVersion, error) {
 	if im.Remote == "" {
-		return nil, "", nil
+		return nil, RemoteVersion{}, nil
 	}
 	if rcs == nil {
-		return nil, "", errors.New("nil RemoteContents")
+		return nil, RemoteVersion{}, errors.New("nil RemoteContents")
 	}
 
 	ri, ok := rcs.Images[im.Name]
 	if !ok {
-		return nil, "", errors.Errorf("image %s not found", im.Name)
+		return nil, RemoteVersion{}, errors.Errorf("image %s not found", im.Name)
 	}
 	targetVersion := im.Reference
 	if targetVersion == DefaultTagRef {
@@ -448,7 +483,7 @@ func (rcs *RemoteContents) CheckAvailable(im Image) (*url.URL, string, error) {
 	for _, vers := range ri.versions {
 		if vers.version == targetVersion {
 			if vers.location == "" {
-				return nil, "", errEmptyLocation
+				return nil, RemoteVersion{}, errEmptyLocation
 			}
 			path := vers.location
 			if !strings.Contains(path, "://") {
@@ -456,13 +491,13 @@ func (rcs *RemoteContents) CheckAvailable(im Image) (*url.URL, string, error) {
 			}
 			location, err := url.Parse(path)
 			if err != nil {
-				return nil, "", err
+				return nil, RemoteVersion{}, err
 			}
-			return location, vers.hash, nil
+			return location, vers, nil
 		}
 	}
 
-	return nil, "", errors.Errorf("image %s:%s not found", im.Name, im.Reference)
+	return nil, RemoteVersion{}, errors.Errorf("image %s:%s not found", im.Name, im.Reference)
 }
 
 // FetchImage checks and fetch an image archive if available on a known remote.
@@ -470,7 +505,7 @@ func (rc *RemotesCache) FetchImage(ctx context.Context, im Image, versionedStore
 	if rc == nil {
 		return errNilRemotesCache
 	}
-	baseURL, location, hash, err := rc.CheckAvailable(im)
+	baseURL, location, version, err := rc.CheckAvailable(im)
 	if err != nil {
 		return err
 	}
@@ -482,36 +517,33 @@ func (rc *RemotesCache) FetchImage(ctx context.Context, im Image, versionedStore
 	case "file":
 		return nil
 	case "https", "http":
-		tries := 0
-		for {
-			tries++
-			err := rc.downloadArchive(ctx, baseURL, location, versionedStorePath, hash)
-			ctxErr := ctx.Err()
-			if err == nil && ctxErr == nil {
-				return nil
-			}
-			if ctxErr != nil {
-				return ctxErr
-			}
-			logrus.WithFields(logrus.Fields{
-				"attempt":   tries,
-				"name":      im.Name,
-				"reference": im.Reference,
-				"remote":    im.Remote,
-				"error":     err,
-			}).Error("failed to fetch")
-			time.Sleep(8 * time.Second)
+		logFields := logrus.Fields{
+			"name":      im.Name,
+			"reference": im.Reference,
+			"remote":    im.Remote,
 		}
+		err := rc.Retry.retry(ctx, logFields, func() error {
+			return rc.downloadArchive(ctx, baseURL, location, versionedStorePath, im.Remote, version)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to fetch %s:%s", im.Name, im.Reference)
+		}
+		return nil
 	default:
 		return errors.Errorf("unsupported scheme while trying to fetch %s", baseURL.String())
 	}
 }
 
 // downloadArchive downloads an image archive from a remote.
-func (rc *RemotesCache) downloadArchive(ctx context.Context, baseURL *url.URL, location *url.URL, baseDir string, hash string) error {
+// Errors which would not go away by downloading again are permanent.
+func (rc *RemotesCache) downloadArchive(ctx context.Context, baseURL *url.URL, location *url.URL, baseDir string, remote string, version RemoteVersion) error {
+	hash := version.hash
 	fileName := path.Base(location.String())
-	if !strings.HasSuffix(fileName, ".torcx.tgz") && !strings.HasSuffix(fileName, ".torcx.squashfs") {
-		return errors.Errorf("invalid extension for image archive %s", fileName)
+	switch ArchiveFormatFor(fileName) {
+	case ArchiveFormatUnknown:
+		return permanent(errors.Errorf("invalid extension for image archive %s", fileName))
+	case ArchiveFormatOCI:
+		return permanent(errors.Errorf("cannot fetch OCI layout directory %s, use an oci-archive", fileName))
 	}
 	targetPath := filepath.Join(baseDir, fileName)
 	tmpFile, err := ioutil.TempFile(baseDir, ".fetchimg")
@@ -530,7 +562,7 @@ func (rc *RemotesCache) downloadArchive(ctx context.Context, baseURL *url.URL, l
 	}).Info("downloading image archive from remote")
 	req, err := http.NewRequest("GET", fullURL.String(), nil)
 	if err != nil {
-		return err
+		return permanent(err)
 	}
 
 	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
@@ -538,6 +570,9 @@ func (rc *RemotesCache) downloadArchive(ctx context.Context, baseURL *url.URL, l
 		return err
 	}
 	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
 	buf := make([]byte, 32*1024)
 	if err := ctxcopy.Copy(ctx, bufwr, resp.Body, buf); err != nil {
 		return err
@@ -552,14 +587,38 @@ func (rc *RemotesCache) downloadArchive(ctx context.Context, baseURL *url.URL, l
 		return errors.Wrapf(err, "failed to chmod %s", tmpName)
 	}
 
+	var d digest.Digest
 	if hash != "" {
 		valid, err := validateHash(tmpName, hash)
 		if err != nil {
-			return errors.Wrapf(err, "failed to validate %s", targetPath)
+			return permanent(errors.Wrapf(err, "failed to validate %s", targetPath))
 		}
 		if !valid {
-			return errors.Errorf("mismatching hash for %s", targetPath)
+			return permanent(errors.Errorf("mismatching hash for %s", targetPath))
 		}
+		d, _ = parseHash(hash)
+	} else if d, _, err = archiveDigest(tmpName); err != nil {
+		return errors.Wrapf(err, "failed to hash %s", targetPath)
+	}
+
+	// Record the digest first, so that the archive is verified at apply time
+	if err := WriteArchiveDigest(targetPath, d); err != nil {
+		return err
+	}
+	sig, err := rc.fetchSignature(ctx, fullURL)
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch signature for %s", targetPath)
+	}
+	if err := writeSignature(targetPath, sig); err != nil {
+		return err
+	}
+	// Keep the root hash under the signature of the contents it came from
+	contents := ""
+	if version.verityRootHash != "" {
+		contents = rc.Manifests[remote]
+	}
+	if err := writeRemoteContents(targetPath, contents); err != nil {
+		return err
 	}
 	if err := os.Rename(tmpName, targetPath); err != nil {
 		return errors.Wrapf(err, "failed to save %s", targetPath)
@@ -571,13 +630,68 @@ func (rc *RemotesCache) downloadArchive(ctx context.Context, baseURL *url.URL, l
 	return nil
 }
 
+// fetchSignature downloads the optional detached signature for the
+// archive at `archiveURL`, returning nil if the remote does not provide one.
+// Failed downloads are retried. Once retries are exhausted, the archive is
+// kept unsigned unless the signature policy is `require`.
+func (rc *RemotesCache) fetchSignature(ctx context.Context, archiveURL *url.URL) ([]byte, error) {
+	sigURL := archiveURL.String() + ArchiveSignatureSuffix
+	logFields := logrus.Fields{
+		"url": sigURL,
+	}
+
+	var sig []byte
+	err := rc.Retry.retry(ctx, logFields, func() error {
+		var err error
+		sig, err = downloadSignature(ctx, sigURL)
+		return err
+	})
+	if err != nil {
+		if rc.SignaturePolicy == SignaturePolicyRequire {
+			// Already retried, do not download the archive again
+			return nil, permanent(err)
+		}
+		logrus.WithFields(logFields).Warn("failed to fetch signature, keeping image archive unsigned: ", err)
+		return nil, nil
+	}
+	return sig, nil
+}
+
+// downloadSignature downloads the detached signature at `sigURL`,
+// returning nil if there is none.
+func downloadSignature(ctx context.Context, sigURL string) ([]byte, error) {
+	req, err := http.NewRequest("GET", sigURL, nil)
+	if err != nil {
+		return nil, permanent(err)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		logrus.WithField("url", sigURL).Debug("no signature for image archive")
+		return nil, nil
+	}
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	var sig bytes.Buffer
+	buf := make([]byte, 32*1024)
+	if err := ctxcopy.Copy(ctx, &sig, resp.Body, buf); err != nil {
+		return nil, err
+	}
+	return sig.Bytes(), nil
+}
+
 func validateHash(path string, hash string) (bool, error) {
 	fp, err := os.Open(path)
 	if err != nil {
 		return false, err
 	}
 	defer fp.Close()
-	d, err := digest.Parse(strings.Replace(hash, "-", ":", 1))
+	d, err := parseHash(hash)
 	if err != nil {
 		return false, errors.Wrap(err, "could not understand package hash")
 	}
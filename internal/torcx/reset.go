@@ -0,0 +1,101 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// ResetSystemState undoes an applied torcx state, as the inverse of
+// ApplyProfile and SealSystemState. All changes recorded in the apply
+// journal are reverted, most recent first, then the unpack directory is
+// unmounted and the run directory and seal files are removed.
+// It also cleans up after a partially failed apply. On failure, entries
+// which could not be reverted are kept in the journal, so that reset can
+// be retried.
+func ResetSystemState(commonCfg *CommonConfig) error {
+	if commonCfg == nil {
+		return errors.New("missing common configuration")
+	}
+
+	unpackDir := commonCfg.RunUnpackDir()
+	unpackMounted, err := isMountpoint(unpackDir)
+	if err != nil {
+		return err
+	}
+	// Sealing remounts the unpack directory read-only
+	if unpackMounted {
+		if err := unix.Mount(unpackDir, unpackDir, "", unix.MS_REMOUNT, ""); err != nil {
+			return errors.Wrap(err, "failed to remount read-write")
+		}
+	}
+
+	journal, err := openApplyJournal(commonCfg.RunJournal())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "reading apply journal")
+	}
+	if journal != nil {
+		if err := journal.rollbackAll(); err != nil {
+			return errors.Wrap(err, "reverting apply journal")
+		}
+		logrus.WithField("path", commonCfg.RunJournal()).Debug("apply journal reverted")
+	}
+
+	if unpackMounted {
+		if err := unix.Unmount(unpackDir, 0); err != nil {
+			return errors.Wrapf(err, "unmounting %q", unpackDir)
+		}
+		logrus.WithField("target", unpackDir).Debug("unmounted tmpfs")
+	}
+
+	paths := []string{
+		commonCfg.RunBinDir(),
+		commonCfg.RunDir,
+		commonCfg.SealFilePath(),
+		commonCfg.SealJSONFilePath(),
+	}
+	for _, path := range paths {
+		if err := os.RemoveAll(path); err != nil {
+			return errors.Wrapf(err, "removing %q", path)
+		}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"run dir":   commonCfg.RunDir,
+		"seal file": commonCfg.SealFilePath(),
+	}).Debug("system state reset")
+	return nil
+}
+
+// isMountpoint checks whether `path` is the root of a filesystem other
+// than the one of its parent directory. Bind mounts are not detected.
+func isMountpoint(path string) (bool, error) {
+	var st, parentSt unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		if err == unix.ENOENT {
+			return false, nil
+		}
+		return false, errors.Wrapf(err, "checking %q", path)
+	}
+	if err := unix.Lstat(filepath.Dir(path), &parentSt); err != nil {
+		return false, errors.Wrapf(err, "checking %q", filepath.Dir(path))
+	}
+	return st.Dev != parentSt.Dev, nil
+}
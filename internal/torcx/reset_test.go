@@ -0,0 +1,93 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResetSystemState(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "torcx_reset_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	commonCfg := &CommonConfig{
+		RunDir: filepath.Join(tmpDir, "run", "torcx"),
+		Root:   tmpDir,
+	}
+	unitsDir := filepath.Join(tmpDir, "run", "systemd", "system")
+	for _, dir := range []string{commonCfg.RunBinDir(), commonCfg.RunUnpackDir(), filepath.Dir(commonCfg.SealFilePath()), unitsDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, path := range []string{commonCfg.SealFilePath(), commonCfg.SealJSONFilePath()} {
+		if err := ioutil.WriteFile(path, []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing applied yet
+	if err := ResetSystemState(commonCfg); err != nil {
+		t.Fatal(err)
+	}
+	if IsExistingPath(commonCfg.RunDir) || IsExistingPath(commonCfg.SealFilePath()) {
+		t.Fatal("expected run directory and seal file to be removed")
+	}
+
+	if err := os.MkdirAll(commonCfg.RunBinDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A unit not created by torcx
+	localUnit := filepath.Join(unitsDir, "local.service")
+	if err := ioutil.WriteFile(localUnit, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := newApplyJournal(commonCfg.RunJournal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx := journal.begin("foo")
+	wantsDir := filepath.Join(unitsDir, "multi-user.target.wants")
+	ops := []assetOp{
+		{Kind: JournalFile, Source: localUnit, Target: filepath.Join(unitsDir, "foo.service")},
+		{Kind: JournalDir, Target: wantsDir},
+		{Kind: JournalSymlink, Target: filepath.Join(wantsDir, "foo.service"), LinkDest: "../foo.service"},
+		{Kind: JournalSymlink, Target: filepath.Join(commonCfg.RunBinDir(), "foo"), LinkDest: "/bin/true"},
+	}
+	if _, err := propagateAssets(tx, ops, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ResetSystemState(commonCfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		if _, err := os.Lstat(op.Target); !os.IsNotExist(err) {
+			t.Errorf("expected %q to be removed, got %v", op.Target, err)
+		}
+	}
+	if _, err := os.Lstat(localUnit); err != nil {
+		t.Errorf("expected %q to be kept: %s", localUnit, err)
+	}
+	if IsExistingPath(commonCfg.RunDir) {
+		t.Errorf("expected %q to be removed", commonCfg.RunDir)
+	}
+}
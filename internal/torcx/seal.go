@@ -0,0 +1,224 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/coreos/torcx/pkg/version"
+)
+
+const (
+	// SealV1K - seal document kind, v1
+	SealV1K = "torcx-seal-v1"
+)
+
+// SealV1JSON holds the JSON seal document (version 1).
+type SealV1JSON struct {
+	Kind  string `json:"kind"`
+	Value SealV1 `json:"value"`
+}
+
+// SealV1 describes the system state sealed after applying a profile.
+type SealV1 struct {
+	TorcxVersion  string        `json:"torcx_version"`
+	ConfigPath    string        `json:"config_path,omitempty"`
+	StorePaths    []string      `json:"store_paths"`
+	LowerProfiles []string      `json:"lower_profiles"`
+	UpperProfile  string        `json:"upper_profile"`
+	ProfilePath   string        `json:"profile_path"`
+	BinDir        string        `json:"bindir"`
+	UnpackDir     string        `json:"unpackdir"`
+	UnitsDir      string        `json:"units_dir,omitempty"`
+	ApplyMode     ApplyMode     `json:"apply_mode"`
+	OverlayTarget string        `json:"overlay_target,omitempty"`
+	Success       bool          `json:"success"`
+	Error         string        `json:"error,omitempty"`
+	Images        []SealImageV1 `json:"images"`
+}
+
+// SealImageV1 describes an applied image in the seal document.
+type SealImageV1 struct {
+	Name      string        `json:"name"`
+	Reference string        `json:"reference"`
+	Archive   string        `json:"archive"`
+	Format    ArchiveFormat `json:"format"`
+	// Digest is the archive digest, if known from its sidecar
+	Digest string `json:"digest,omitempty"`
+}
+
+// envLines returns the seal content in the `KEY="value"` format of the
+// metadata file, usable as a systemd EnvironmentFile.
+func (seal *SealV1) envLines() []string {
+	return []string{
+		envLine(SealLowerProfiles, strings.Join(seal.LowerProfiles, ":")),
+		envLine(SealUpperProfile, seal.UpperProfile),
+		envLine(SealRunProfilePath, seal.ProfilePath),
+		envLine(SealBindir, seal.BinDir),
+		envLine(SealUnpackdir, seal.UnpackDir),
+		envLine(SealApplyError, seal.Error),
+		envLine(SealApplyMode, string(seal.ApplyMode)),
+		envLine(SealOverlayTarget, seal.OverlayTarget),
+	}
+}
+
+func envLine(key, value string) string {
+	return fmt.Sprintf("%s=%q", key, value)
+}
+
+// writeSeal atomically writes a JSON seal document to `path`.
+func writeSeal(path string, seal SealV1) error {
+	doc := SealV1JSON{
+		Kind:  SealV1K,
+		Value: seal,
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".seal")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	defer tmpFile.Close()
+	if _, err := tmpFile.Write(append(b, '\n')); err != nil {
+		return errors.Wrapf(err, "writing %q", path)
+	}
+	if err := tmpFile.Chmod(0644); err != nil {
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// ReadSeal reads the JSON seal document at `path`.
+func ReadSeal(path string) (*SealV1JSON, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var doc SealV1JSON
+	if err := json.NewDecoder(bufio.NewReader(fp)).Decode(&doc); err != nil {
+		return nil, errors.Wrapf(err, "decoding %q", path)
+	}
+	if doc.Kind != SealV1K {
+		return nil, errors.Errorf("unknown seal kind %q", doc.Kind)
+	}
+	return &doc, nil
+}
+
+// CurrentSeal returns the sealed state of the running system. Systems
+// sealed without a JSON document fall back to the metadata file, which
+// does not record the torcx version, config, stores and images.
+func (cc *CommonConfig) CurrentSeal() (*SealV1, error) {
+	doc, err := ReadSeal(cc.SealJSONFilePath())
+	if err == nil {
+		return &doc.Value, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	meta, err := ReadMetadata(cc.SealFilePath())
+	if err != nil {
+		return nil, err
+	}
+	seal := &SealV1{
+		StorePaths:    []string{},
+		LowerProfiles: []string{},
+		UpperProfile:  meta[SealUpperProfile],
+		ProfilePath:   meta[SealRunProfilePath],
+		BinDir:        meta[SealBindir],
+		UnpackDir:     meta[SealUnpackdir],
+		ApplyMode:     ApplyMode(meta[SealApplyMode]),
+		OverlayTarget: meta[SealOverlayTarget],
+		Error:         meta[SealApplyError],
+		Images:        []SealImageV1{},
+	}
+	seal.Success = seal.Error == ""
+	if lower := meta[SealLowerProfiles]; lower != "" {
+		seal.LowerProfiles = strings.Split(lower, ":")
+	}
+	return seal, nil
+}
+
+// newSeal describes the state of the system after applying a profile,
+// including the images listed as applied in the apply status report.
+// Paths are as seen from within the root directory.
+func newSeal(applyCfg *ApplyConfig, applyErr error) SealV1 {
+	seal := SealV1{
+		TorcxVersion:  version.VERSION,
+		ConfigPath:    applyCfg.RootRelative(applyCfg.ConfigPath),
+		StorePaths:    []string{},
+		LowerProfiles: []string{},
+		UpperProfile:  applyCfg.UpperProfile,
+		ProfilePath:   applyCfg.RootRelative(applyCfg.RunProfile()),
+		BinDir:        applyCfg.RootRelative(applyCfg.RunBinDir()),
+		UnpackDir:     applyCfg.RootRelative(applyCfg.RunUnpackDir()),
+		UnitsDir:      applyCfg.RootRelative(applyCfg.Dirs.withDefaults(&applyCfg.CommonConfig).Units),
+		ApplyMode:     applyCfg.ApplyMode,
+		Success:       applyErr == nil,
+		Images:        []SealImageV1{},
+	}
+	for _, path := range applyCfg.StorePaths {
+		seal.StorePaths = append(seal.StorePaths, applyCfg.RootRelative(path))
+	}
+	if len(applyCfg.LowerProfiles) > 0 {
+		seal.LowerProfiles = applyCfg.LowerProfiles
+	}
+	if seal.ApplyMode == "" {
+		seal.ApplyMode = ApplyModeSymlink
+	}
+	if seal.ApplyMode == ApplyModeOverlay {
+		seal.OverlayTarget = applyCfg.overlayTarget()
+	}
+	if applyErr != nil {
+		seal.Error = applyErr.Error()
+	}
+
+	status, err := ReadApplyStatus(applyCfg.RunStatus())
+	if err != nil {
+		logrus.WithField("path", applyCfg.RunStatus()).Warn("no applied images to seal: ", err)
+		return seal
+	}
+	for _, im := range status.Value.Images {
+		if !im.Success {
+			continue
+		}
+		seal.Images = append(seal.Images, SealImageV1{
+			Name:      im.Name,
+			Reference: im.Reference,
+			Archive:   applyCfg.RootRelative(im.Archive),
+			Format:    im.Format,
+			Digest:    im.Digest,
+		})
+	}
+	return seal
+}
@@ -0,0 +1,168 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCurrentSeal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_test_seal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cc := &CommonConfig{Root: dir}
+	if err := os.MkdirAll(filepath.Dir(cc.SealFilePath()), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	seal := SealV1{
+		TorcxVersion:  "v1.0.0",
+		StorePaths:    []string{"/var/lib/torcx/store"},
+		LowerProfiles: []string{"vendor", "oem"},
+		UpperProfile:  "user",
+		ProfilePath:   "/run/torcx/profile.json",
+		BinDir:        "/run/torcx/bin",
+		UnpackDir:     "/run/torcx/unpack",
+		UnitsDir:      "/run/systemd/generator",
+		ApplyMode:     ApplyModeSymlink,
+		Success:       true,
+		Images: []SealImageV1{
+			{Name: "docker", Reference: "17.03", Archive: "/var/lib/torcx/store/docker:17.03.torcx.tgz", Format: ArchiveFormatTgz, Digest: "sha512-0123"},
+		},
+	}
+	env := strings.Join(seal.envLines(), "\n") + "\n"
+	if err := ioutil.WriteFile(cc.SealFilePath(), []byte(env), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Metadata file only
+	legacy, err := cc.CurrentSeal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy.UpperProfile != "user" || !reflect.DeepEqual(legacy.LowerProfiles, seal.LowerProfiles) || legacy.ProfilePath != seal.ProfilePath || !legacy.Success {
+		t.Errorf("unexpected seal from metadata: %+v", legacy)
+	}
+
+	if err := writeSeal(cc.SealJSONFilePath(), seal); err != nil {
+		t.Fatal(err)
+	}
+	current, err := cc.CurrentSeal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*current, seal) {
+		t.Errorf("expected %+v, got %+v", seal, *current)
+	}
+
+	upper, lower, err := cc.CurrentProfileNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upper != "user" || !reflect.DeepEqual(lower, seal.LowerProfiles) {
+		t.Errorf("unexpected profile names %q, %q", upper, lower)
+	}
+}
+
+func TestRootRelativePaths(t *testing.T) {
+	root, err := ioutil.TempDir("", "torcx_test_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	applyCfg := &ApplyConfig{
+		CommonConfig: CommonConfig{
+			Root:       root,
+			RunDir:     filepath.Join(root, "run", "torcx"),
+			ConfigPath: filepath.Join(root, "etc", "torcx", "config.json"),
+			StorePaths: []string{filepath.Join(root, "var", "lib", "torcx", "store"), "/outside/store"},
+			ApplyMode:  ApplyModeOverlay,
+		},
+	}
+
+	// Host paths are used for I/O
+	imageRoot := filepath.Join(applyCfg.RunUnpackDir(), "foo")
+	for _, dir := range []string{filepath.Join(imageRoot, ".torcx"), filepath.Join(imageRoot, "bin")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	manifest := `{"kind": "image-manifest-v0", "value": {"bin": ["/bin/foo"]}}`
+	if err := ioutil.WriteFile(filepath.Join(imageRoot, ".torcx", "manifest.json"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(imageRoot, "bin", "foo"), []byte("#!"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	status := ApplyStatusV0{
+		Images: []ImageStatusV0{
+			{Name: "foo", Reference: "1", Archive: filepath.Join(root, "var", "lib", "torcx", "store", "foo:1.torcx.tgz"), Success: true},
+		},
+	}
+	if err := writeApplyStatus(applyCfg.RunStatus(), status); err != nil {
+		t.Fatal(err)
+	}
+
+	// Persisted paths are as seen from within the root
+	pi, err := planImageManifest(applyCfg, hostFS{}, "foo", imageRoot, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binOp := pi.groups[0].ops[0]
+	if binOp.Target != filepath.Join(root, "run", "torcx", "bin", "foo") {
+		t.Errorf("unexpected binary target %q", binOp.Target)
+	}
+	if binOp.LinkDest != "/run/torcx/unpack/foo/bin/foo" {
+		t.Errorf("unexpected binary link destination %q", binOp.LinkDest)
+	}
+
+	expVars := map[string]string{
+		SealBindir:        "/run/torcx/bin",
+		SealUnpackdir:     "/run/torcx/unpack",
+		TemplateImageRoot: "/run/torcx/unpack/foo",
+	}
+	if vars := templateVars(applyCfg, imageRoot); !reflect.DeepEqual(vars, expVars) {
+		t.Errorf("expected template variables %v, got %v", expVars, vars)
+	}
+
+	seal := newSeal(applyCfg, nil)
+	expSeal := SealV1{
+		ConfigPath:    "/etc/torcx/config.json",
+		StorePaths:    []string{"/var/lib/torcx/store", "/outside/store"},
+		LowerProfiles: []string{},
+		ProfilePath:   "/run/torcx/profile.json",
+		BinDir:        "/run/torcx/bin",
+		UnpackDir:     "/run/torcx/unpack",
+		UnitsDir:      "/run/systemd/system",
+		ApplyMode:     ApplyModeOverlay,
+		OverlayTarget: "/usr",
+		Success:       true,
+		Images: []SealImageV1{
+			{Name: "foo", Reference: "1", Archive: "/var/lib/torcx/store/foo:1.torcx.tgz"},
+		},
+	}
+	seal.TorcxVersion = ""
+	if !reflect.DeepEqual(seal, expSeal) {
+		t.Errorf("expected %+v, got %+v", expSeal, seal)
+	}
+}
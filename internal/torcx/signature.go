@@ -0,0 +1,209 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+// SignaturePolicy selects whether unsigned archives are accepted.
+type SignaturePolicy string
+
+const (
+	// SignaturePolicyVerify checks signatures when present, accepting unsigned archives
+	SignaturePolicyVerify SignaturePolicy = "verify"
+	// SignaturePolicyRequire refuses archives without a valid signature
+	SignaturePolicyRequire SignaturePolicy = "require"
+
+	// ArchiveSignatureSuffix is the file suffix of detached signatures,
+	// stored next to image archives in the store.
+	ArchiveSignatureSuffix = ".asc"
+	// storeTrustFile is the name of store trust manifests
+	storeTrustFile = "trust.json"
+)
+
+// Validate checks that the policy is a known one. An empty policy
+// stands for the default one (verify).
+func (sp SignaturePolicy) Validate() error {
+	switch sp {
+	case "", SignaturePolicyVerify, SignaturePolicyRequire:
+		return nil
+	}
+	return errors.Errorf("unknown signature policy %q, must be one of %q, %q",
+		sp, SignaturePolicyVerify, SignaturePolicyRequire)
+}
+
+// SignaturePath returns the path of the detached signature for an archive.
+func SignaturePath(archivePath string) string {
+	return archivePath + ArchiveSignatureSuffix
+}
+
+// writeSignature atomically writes the detached signature `sig` for the
+// archive at `archivePath`. An empty signature removes any stale one.
+func writeSignature(archivePath string, sig []byte) error {
+	sigPath := SignaturePath(archivePath)
+	if len(sig) == 0 {
+		if err := os.Remove(sigPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(archivePath), ".signature")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+	defer os.Remove(tmpName)
+	defer tmpFile.Close()
+	if _, err := tmpFile.Write(sig); err != nil {
+		return errors.Wrapf(err, "failed to write %s", tmpName)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return errors.Wrapf(err, "failed to close %s", tmpName)
+	}
+	if err := os.Chmod(tmpName, 0644); err != nil {
+		return errors.Wrapf(err, "failed to chmod %s", tmpName)
+	}
+	if err := os.Rename(tmpName, sigPath); err != nil {
+		return errors.Wrapf(err, "failed to save %s", sigPath)
+	}
+	return nil
+}
+
+// StoreTrust holds keys trusted to sign archives in local stores,
+// and the policy for unsigned ones.
+type StoreTrust struct {
+	Policy   SignaturePolicy
+	Keyrings []openpgp.KeyRing
+}
+
+// LoadStoreTrust loads keyrings from all store trust manifests found
+// in `cc.TrustDirs()`.
+func LoadStoreTrust(cc *CommonConfig) (*StoreTrust, error) {
+	if cc == nil {
+		return nil, errors.New("nil common config")
+	}
+	st := StoreTrust{
+		Policy:   cc.SignaturePolicy,
+		Keyrings: []openpgp.KeyRing{},
+	}
+
+	for _, dir := range cc.TrustDirs() {
+		path := filepath.Join(dir, storeTrustFile)
+		manifest, err := readStoreTrust(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		keys := make([]string, 0, len(manifest.Keys))
+		for _, k := range manifest.Keys {
+			keys = append(keys, k.ArmoredKeyring)
+		}
+		keyrings, err := loadArmoredKeyrings(dir, keys)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load keyrings for %s", path)
+		}
+		st.Keyrings = append(st.Keyrings, keyrings...)
+
+		logrus.WithFields(logrus.Fields{
+			"path": path,
+			"keys": len(keyrings),
+		}).Debug("store trust loaded")
+	}
+
+	return &st, nil
+}
+
+// readStoreTrust reads the store trust manifest at `path`.
+func readStoreTrust(path string) (*StoreTrustV0, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var jm StoreTrustV0JSON
+	if err := json.NewDecoder(bufio.NewReader(fp)).Decode(&jm); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode %s", path)
+	}
+	if jm.Kind != StoreTrustV0K {
+		return nil, errors.Errorf("invalid manifest kind: %s", jm.Kind)
+	}
+	return &jm.Value, nil
+}
+
+// VerifyArchive checks the detached signature of `archive`, returning
+// whether it is signed by a trusted key. Pinned archives are read from
+// the same file they are unpacked from.
+// Unsigned archives are an error with the `require` policy, as are OCI
+// layout directories, which cannot carry a detached signature.
+func (st *StoreTrust) VerifyArchive(archive Archive) (bool, error) {
+	if st == nil {
+		return false, errors.New("nil store trust")
+	}
+	archivePath := archive.Filepath
+	if archive.Format == ArchiveFormatOCI {
+		if st.Policy == SignaturePolicyRequire {
+			return false, errors.Errorf("OCI layout directory %s cannot be signed, use an oci-archive", archivePath)
+		}
+		logrus.WithField("path", archivePath).Debug("archive signature not verified")
+		return false, nil
+	}
+	sigPath := SignaturePath(archivePath)
+	sig, err := os.Open(sigPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil {
+		defer sig.Close()
+	}
+	if err != nil || len(st.Keyrings) == 0 {
+		if st.Policy == SignaturePolicyRequire {
+			if err != nil {
+				return false, errors.Errorf("unsigned archive %s", archivePath)
+			}
+			return false, errors.Errorf("no trusted keys to verify %s", archivePath)
+		}
+		logrus.WithField("path", archivePath).Debug("archive signature not verified")
+		return false, nil
+	}
+
+	for _, kr := range st.Keyrings {
+		if _, err := sig.Seek(0, 0); err != nil {
+			return false, err
+		}
+		fp, err := archive.open()
+		if err != nil {
+			return false, err
+		}
+		_, err = openpgp.CheckArmoredDetachedSignature(kr, bufio.NewReader(fp), sig)
+		fp.Close()
+		if err == nil {
+			return true, nil
+		}
+	}
+	return false, errors.Errorf("invalid signature %s", sigPath)
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestVerifyArchiveSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_test_signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cc := &CommonConfig{
+		UsrDir:  filepath.Join(dir, "usr"),
+		ConfDir: filepath.Join(dir, "etc"),
+		Root:    dir,
+	}
+
+	pgpCfg := &packet.Config{RSABits: 1024}
+	signer, err := openpgp.NewEntity("torcx", "test", "torcx@example.com", pgpCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustDir := filepath.Join(cc.ConfDir, "trust")
+	if err := os.MkdirAll(trustDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var pubkey bytes.Buffer
+	wr, err := armor.Encode(&pubkey, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Serialize(wr); err != nil {
+		t.Fatal(err)
+	}
+	wr.Close()
+	if err := ioutil.WriteFile(filepath.Join(trustDir, "keys.asc"), pubkey.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	manifest := `{"kind": "torcx-store-trust-v0", "value": {"keys": [{"armored_keyring": "keys.asc"}]}}`
+	if err := ioutil.WriteFile(filepath.Join(trustDir, "trust.json"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	signed := filepath.Join(dir, "signed:1.torcx.tgz")
+	unsigned := filepath.Join(dir, "unsigned:1.torcx.tgz")
+	tampered := filepath.Join(dir, "tampered:1.torcx.tgz")
+	for _, p := range []string{signed, unsigned, tampered} {
+		if err := ioutil.WriteFile(p, []byte("archive"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{signed, tampered} {
+		var sig bytes.Buffer
+		if err := openpgp.ArmoredDetachSign(&sig, signer, bytes.NewReader([]byte("archive")), pgpCfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeSignature(p, sig.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(tampered, []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	layout := filepath.Join(dir, "layout:1.torcx.oci")
+	if err := os.Mkdir(layout, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		policy  SignaturePolicy
+		path    string
+		signed  bool
+		isError bool
+	}{
+		{SignaturePolicyVerify, signed, true, false},
+		{SignaturePolicyVerify, unsigned, false, false},
+		{SignaturePolicyVerify, tampered, false, true},
+		{SignaturePolicyRequire, signed, true, false},
+		{SignaturePolicyRequire, unsigned, false, true},
+		{SignaturePolicyRequire, tampered, false, true},
+		{SignaturePolicyVerify, layout, false, false},
+		{SignaturePolicyRequire, layout, false, true},
+	}
+
+	for _, tt := range testCases {
+		cc.SignaturePolicy = tt.policy
+		trust, err := LoadStoreTrust(cc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trust.Keyrings) != 1 {
+			t.Fatalf("expected 1 keyring, got %d", len(trust.Keyrings))
+		}
+		archive := Archive{Filepath: tt.path, Format: ArchiveFormatFor(tt.path)}
+		ok, err := trust.VerifyArchive(archive)
+		if (err != nil) != tt.isError {
+			t.Errorf("%s, %s: unexpected error %v", tt.policy, filepath.Base(tt.path), err)
+		}
+		if ok != tt.signed {
+			t.Errorf("%s, %s: expected signed=%t, got %t", tt.policy, filepath.Base(tt.path), tt.signed, ok)
+		}
+	}
+
+	// A pinned archive keeps being read from the same file once replaced
+	trust, err := LoadStoreTrust(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := Archive{Filepath: signed, Format: ArchiveFormatTgz}
+	if err := archive.pin(); err != nil {
+		t.Fatal(err)
+	}
+	defer archive.unpin()
+	if err := os.Rename(tampered, signed); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := trust.VerifyArchive(archive); err != nil || !ok {
+		t.Errorf("pinned archive: expected signed, got %t, %v", ok, err)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ApplyStatusV0K - apply status kind, v0
+	ApplyStatusV0K = "torcx-apply-status-v0"
+)
+
+// ApplyStatusV0JSON holds the JSON apply status report (version 0).
+type ApplyStatusV0JSON struct {
+	Kind  string        `json:"kind"`
+	Value ApplyStatusV0 `json:"value"`
+}
+
+// ApplyStatusV0 reports the outcome of applying a profile.
+type ApplyStatusV0 struct {
+	LowerProfiles []string        `json:"lower_profiles"`
+	UpperProfile  string          `json:"upper_profile"`
+	StartTime     time.Time       `json:"start_time"`
+	EndTime       time.Time       `json:"end_time"`
+	Success       bool            `json:"success"`
+	Error         string          `json:"error,omitempty"`
+	Images        []ImageStatusV0 `json:"images"`
+	// Collisions lists assets shipped by more than one image
+	Collisions []AssetCollision `json:"collisions,omitempty"`
+	// Overlay is the overlay mounted in overlay mode, if any
+	Overlay *OverlayStatus `json:"overlay,omitempty"`
+}
+
+// ImageStatusV0 reports the outcome of applying a single image.
+type ImageStatusV0 struct {
+	Name       string        `json:"name"`
+	Reference  string        `json:"reference"`
+	Remote     string        `json:"remote,omitempty"`
+	Optional   bool          `json:"optional,omitempty"`
+	Archive    string        `json:"archive,omitempty"`
+	Format     ArchiveFormat `json:"format,omitempty"`
+	ImageRoot  string        `json:"image_root,omitempty"`
+	Digest     string        `json:"digest,omitempty"`
+	Verified   bool          `json:"verified,omitempty"`
+	Signed     bool          `json:"signed,omitempty"`
+	Verity     bool          `json:"verity,omitempty"`
+	Cached     bool          `json:"cached,omitempty"`
+	Assets     []AssetEntry  `json:"assets"`
+	StartTime  time.Time     `json:"start_time"`
+	DurationMs int64         `json:"duration_ms"`
+	Success    bool          `json:"success"`
+	RolledBack bool          `json:"rolled_back,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// newImageStatus initializes the status report for an image.
+func newImageStatus(im Image) ImageStatusV0 {
+	return ImageStatusV0{
+		Name:      im.Name,
+		Reference: im.Reference,
+		Remote:    im.Remote,
+		Optional:  im.Optional,
+		Assets:    []AssetEntry{},
+		StartTime: time.Now(),
+	}
+}
+
+// finish marks the end of apply for an image, recording its outcome.
+func (st *ImageStatusV0) finish(err error) {
+	st.DurationMs = int64(time.Since(st.StartTime) / time.Millisecond)
+	st.Success = err == nil
+	if err != nil {
+		st.Error = err.Error()
+	}
+}
+
+// writeApplyStatus writes an apply status report to `path`.
+func writeApplyStatus(path string, status ApplyStatusV0) error {
+	doc := ApplyStatusV0JSON{
+		Kind:  ApplyStatusV0K,
+		Value: status,
+	}
+
+	fp, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	bufwr := bufio.NewWriter(fp)
+	enc := json.NewEncoder(bufwr)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return errors.Wrapf(err, "writing %q", path)
+	}
+	if err := bufwr.Flush(); err != nil {
+		return errors.Wrapf(err, "writing %q", path)
+	}
+	return fp.Close()
+}
+
+// ReadApplyStatus reads the apply status report at `path`.
+func ReadApplyStatus(path string) (*ApplyStatusV0JSON, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	var doc ApplyStatusV0JSON
+	if err := json.NewDecoder(bufio.NewReader(fp)).Decode(&doc); err != nil {
+		return nil, errors.Wrapf(err, "decoding %q", path)
+	}
+	if doc.Kind != ApplyStatusV0K {
+		return nil, errors.Errorf("unknown apply status kind %q", doc.Kind)
+	}
+	return &doc, nil
+}
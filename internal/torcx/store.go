@@ -43,7 +43,8 @@ func NewStoreCache(paths []string) (StoreCache, error) {
 		path := filepath.Clean(filepath.Join(dir, inInfo.Name()))
 		name := filepath.Base(path)
 
-		// Ensure a symlink points to a regular file
+		// Ensure a symlink points to a regular file, or a directory
+		// for OCI image layouts
 		if inInfo.Mode()&os.ModeSymlink != 0 {
 			if lpath, err := filepath.EvalSymlinks(path); err != nil {
 				return nil
@@ -52,17 +53,14 @@ func NewStoreCache(paths []string) (StoreCache, error) {
 			}
 		}
 
-		if !inInfo.Mode().IsRegular() {
+		arFormat := ArchiveFormatFor(name)
+		if arFormat == ArchiveFormatUnknown {
 			return nil
 		}
-		var arFormat ArchiveFormat
-		for _, format := range []ArchiveFormat{ArchiveFormatTgz, ArchiveFormatSquashfs} {
-			if strings.HasSuffix(name, format.FileSuffix()) {
-				arFormat = format
-				break
-			}
+		if arFormat == ArchiveFormatOCI && !inInfo.IsDir() {
+			return nil
 		}
-		if arFormat == ArchiveFormatUnknown {
+		if arFormat != ArchiveFormatOCI && !inInfo.Mode().IsRegular() {
 			return nil
 		}
 		baseName := strings.TrimSuffix(name, arFormat.FileSuffix())
@@ -78,21 +76,21 @@ func NewStoreCache(paths []string) (StoreCache, error) {
 			Name:      imageName,
 			Reference: imageRef,
 		}
-		archive := Archive{image, path, arFormat}
+		archive := Archive{Image: image, Filepath: path, Format: arFormat}
 
-		// The first squashfs archive to define a reference wins, followed by the
-		// first tgz.  Any collisions will result in a warning.
+		// The first squashfs or erofs archive to define a reference wins,
+		// followed by the first tarball.  Any collisions will result in a warning.
 		ar, ok := sc.Images[image]
-		if ok && archive.Format == ArchiveFormatSquashfs && ar.Format != ArchiveFormatSquashfs {
+		if ok && archive.Format.Mountable() && !ar.Format.Mountable() {
 			logrus.WithFields(logrus.Fields{
 				"name":      image.Name,
 				"reference": image.Reference,
 				"original":  ar.Filepath,
 				"format":    ar.Format,
 				"duplicate": path,
-			}).Warn("prefering squashfs for duplicate image")
+			}).Warn("prefering mountable archive for duplicate image")
 		} else if ok {
-			// Duplicate, but not squashfs overriding tgz
+			// Duplicate, but not squashfs or erofs overriding a tarball
 			logrus.WithFields(logrus.Fields{
 				"name":      image.Name,
 				"reference": image.Reference,
@@ -0,0 +1,75 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/ulikunitz/xz"
+
+	pkgtar "github.com/coreos/torcx/pkg/tar"
+)
+
+// decompressTarball returns a reader over the uncompressed tar stream of
+// a tarball archive in the given format.
+func decompressTarball(r io.Reader, format ArchiveFormat) (io.ReadCloser, error) {
+	switch format {
+	case ArchiveFormatTgz:
+		return gzip.NewReader(r)
+	case ArchiveFormatTarZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case ArchiveFormatTarXz:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xr), nil
+	}
+	return nil, errors.Errorf("%q is not a tarball format", format)
+}
+
+// extractArchive unpacks a tarball or an OCI image into `targetDir`.
+func extractArchive(archive Archive, targetDir string) error {
+	if archive.Format == ArchiveFormatOCI || archive.Format == ArchiveFormatOCIArchive {
+		return unpackOCI(archive, targetDir)
+	}
+
+	fp, err := archive.open()
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	dr, err := decompressTarball(fp, archive.Format)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	untarCfg := pkgtar.ExtractCfg{}.Default()
+	if err := pkgtar.Untar(tar.NewReader(dr), targetDir, untarCfg); err != nil {
+		return errors.Wrapf(err, "unpacking %q", archive.Filepath)
+	}
+	return nil
+}
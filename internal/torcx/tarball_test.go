@@ -0,0 +1,100 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+func TestDecompressTarball(t *testing.T) {
+	content := []byte("hello\n")
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	if err := tw.WriteHeader(&tar.Header{Name: "bin/hello", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		format   ArchiveFormat
+		compress func(io.Writer) (io.WriteCloser, error)
+	}{
+		{
+			ArchiveFormatTgz,
+			func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		},
+		{
+			ArchiveFormatTarZstd,
+			func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) },
+		},
+		{
+			ArchiveFormatTarXz,
+			func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) },
+		},
+	}
+
+	for _, tt := range testCases {
+		var buf bytes.Buffer
+		cw, err := tt.compress(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cw.Write(tarBuf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if err := cw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		dr, err := decompressTarball(&buf, tt.format)
+		if err != nil {
+			t.Errorf("%s: %v", tt.format, err)
+			continue
+		}
+		tr := tar.NewReader(dr)
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Errorf("%s: %v", tt.format, err)
+			dr.Close()
+			continue
+		}
+		got, err := ioutil.ReadAll(tr)
+		dr.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.format, err)
+			continue
+		}
+		if hdr.Name != "bin/hello" || !bytes.Equal(got, content) {
+			t.Errorf("%s: unexpected entry %q: %q", tt.format, hdr.Name, got)
+		}
+	}
+
+	if _, err := decompressTarball(&tarBuf, ArchiveFormatSquashfs); err == nil {
+		t.Error("expected failure for a non-tarball format")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// assetTemplate marks a file asset copied with torcx variables expanded
+	assetTemplate = "template"
+
+	// TemplateImageRoot is the template variable for the image root directory
+	TemplateImageRoot = "TORCX_IMAGE_ROOT"
+)
+
+// templateVars returns the variables expanded in templates of the image
+// rooted at `imageRoot`. Values are the same as in the seal file, i.e.
+// paths as seen from within the root directory.
+func templateVars(applyCfg *ApplyConfig, imageRoot string) map[string]string {
+	return map[string]string{
+		SealBindir:        applyCfg.RootRelative(applyCfg.RunBinDir()),
+		SealUnpackdir:     applyCfg.RootRelative(applyCfg.RunUnpackDir()),
+		TemplateImageRoot: applyCfg.RootRelative(imageRoot),
+	}
+}
+
+// markTemplates turns file propagation steps for assets at or below one
+// of the `templates` paths (relative to the image root) into template steps.
+func markTemplates(groups []plannedGroup, imageRoot string, templates []string) {
+	if len(templates) == 0 {
+		return
+	}
+	roots := make([]string, 0, len(templates))
+	for _, t := range templates {
+		if t != "" {
+			roots = append(roots, filepath.Join(imageRoot, t))
+		}
+	}
+
+	for g := range groups {
+		for i := range groups[g].ops {
+			op := &groups[g].ops[i]
+			if op.Kind != JournalFile {
+				continue
+			}
+			for _, root := range roots {
+				if op.Source == root || strings.HasPrefix(op.Source, root+"/") {
+					op.Kind = assetTemplate
+					break
+				}
+			}
+		}
+	}
+}
+
+// expandTemplate replaces all `${NAME}` occurrences of the given variables.
+// Other variables (e.g. for systemd environment) are left untouched.
+func expandTemplate(content string, vars map[string]string) string {
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		pairs = append(pairs, "${"+name+"}", vars[name])
+	}
+	return strings.NewReplacer(pairs...).Replace(content)
+}
+
+// copyTemplate copies a single file from an image to the host,
+// expanding torcx variables.
+func copyTemplate(tx *journalTx, srcPath string, hostPath string, vars map[string]string) error {
+	b, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		return errors.Wrapf(err, "error reading %q", srcPath)
+	}
+	fpDst, err := tx.createFile(hostPath)
+	if err != nil {
+		return err
+	}
+	defer fpDst.Close()
+	if _, err := fpDst.WriteString(expandTemplate(string(b), vars)); err != nil {
+		return errors.Wrapf(err, "error writing %q", hostPath)
+	}
+	return nil
+}
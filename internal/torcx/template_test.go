@@ -0,0 +1,72 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	applyCfg := &ApplyConfig{CommonConfig: CommonConfig{RunDir: "/run/torcx"}}
+	vars := templateVars(applyCfg, "/run/torcx/unpack/foo")
+
+	testCases := []struct {
+		in  string
+		out string
+	}{
+		{
+			"ExecStart=${TORCX_BINDIR}/foo --data ${TORCX_IMAGE_ROOT}/share",
+			"ExecStart=/run/torcx/bin/foo --data /run/torcx/unpack/foo/share",
+		},
+		{
+			"Environment=PATH=${TORCX_UNPACKDIR}/foo/bin:$PATH",
+			"Environment=PATH=/run/torcx/unpack/foo/bin:$PATH",
+		},
+		{
+			"ExecStart=/usr/bin/foo ${OPTIONS} $TORCX_BINDIR",
+			"ExecStart=/usr/bin/foo ${OPTIONS} $TORCX_BINDIR",
+		},
+	}
+
+	for _, tt := range testCases {
+		if out := expandTemplate(tt.in, vars); out != tt.out {
+			t.Errorf("expected %q, got %q", tt.out, out)
+		}
+	}
+}
+
+func TestMarkTemplates(t *testing.T) {
+	root := "/run/torcx/unpack/foo"
+	unitsGroup := assetGroup{kind: "units", dir: "/run/systemd/system"}
+	groups := []plannedGroup{{unitsGroup, []assetOp{
+		{JournalDir, "", "/run/systemd/system", ""},
+		{JournalFile, root + "/lib/systemd/system/foo.service", "/run/systemd/system/foo.service", ""},
+		{JournalFile, root + "/lib/systemd/system/bar.service", "/run/systemd/system/bar.service", ""},
+		{JournalDir, root + "/lib/systemd/system/foo.service.d", "/run/systemd/system/foo.service.d", ""},
+		{JournalFile, root + "/lib/systemd/system/foo.service.d/10-env.conf", "/run/systemd/system/foo.service.d/10-env.conf", ""},
+	}}}
+
+	markTemplates(groups, root, []string{"/lib/systemd/system/foo.service", "/lib/systemd/system/foo.service.d"})
+
+	kinds := []string{}
+	for _, op := range groups[0].ops {
+		kinds = append(kinds, op.Kind)
+	}
+	expKinds := []string{JournalDir, assetTemplate, JournalFile, JournalDir, assetTemplate}
+	if !reflect.DeepEqual(kinds, expKinds) {
+		t.Fatalf("expected %v, got %v", expKinds, kinds)
+	}
+}
@@ -17,6 +17,8 @@ package torcx
 import (
 	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
 )
 
 const (
@@ -30,8 +32,16 @@ const (
 	SealBindir = "TORCX_BINDIR"
 	// SealUnpackdir is the key label for seal unpackdir
 	SealUnpackdir = "TORCX_UNPACKDIR"
+	// SealApplyError is the key label for the apply failure, if any
+	SealApplyError = "TORCX_APPLY_ERROR"
+	// SealApplyMode is the key label for the apply mode
+	SealApplyMode = "TORCX_APPLY_MODE"
+	// SealOverlayTarget is the key label for the directory extended in overlay mode
+	SealOverlayTarget = "TORCX_OVERLAY_TARGET"
 	// ImageManifestV0K - image manifest kind, v0
 	ImageManifestV0K = "image-manifest-v0"
+	// ImageManifestV1K - image manifest kind, v1
+	ImageManifestV1K = "image-manifest-v1"
 	// CommonConfigV0K - common torcx config kind, v0
 	CommonConfigV0K = "torcx-config-v0"
 )
@@ -50,6 +60,29 @@ type CommonConfig struct {
 	UsrDir     string   `json:"usr_dir,omitempty"`
 	ConfDir    string   `json:"conf_dir,omitempty"`
 	StorePaths []string `json:"store_paths,omitempty"`
+	// CollisionPolicy selects how assets shipped by multiple images are handled
+	CollisionPolicy CollisionPolicy `json:"collision_policy,omitempty"`
+	// ApplyMode selects how image contents are exposed on the host
+	ApplyMode ApplyMode `json:"apply_mode,omitempty"`
+	// OverlayTarget is the directory extended in overlay mode
+	OverlayTarget string `json:"overlay_target,omitempty"`
+	// UnpackCache keeps unpacked tarball archives across boots, under BaseDir
+	UnpackCache bool `json:"unpack_cache,omitempty"`
+	// SignaturePolicy selects whether unsigned archives are accepted
+	SignaturePolicy SignaturePolicy `json:"signature_policy,omitempty"`
+	// FetchRetries is how many times a failed fetch from a remote is retried
+	FetchRetries *int `json:"fetch_retries,omitempty"`
+	// FetchBackoff is the delay before the first retry, as a duration string
+	FetchBackoff string `json:"fetch_backoff,omitempty"`
+	// FetchMaxBackoff caps the delay between retries, as a duration string
+	FetchMaxBackoff string `json:"fetch_max_backoff,omitempty"`
+	// FetchTimeout bounds fetching all remote manifests and images, as a duration string
+	FetchTimeout string `json:"fetch_timeout,omitempty"`
+	// Root is an alternate root directory (sysroot), prefixed to all
+	// host paths. It is only set at runtime, never from config files.
+	Root string `json:"-"`
+	// ConfigPath is the config file in use, if any. It is only set at runtime.
+	ConfigPath string `json:"-"`
 }
 
 // ApplyConfig contains runtime configuration items specific to
@@ -58,6 +91,8 @@ type ApplyConfig struct {
 	CommonConfig
 	LowerProfiles []string
 	UpperProfile  string
+	// Dirs are the host directories where assets are propagated
+	Dirs PropagationDirs
 }
 
 // ProfileConfig contains runtime configuration items specific to
@@ -70,11 +105,15 @@ type ProfileConfig struct {
 	NextProfile        string
 }
 
-// Archive represents a .torcx.squashfs or .torcx.tgz on disk
+// Archive represents a .torcx.squashfs, .torcx.erofs, a tarball
+// (.torcx.tgz, .torcx.tar.zst, .torcx.tar.xz) or an OCI image layout
+// (.torcx.oci directory, .torcx.oci-archive) on disk
 type Archive struct {
 	Image
 	Filepath string        `json:"filepath"`
 	Format   ArchiveFormat `json:"format"`
+	// file is the archive file, once pinned
+	file *os.File
 }
 
 // Image represents an addon archive within a profile.
@@ -82,9 +121,13 @@ type Image struct {
 	Name      string `json:"name"`
 	Reference string `json:"reference"`
 	Remote    string `json:"remote"`
+	// Optional images can fail to apply without failing the profile
+	Optional bool `json:"optional,omitempty"`
 }
 
-// ArchiveFormat is a torcx archive format, either 'tgz' or 'squashfs'
+// ArchiveFormat is a torcx archive format, either a filesystem image
+// ('squashfs', 'erofs'), a tarball ('tgz', 'tar.zst', 'tar.xz') or an
+// OCI image layout ('oci', 'oci-archive')
 type ArchiveFormat string
 
 const (
@@ -92,25 +135,44 @@ const (
 	ArchiveFormatUnknown ArchiveFormat = ""
 	// ArchiveFormatTgz indicates a tar-gzipped image
 	ArchiveFormatTgz = "tgz"
+	// ArchiveFormatTarZstd indicates a zstd-compressed tar image
+	ArchiveFormatTarZstd = "tar.zst"
+	// ArchiveFormatTarXz indicates an xz-compressed tar image
+	ArchiveFormatTarXz = "tar.xz"
 	// ArchiveFormatSquashfs indicates a squashfs image archive
 	ArchiveFormatSquashfs = "squashfs"
+	// ArchiveFormatErofs indicates an erofs image archive
+	ArchiveFormatErofs = "erofs"
+	// ArchiveFormatOCI indicates an OCI image layout directory
+	ArchiveFormatOCI = "oci"
+	// ArchiveFormatOCIArchive indicates a tarball of an OCI image layout
+	ArchiveFormatOCIArchive = "oci-archive"
 )
 
+// archiveFormats lists all known archive formats, mountable ones first
+var archiveFormats = []ArchiveFormat{
+	ArchiveFormatSquashfs,
+	ArchiveFormatErofs,
+	ArchiveFormatTgz,
+	ArchiveFormatTarZstd,
+	ArchiveFormatTarXz,
+	ArchiveFormatOCI,
+	ArchiveFormatOCIArchive,
+}
+
 // UnmarshalJSON unmarshals an ArchiveFormat
 func (arf *ArchiveFormat) UnmarshalJSON(b []byte) error {
 	s := ""
 	if err := json.Unmarshal(b, &s); err != nil {
 		return err
 	}
-	switch s {
-	case ArchiveFormatTgz:
-		*arf = ArchiveFormatTgz
-	case ArchiveFormatSquashfs:
-		*arf = ArchiveFormatSquashfs
-	default:
-		return fmt.Errorf("could not unmarshal into ArchiveFormat: must be one of %q, %q", ArchiveFormatTgz, ArchiveFormatSquashfs)
+	for _, format := range archiveFormats {
+		if s == string(format) {
+			*arf = format
+			return nil
+		}
 	}
-	return nil
+	return fmt.Errorf("could not unmarshal into ArchiveFormat: must be one of %q", archiveFormats)
 }
 
 // UnmarshalJSON unmarshals an Archive, including defaulting the "format" field
@@ -134,6 +196,23 @@ func (arf ArchiveFormat) FileSuffix() string {
 	return fmt.Sprintf(".torcx.%s", arf)
 }
 
+// Mountable returns whether archives in this format are filesystem
+// images, loop-mounted rather than unpacked.
+func (arf ArchiveFormat) Mountable() bool {
+	return arf == ArchiveFormatSquashfs || arf == ArchiveFormatErofs
+}
+
+// ArchiveFormatFor returns the archive format for a file name,
+// based on its suffix.
+func ArchiveFormatFor(fileName string) ArchiveFormat {
+	for _, format := range archiveFormats {
+		if strings.HasSuffix(fileName, format.FileSuffix()) {
+			return format
+		}
+	}
+	return ArchiveFormatUnknown
+}
+
 // ToJSONV0 converts an internal Image into ImageV0.
 func (im Image) ToJSONV0() ImageV0 {
 	return ImageV0{
@@ -170,6 +249,26 @@ func ImageFromJSONV1(j ImageV1) Image {
 	return entry
 }
 
+// ToJSONV2 converts an internal Image into ImageV2.
+func (im Image) ToJSONV2() ImageV2 {
+	return ImageV2{
+		Name:      im.Name,
+		Reference: im.Reference,
+		Remote:    im.Remote,
+		Optional:  im.Optional,
+	}
+}
+
+// ImageFromJSONV2 converts an ImageV2 into an internal Image.
+func ImageFromJSONV2(j ImageV2) Image {
+	return Image{
+		Name:      j.Name,
+		Reference: j.Reference,
+		Remote:    j.Remote,
+		Optional:  j.Optional,
+	}
+}
+
 // ImagesToJSONV0 converts an internal Image list into ImagesV0.
 func ImagesToJSONV0(ims []Image) ImagesV0 {
 	j := ImagesV0{}
@@ -210,6 +309,26 @@ func ImagesFromJSONV1(j ImagesV1) []Image {
 	return result
 }
 
+// ImagesToJSONV2 converts an internal Image list into ImagesV2.
+func ImagesToJSONV2(ims []Image) ImagesV2 {
+	j := ImagesV2{}
+	for _, im := range ims {
+		entry := im.ToJSONV2()
+		j.Images = append(j.Images, entry)
+	}
+	return j
+}
+
+// ImagesFromJSONV2 converts an ImagesV2 into an internal Image list.
+func ImagesFromJSONV2(j ImagesV2) []Image {
+	result := []Image{}
+	for _, im := range j.Images {
+		entry := ImageFromJSONV2(im)
+		result = append(result, entry)
+	}
+	return result
+}
+
 // ImageManifestV0 holds JSON image manifest
 type ImageManifestV0 struct {
 	Kind  string `json:"kind"`
@@ -218,12 +337,49 @@ type ImageManifestV0 struct {
 
 // Assets holds lists of assets propagated from an image to the system
 type Assets struct {
-	Binaries  []string `json:"bin,omitempty"`
-	Network   []string `json:"network,omitempty"`
-	Units     []string `json:"units,omitempty"`
-	Sysusers  []string `json:"sysusers,omitempty"`
-	Tmpfiles  []string `json:"tmpfiles,omitempty"`
-	UdevRules []string `json:"udev_rules,omitempty"`
+	Binaries    []string `json:"bin,omitempty"`
+	Network     []string `json:"network,omitempty"`
+	Units       []string `json:"units,omitempty"`
+	Sysusers    []string `json:"sysusers,omitempty"`
+	Tmpfiles    []string `json:"tmpfiles,omitempty"`
+	UdevRules   []string `json:"udev_rules,omitempty"`
+	Sysctl      []string `json:"sysctl,omitempty"`
+	ModulesLoad []string `json:"modules_load,omitempty"`
+	Modprobe    []string `json:"modprobe,omitempty"`
+	Environment []string `json:"environment,omitempty"`
+	Presets     []string `json:"presets,omitempty"`
+}
+
+// ImageManifestV1 holds JSON image manifest (version 1)
+type ImageManifestV1 struct {
+	Kind  string               `json:"kind"`
+	Value ImageManifestV1Value `json:"value"`
+}
+
+// ImageManifestV1Value holds the assets, the dependencies and the
+// unit enablement of an image
+type ImageManifestV1Value struct {
+	Assets
+	Dependencies
+	Install []UnitInstall `json:"install,omitempty"`
+	// Templates are assets with torcx variables expanded when propagated
+	Templates []string `json:"templates,omitempty"`
+}
+
+// UnitInstall holds the install section of a unit shipped by an image,
+// as in `systemctl enable`.
+type UnitInstall struct {
+	Unit       string   `json:"unit"`
+	WantedBy   []string `json:"wanted_by,omitempty"`
+	RequiredBy []string `json:"required_by,omitempty"`
+}
+
+// Dependencies holds the constraints of an image on other images.
+// Names refer to image names or to names listed in `provides`.
+type Dependencies struct {
+	Requires  []string `json:"requires,omitempty"`
+	Conflicts []string `json:"conflicts,omitempty"`
+	Provides  []string `json:"provides,omitempty"`
 }
 
 type Remote struct {
@@ -281,19 +437,21 @@ type RemoteImage struct {
 
 // RemoteVersion describes a remote image archive.
 type RemoteVersion struct {
-	format   string
-	version  string
-	hash     string
-	location string
+	format         string
+	version        string
+	hash           string
+	location       string
+	verityRootHash string
 }
 
 // RemoteVersionFromJSONV1 translates a RemoteVersionV1 to an internal RemoteVersion.
 func RemoteVersionFromJSONV1(j RemoteVersionV1) RemoteVersion {
 	remoteVer := RemoteVersion{
-		format:   j.Format,
-		hash:     j.Hash,
-		location: j.Location,
-		version:  j.Version,
+		format:         j.Format,
+		hash:           j.Hash,
+		location:       j.Location,
+		version:        j.Version,
+		verityRootHash: j.VerityRootHash,
 	}
 	return remoteVer
 }
@@ -0,0 +1,260 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/coreos/torcx/internal/third_party/docker/pkg/loopback"
+	"github.com/coreos/torcx/pkg/verity"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// VerityHashTreeSuffix is the file suffix of dm-verity hash tree sidecars
+	VerityHashTreeSuffix = ".verity"
+	// VerityContentsSuffix is the file suffix of remote contents sidecars,
+	// holding the signed manifest a dm-verity root hash was fetched from
+	VerityContentsSuffix = ".contents.asc"
+
+	// squashfsMagic is "hsqs", little-endian
+	squashfsMagic = 0x73717368
+	// erofsMagic is the erofs superblock magic, at erofsSuperblockOffset
+	erofsMagic            = 0xE0F5E1E2
+	erofsSuperblockOffset = 1024
+	// appendedTreeAlign is the alignment of hash trees appended to archives
+	appendedTreeAlign = 4096
+)
+
+// verityRootHash returns the dm-verity root hash for image `im` in
+// `archive`: from the profile if set there, otherwise from the signed
+// remote contents it was fetched from. It returns nil if there is none,
+// and fails if the archive carries a hash tree without a root hash.
+func verityRootHash(cc *CommonConfig, archive Archive, im Image, profileHash string) ([]byte, error) {
+	rootHash := profileHash
+	if rootHash == "" {
+		var err error
+		if rootHash, err = remoteRootHash(cc, archive.Filepath, im); err != nil {
+			return nil, err
+		}
+	}
+	if rootHash == "" {
+		hasTree, err := hasHashTree(archive)
+		if err != nil {
+			return nil, err
+		}
+		if hasTree {
+			return nil, errors.Errorf("no verity root hash for %s, which carries a hash tree", archive.Filepath)
+		}
+		return nil, nil
+	}
+	root, err := hex.DecodeString(rootHash)
+	if err != nil || len(root) == 0 {
+		return nil, errors.Errorf("invalid verity root hash %q", rootHash)
+	}
+	return root, nil
+}
+
+// remoteRootHash returns the dm-verity root hash for image `im` from the
+// remote contents recorded next to the archive at `archivePath`, verified
+// again against the keys of its remote. It returns an empty string if
+// the archive was not fetched with a root hash.
+func remoteRootHash(cc *CommonConfig, archivePath string, im Image) (string, error) {
+	contentsPath := archivePath + VerityContentsSuffix
+	b, err := ioutil.ReadFile(contentsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if im.Remote == "" {
+		return "", errors.Errorf("no remote to verify %s", contentsPath)
+	}
+	remotePath := remoteManifestPath(cc.RemotesDirs(), im.Remote)
+	if remotePath == "" {
+		return "", errors.Errorf("manifest for remote %s not found", im.Remote)
+	}
+	_, keyrings, err := loadRemote(im.Remote, remotePath)
+	if err != nil {
+		return "", err
+	}
+	unwrapped, err := verifyManifest(im.Remote, string(b), keyrings)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to verify %s", contentsPath)
+	}
+	contents, err := decodeContents(unwrapped)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to decode %s", contentsPath)
+	}
+	_, version, err := contents.CheckAvailable(im)
+	if err != nil {
+		return "", errors.Wrapf(err, "inspecting %s", contentsPath)
+	}
+	if version.verityRootHash == "" {
+		return "", errors.Errorf("no verity root hash for %s:%s in %s", im.Name, im.Reference, contentsPath)
+	}
+	return version.verityRootHash, nil
+}
+
+// writeRemoteContents records the signed remote `contents` a dm-verity
+// root hash was fetched from, next to the archive at `archivePath`.
+// Empty contents remove any stale ones.
+func writeRemoteContents(archivePath string, contents string) error {
+	path := archivePath + VerityContentsSuffix
+	if contents == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(contents), 0644)
+}
+
+// hasHashTree returns whether `archive` carries a dm-verity hash tree,
+// in a sidecar file or appended to it.
+func hasHashTree(archive Archive) (bool, error) {
+	if _, err := os.Stat(archive.Filepath + VerityHashTreeSuffix); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+	fp, err := archive.open()
+	if err != nil {
+		return false, err
+	}
+	defer fp.Close()
+	offset, err := appendedTreeOffset(fp, archive.Format)
+	if err != nil {
+		return false, err
+	}
+	return verity.HasSuperblock(fp, offset), nil
+}
+
+// appendedTreeOffset returns the offset of a hash tree appended to
+// the filesystem in `fp`.
+func appendedTreeOffset(fp io.ReaderAt, format ArchiveFormat) (int64, error) {
+	size, err := filesystemSize(fp, format)
+	if err != nil {
+		return 0, err
+	}
+	return (size + appendedTreeAlign - 1) / appendedTreeAlign * appendedTreeAlign, nil
+}
+
+// filesystemSize returns the size of the filesystem in `fp`, as
+// recorded in its superblock.
+func filesystemSize(fp io.ReaderAt, format ArchiveFormat) (int64, error) {
+	buf := make([]byte, 48)
+	switch format {
+	case ArchiveFormatSquashfs:
+		if _, err := fp.ReadAt(buf, 0); err != nil {
+			return 0, errors.Wrap(err, "reading squashfs superblock")
+		}
+		if binary.LittleEndian.Uint32(buf[0:]) != squashfsMagic {
+			return 0, errors.New("not a squashfs archive")
+		}
+		return int64(binary.LittleEndian.Uint64(buf[40:])), nil
+	case ArchiveFormatErofs:
+		if _, err := fp.ReadAt(buf, erofsSuperblockOffset); err != nil {
+			return 0, errors.Wrap(err, "reading erofs superblock")
+		}
+		if binary.LittleEndian.Uint32(buf[0:]) != erofsMagic {
+			return 0, errors.New("not an erofs archive")
+		}
+		blkszbits := uint(buf[12])
+		return int64(binary.LittleEndian.Uint32(buf[36:])) << blkszbits, nil
+	}
+	return 0, errors.Errorf("no filesystem size for format %q", format)
+}
+
+// setupVerity sets up a dm-verity device for the squashfs or erofs
+// `archive`, attached to `dataDev`, recording it in the journal.
+// The hash tree is either in a sidecar file, or appended to the archive
+// at the first 4 KiB boundary after the filesystem. It returns the path
+// of the verity block device.
+func setupVerity(tx *journalTx, archive Archive, dataDev *os.File, imageName string, rootHash []byte) (devPath string, err error) {
+	archivePath := archive.Filepath
+	logFields := logrus.Fields{
+		"image": imageName,
+		"path":  archivePath,
+	}
+
+	var params *verity.Params
+	treePath := archivePath + VerityHashTreeSuffix
+	if _, err := os.Stat(treePath); err == nil {
+		treeFile, err := os.Open(treePath)
+		if err != nil {
+			return "", err
+		}
+		defer treeFile.Close()
+		sb, err := verity.ReadSuperblock(treeFile, 0)
+		if err != nil {
+			return "", errors.Wrapf(err, "hash tree %s", treePath)
+		}
+		hashDev, err := loopback.AttachLoopDevice(treePath)
+		if err != nil {
+			return "", errors.Wrapf(err, "attaching %q", treePath)
+		}
+		// The verity device holds a reference once set up
+		defer hashDev.Close()
+		defer func() {
+			if devPath == "" {
+				loopback.DetachLoopDevice(hashDev)
+			}
+		}()
+		if params, err = sb.Params(dataDev.Name(), hashDev.Name(), 0, rootHash); err != nil {
+			return "", err
+		}
+		logFields["tree"] = treePath
+	} else {
+		fp, err := archive.open()
+		if err != nil {
+			return "", err
+		}
+		defer fp.Close()
+		offset, err := appendedTreeOffset(fp, archive.Format)
+		if err != nil {
+			return "", err
+		}
+		sb, err := verity.ReadSuperblock(fp, offset)
+		if err != nil {
+			return "", errors.Wrapf(err, "no hash tree for %s", archivePath)
+		}
+		if sb.DataBlocks*uint64(sb.DataBlockSize) > uint64(offset) {
+			return "", errors.Errorf("hash tree overlaps data in %s", archivePath)
+		}
+		if params, err = sb.Params(dataDev.Name(), dataDev.Name(), offset, rootHash); err != nil {
+			return "", err
+		}
+		logFields["tree"] = "appended"
+	}
+
+	name := "torcx-" + imageName
+	// Record the device first, removing a missing one is harmless
+	if err := tx.record(JournalVerity, name); err != nil {
+		return "", err
+	}
+	if devPath, err = verity.Create(name, params); err != nil {
+		return "", err
+	}
+	logFields["device"] = devPath
+	logrus.WithFields(logFields).Debug("verity device set up")
+	return devPath, nil
+}
@@ -0,0 +1,154 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package torcx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func TestVerityRootHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torcx_test_verity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cc := &CommonConfig{
+		UsrDir:  filepath.Join(dir, "usr"),
+		ConfDir: filepath.Join(dir, "etc"),
+		Root:    dir,
+	}
+
+	// A remote, and contents signed with its key
+	pgpCfg := &packet.Config{RSABits: 1024}
+	signer, err := openpgp.NewEntity("torcx", "test", "torcx@example.com", pgpCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteDir := filepath.Join(cc.ConfDir, "remotes", "vendor")
+	if err := os.MkdirAll(remoteDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	var pubkey bytes.Buffer
+	wr, err := armor.Encode(&pubkey, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.Serialize(wr); err != nil {
+		t.Fatal(err)
+	}
+	wr.Close()
+	if err := ioutil.WriteFile(filepath.Join(remoteDir, "keys.asc"), pubkey.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	remote := `{"kind": "remote-manifest-v0", "value": {"base_url": "https://example.com", "keys": [{"armored_keyring": "keys.asc"}]}}`
+	if err := ioutil.WriteFile(filepath.Join(remoteDir, "remote.json"), []byte(remote), 0644); err != nil {
+		t.Fatal(err)
+	}
+	contents := `{"kind": "torcx-remote-contents-v1", "value": {"images": [{"name": "foo", "versions": [{"format": "squashfs", "hash": "", "location": "foo:1.torcx.squashfs", "version": "1", "verity_root_hash": "0102"}]}]}}`
+	var signed bytes.Buffer
+	plain, err := clearsign.Encode(&signed, signer.PrivateKey, pgpCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	plain.Close()
+	tampered := strings.Replace(signed.String(), "0102", "0304", 1)
+
+	// A squashfs archive, with or without an appended hash tree
+	archive := Archive{Filepath: filepath.Join(dir, "foo:1.torcx.squashfs"), Format: ArchiveFormatSquashfs}
+	sb := make([]byte, 48)
+	binary.LittleEndian.PutUint32(sb[0:], squashfsMagic)
+	binary.LittleEndian.PutUint64(sb[40:], uint64(len(sb)))
+	withTree := append(append(sb, make([]byte, appendedTreeAlign-len(sb))...), []byte("verity\x00\x00")...)
+
+	testCases := []struct {
+		desc     string
+		data     []byte
+		remote   string
+		contents string
+		profile  string
+		expected []byte
+		isError  bool
+	}{
+		{"none", sb, "vendor", "", "", nil, false},
+		{"profile", sb, "vendor", "", "0304", []byte{0x03, 0x04}, false},
+		{"invalid profile", sb, "vendor", "", "zz", nil, true},
+		{"remote", sb, "vendor", signed.String(), "", []byte{0x01, 0x02}, false},
+		{"profile over remote", sb, "vendor", signed.String(), "0304", []byte{0x03, 0x04}, false},
+		{"tampered remote", sb, "vendor", tampered, "", nil, true},
+		{"unknown remote", sb, "other", signed.String(), "", nil, true},
+		{"no remote", sb, "", signed.String(), "", nil, true},
+		{"tree without root hash", withTree, "vendor", "", "", nil, true},
+		{"tree with root hash", withTree, "vendor", "", "0304", []byte{0x03, 0x04}, false},
+	}
+
+	for _, tt := range testCases {
+		if err := ioutil.WriteFile(archive.Filepath, tt.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeRemoteContents(archive.Filepath, tt.contents); err != nil {
+			t.Fatal(err)
+		}
+		im := Image{Name: "foo", Reference: "1", Remote: tt.remote}
+		root, err := verityRootHash(cc, archive, im, tt.profile)
+		if (err != nil) != tt.isError {
+			t.Errorf("%s: unexpected error %v", tt.desc, err)
+		}
+		if !bytes.Equal(root, tt.expected) {
+			t.Errorf("%s: expected %x, got %x", tt.desc, tt.expected, root)
+		}
+	}
+}
+
+func TestFilesystemSize(t *testing.T) {
+	fp, err := ioutil.TempFile("", "torcx_test_fssize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+
+	sb := make([]byte, erofsSuperblockOffset+128)
+	binary.LittleEndian.PutUint32(sb[erofsSuperblockOffset:], erofsMagic)
+	sb[erofsSuperblockOffset+12] = 12
+	binary.LittleEndian.PutUint32(sb[erofsSuperblockOffset+36:], 3)
+	if _, err := fp.Write(sb); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := filesystemSize(fp, ArchiveFormatErofs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 3*4096 {
+		t.Errorf("expected size %d, got %d", 3*4096, size)
+	}
+	if _, err := filesystemSize(fp, ArchiveFormatSquashfs); err == nil {
+		t.Error("expected failure reading an erofs image as squashfs")
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"archive/tar"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
@@ -49,8 +50,20 @@ type ExtractCfg struct {
 	UIDShift uint
 	// GIDShift - positive increment to gid (requires Chown)
 	GIDShift uint
+	// Whiteouts - whether to apply OCI layer whiteouts, letting entries
+	// hide or replace existing ones from previous layers
+	Whiteouts bool
 }
 
+const (
+	// whiteoutPrefix marks an entry hiding the one with the same base name
+	whiteoutPrefix = ".wh."
+	// whiteoutMetaPrefix marks special whiteout entries
+	whiteoutMetaPrefix = ".wh..wh."
+	// whiteoutOpaque marks a directory hiding all previous content
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
 // Default returns a default configuration for extract operations
 func (ec ExtractCfg) Default() ExtractCfg {
 	return ExtractCfg{
@@ -79,12 +92,27 @@ func (ec ExtractCfg) Default() ExtractCfg {
 // Only numerical uid and gid are handled, no shift or name resolution
 // is applied.
 func ExtractRoot(tr *tar.Reader, cfg ExtractCfg) error {
-	targetDir := "/"
+	return Untar(tr, "/", cfg)
+}
 
+// Untar reads tar entries from r until EOF and creates filesystem
+// entries rooted in targetDir, as ExtractRoot does.
+// Paths and symlinks in the archive are resolved as if targetDir were
+// the filesystem root, so no entry can be created outside of it.
+// Unlike ChrootUntar, it does not change the root of the process and
+// can be used concurrently on different target directories.
+//
+// With Whiteouts set, the archive is handled as an OCI image layer
+// applied on top of the content of targetDir: whiteout entries are
+// processed once all other entries have been extracted, and only hide
+// content which was already there.
+func Untar(tr *tar.Reader, targetDir string, cfg ExtractCfg) error {
 	if tr == nil {
 		return fmt.Errorf("invalid tar reader")
 	}
 
+	var whiteouts []string
+	extracted := map[string]bool{}
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
@@ -94,68 +122,115 @@ func ExtractRoot(tr *tar.Reader, cfg ExtractCfg) error {
 			return err
 		}
 
-		err = extractOne(hdr, tr, targetDir, cfg)
+		if cfg.Whiteouts && strings.HasPrefix(filepath.Base(hdr.Name), whiteoutPrefix) {
+			whiteouts = append(whiteouts, filepath.Clean("/"+hdr.Name))
+			continue
+		}
+		path, err := extractOne(hdr, tr, targetDir, cfg)
 		if err != nil {
 			return err
 		}
+		extracted[path] = true
+	}
+	if len(whiteouts) > 0 {
+		return applyWhiteouts(targetDir, whiteouts, extracted)
 	}
 	return nil
 }
 
-func extractOne(hdr *tar.Header, r io.Reader, targetDir string, cfg ExtractCfg) error {
-	// Clean before joining to remove all .. elements
-	path := filepath.Join(targetDir, filepath.Clean(hdr.Name))
+// extractOne extracts a single entry, returning its path.
+func extractOne(hdr *tar.Header, r io.Reader, targetDir string, cfg ExtractCfg) (string, error) {
+	name := filepath.Clean("/" + hdr.Name)
 	fi := hdr.FileInfo()
 
+	// Directories may be reached through symlinks, other entries
+	// replace whatever is found at their path.
+	var path string
+	if hdr.Typeflag == tar.TypeDir {
+		p, err := resolveInRoot(targetDir, name)
+		if err != nil {
+			return "", err
+		}
+		path = p
+		if cur, err := os.Lstat(path); cfg.Whiteouts && err == nil && !cur.IsDir() {
+			if err := os.Remove(path); err != nil {
+				return "", err
+			}
+		}
+	} else {
+		if name == "/" {
+			return "", nil
+		}
+		parent, err := resolveInRoot(targetDir, filepath.Dir(name))
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(parent, filepath.Base(name))
+		if cur, err := os.Lstat(path); err == nil && !cur.IsDir() {
+			if err := os.Remove(path); err != nil {
+				return "", err
+			}
+		} else if err == nil && cfg.Whiteouts {
+			// A directory from a previous layer
+			if err := os.RemoveAll(path); err != nil {
+				return "", err
+			}
+		}
+	}
+
 	// Extract entry
 	switch hdr.Typeflag {
 	case tar.TypeReg, tar.TypeRegA:
 		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, fi.Mode())
 		if err != nil {
-			return err
+			return "", err
 		}
 		if _, err = io.Copy(f, r); err != nil {
-			return err
+			return "", err
 		}
 		if err = f.Close(); err != nil {
-			return err
+			return "", err
 		}
 	case tar.TypeLink:
 		if !cfg.HardLink {
-			return nil
+			return "", nil
+		}
+		linkPath, err := resolveInRoot(targetDir, hdr.Linkname)
+		if err != nil {
+			return "", err
 		}
 		// Skip adjusting metadata below for hardlinks
-		return os.Link(hdr.Linkname, path)
+		return path, os.Link(linkPath, path)
 	case tar.TypeSymlink:
 		if !cfg.Symlink {
-			return nil
+			return "", nil
 		}
 		// Skip adjusting metadata below for symlinks
-		return os.Symlink(hdr.Linkname, path)
+		return path, os.Symlink(hdr.Linkname, path)
 	case tar.TypeDir:
 		if err := os.MkdirAll(path, fi.Mode()); err != nil {
-			return err
+			return "", err
 		}
 	case tar.TypeChar:
 		dev := makedev(uint(hdr.Devmajor), uint(hdr.Devminor))
 		mode := uint32(fi.Mode()) | unix.S_IFCHR
 		if err := unix.Mknod(path, mode, int(dev)); err != nil {
-			return err
+			return "", err
 		}
 	case tar.TypeBlock:
 		dev := makedev(uint(hdr.Devmajor), uint(hdr.Devminor))
 		mode := uint32(fi.Mode()) | unix.S_IFBLK
 		if err := unix.Mknod(path, mode, int(dev)); err != nil {
-			return err
+			return "", err
 		}
 	case tar.TypeFifo:
 		if err := unix.Mkfifo(path, uint32(fi.Mode())); err != nil {
-			return err
+			return "", err
 		}
 	case tar.TypeCont, tar.TypeXHeader, tar.TypeXGlobalHeader:
-		return nil
+		return "", nil
 	default:
-		return fmt.Errorf("extract: unrecognized type %q: %s", hdr.Typeflag, hdr.Name)
+		return "", fmt.Errorf("extract: unrecognized type %q: %s", hdr.Typeflag, hdr.Name)
 
 	}
 
@@ -169,20 +244,20 @@ func extractOne(hdr *tar.Header, r io.Reader, targetDir string, cfg ExtractCfg)
 			mtime = time.Now()
 		}
 		if err := os.Chtimes(path, atime, mtime); err != nil {
-			return err
+			return "", err
 		}
 	}
 	if cfg.Chmod {
 		mode := os.FileMode(hdr.Mode)
 		if err := os.Chmod(path, mode); err != nil {
-			return err
+			return "", err
 		}
 	}
 	if cfg.Chown {
 		origUID, oriGGID := hdr.Uid, hdr.Gid
 		uid, gid := origUID+int(cfg.UIDShift), oriGGID+int(cfg.GIDShift)
 		if err := os.Lchown(path, uid, gid); err != nil {
-			return err
+			return "", err
 		}
 	}
 	if cfg.XattrPrivileged || cfg.XattrUser {
@@ -196,11 +271,80 @@ func extractOne(hdr *tar.Header, r io.Reader, targetDir string, cfg ExtractCfg)
 
 			err := unix.Setxattr(path, k, []byte(v), 0)
 			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return path, nil
+}
+
+// applyWhiteouts removes the content hidden by whiteout entries, which
+// are absolute paths in the archive. Entries in `extracted` come from
+// the same layer and are kept, along with their parent directories.
+func applyWhiteouts(targetDir string, whiteouts []string, extracted map[string]bool) error {
+	kept := map[string]bool{}
+	for p := range extracted {
+		for ; p != targetDir && p != "/" && p != "."; p = filepath.Dir(p) {
+			kept[p] = true
+		}
+	}
+
+	for _, wh := range whiteouts {
+		dir, err := resolveInRoot(targetDir, filepath.Dir(wh))
+		if err != nil {
+			return err
+		}
+		base := filepath.Base(wh)
+		switch {
+		case base == whiteoutOpaque:
+			if err := clearLowerContent(dir, kept); err != nil {
 				return err
 			}
+		case strings.HasPrefix(base, whiteoutMetaPrefix):
+			continue
+		default:
+			path := filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+			if !kept[path] {
+				if err := os.RemoveAll(path); err != nil {
+					return err
+				}
+				continue
+			}
+			if fi, err := os.Lstat(path); err == nil && fi.IsDir() {
+				if err := clearLowerContent(path, kept); err != nil {
+					return err
+				}
+			}
 		}
 	}
+	return nil
+}
 
+// clearLowerContent removes everything below `dir` which does not come
+// from the current layer.
+func clearLowerContent(dir string, kept map[string]bool) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range infos {
+		path := filepath.Join(dir, fi.Name())
+		if !kept[path] {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if fi.IsDir() {
+			if err := clearLowerContent(path, kept); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -209,3 +353,52 @@ func makedev(maj uint, min uint) uint64 {
 		((uint64(min) & ^uint64(0xff)) << 12) |
 		((uint64(maj) & ^uint64(0xfff)) << 32)
 }
+
+// maxSymlinkHops is the maximum number of symlinks followed while
+// resolving a single path.
+const maxSymlinkHops = 255
+
+// resolveInRoot resolves `name` as if `root` were the filesystem root,
+// following symlinks without ever escaping it. Missing path components
+// are joined as they are.
+func resolveInRoot(root, name string) (string, error) {
+	resolved := "/"
+	pending := strings.Split(name, "/")
+	hops := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if os.IsNotExist(err) || (err == nil && fi.Mode()&os.ModeSymlink == 0) {
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symbolic links: %s", name)
+		}
+		dest, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(dest) {
+			resolved = "/"
+		}
+		pending = append(strings.Split(dest, "/"), pending...)
+	}
+
+	return filepath.Join(root, resolved), nil
+}
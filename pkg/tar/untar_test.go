@@ -0,0 +1,133 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tar
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUntarStaysInRoot(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "torcx-untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	root := filepath.Join(tmp, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []tar.Header{
+		{Name: "./abs", Typeflag: tar.TypeSymlink, Linkname: "/"},
+		{Name: "./rel", Typeflag: tar.TypeSymlink, Linkname: "../../.."},
+		{Name: "./abs/a", Typeflag: tar.TypeReg},
+		{Name: "./rel/b", Typeflag: tar.TypeReg},
+		{Name: "../c", Typeflag: tar.TypeReg},
+		{Name: "./abs/d/", Typeflag: tar.TypeDir, Mode: 0755},
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range entries {
+		hdr := hdr
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ExtractCfg{Symlink: true}
+	if err := Untar(tar.NewReader(&buf), root, cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"a", "b", "c", "d"} {
+		if _, err := os.Lstat(filepath.Join(root, p)); err != nil {
+			t.Errorf("expected %q inside root: %s", p, err)
+		}
+		if _, err := os.Lstat(filepath.Join(tmp, p)); err == nil {
+			t.Errorf("unexpected %q outside root", p)
+		}
+	}
+}
+
+func TestUntarWhiteouts(t *testing.T) {
+	root, err := ioutil.TempDir("", "torcx-untar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	layers := [][]tar.Header{
+		{
+			{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "b/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "c/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "a/x", Typeflag: tar.TypeReg},
+			{Name: "a/y", Typeflag: tar.TypeReg},
+			{Name: "b/z", Typeflag: tar.TypeReg},
+			{Name: "c/old", Typeflag: tar.TypeReg},
+			{Name: "d", Typeflag: tar.TypeReg},
+		},
+		{
+			{Name: "a/.wh.x", Typeflag: tar.TypeReg},
+			{Name: "b/new", Typeflag: tar.TypeReg},
+			{Name: "b/.wh..wh..opq", Typeflag: tar.TypeReg},
+			{Name: ".wh.c", Typeflag: tar.TypeReg},
+			{Name: "d/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "d/f", Typeflag: tar.TypeReg},
+		},
+	}
+	cfg := ExtractCfg{Whiteouts: true}
+	for _, entries := range layers {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range entries {
+			hdr := hdr
+			if hdr.Mode == 0 {
+				hdr.Mode = 0644
+			}
+			if err := tw.WriteHeader(&hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := Untar(tar.NewReader(&buf), root, cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, p := range []string{"a/y", "b/new", "d/f"} {
+		if _, err := os.Lstat(filepath.Join(root, p)); err != nil {
+			t.Errorf("expected %q: %s", p, err)
+		}
+	}
+	for _, p := range []string{"a/x", "a/.wh.x", "b/z", "b/.wh..wh..opq", "c"} {
+		if _, err := os.Lstat(filepath.Join(root, p)); err == nil {
+			t.Errorf("unexpected %q", p)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verity
+
+import (
+	"fmt"
+	"os"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// dmControl is the device-mapper control device
+	dmControl = "/dev/mapper/control"
+
+	dmVersionMajor = 4
+	dmReadonlyFlag = 1 << 0
+
+	dmDevCreate  = 3
+	dmDevRemove  = 4
+	dmDevSuspend = 6
+	dmTableLoad  = 9
+)
+
+// dmIoctl mirrors `struct dm_ioctl` from linux/dm-ioctl.h.
+type dmIoctl struct {
+	Version     [3]uint32
+	DataSize    uint32
+	DataStart   uint32
+	TargetCount uint32
+	OpenCount   int32
+	Flags       uint32
+	EventNr     uint32
+	Padding     uint32
+	Dev         uint64
+	Name        [128]byte
+	UUID        [129]byte
+	Data        [7]byte
+}
+
+// dmTargetSpec mirrors `struct dm_target_spec` from linux/dm-ioctl.h.
+type dmTargetSpec struct {
+	SectorStart uint64
+	Length      uint64
+	Status      int32
+	Next        uint32
+	TargetType  [16]byte
+}
+
+// dmRequest returns the ioctl request number for a device-mapper command.
+func dmRequest(cmd uintptr) uintptr {
+	// _IOWR(DM_IOCTL, cmd, struct dm_ioctl)
+	return 3<<30 | unsafe.Sizeof(dmIoctl{})<<16 | 0xfd<<8 | cmd
+}
+
+// dmBuffer builds an ioctl buffer for device `name`, with an optional
+// verity target appended.
+func dmBuffer(name string, flags uint32, p *Params) ([]byte, error) {
+	if name == "" || len(name) >= 128 {
+		return nil, errors.Errorf("invalid device name %q", name)
+	}
+	hdrSize := int(unsafe.Sizeof(dmIoctl{}))
+	specSize := int(unsafe.Sizeof(dmTargetSpec{}))
+	size := hdrSize
+	table := ""
+	if p != nil {
+		table = p.Table()
+		// Parameters are NUL-terminated, padded to 8 bytes
+		size += (specSize + len(table) + 1 + 7) &^ 7
+	}
+	// Some room for data returned by the kernel
+	buf := make([]byte, size+16*1024)
+
+	hdr := (*dmIoctl)(unsafe.Pointer(&buf[0]))
+	hdr.Version = [3]uint32{dmVersionMajor, 0, 0}
+	hdr.DataSize = uint32(len(buf))
+	hdr.DataStart = uint32(hdrSize)
+	hdr.Flags = flags
+	copy(hdr.Name[:], name)
+	if p != nil {
+		hdr.TargetCount = 1
+		spec := (*dmTargetSpec)(unsafe.Pointer(&buf[hdrSize]))
+		spec.Length = p.Sectors()
+		copy(spec.TargetType[:], "verity")
+		copy(buf[hdrSize+specSize:], table)
+	}
+	return buf, nil
+}
+
+// dmCall performs a device-mapper ioctl on `buf`.
+func dmCall(cmd uintptr, buf []byte) error {
+	fp, err := os.OpenFile(dmControl, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fp.Fd(), dmRequest(cmd), uintptr(unsafe.Pointer(&buf[0]))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Create sets up a read-only verity device `name` with parameters `p`,
+// returning the path to its block device.
+func Create(name string, p *Params) (string, error) {
+	if p == nil {
+		return "", errors.New("missing verity parameters")
+	}
+	buf, err := dmBuffer(name, 0, nil)
+	if err != nil {
+		return "", err
+	}
+	if err := dmCall(dmDevCreate, buf); err != nil {
+		return "", errors.Wrapf(err, "creating device %q", name)
+	}
+	dev := (*dmIoctl)(unsafe.Pointer(&buf[0])).Dev
+
+	if err := loadAndResume(name, p); err != nil {
+		if rmErr := Remove(name); rmErr != nil {
+			return "", errors.Wrapf(err, "cleanup failed (%s)", rmErr)
+		}
+		return "", err
+	}
+
+	// Device nodes are created by devtmpfs, without udev
+	return fmt.Sprintf("/dev/dm-%d", unix.Minor(dev)), nil
+}
+
+// loadAndResume loads the verity table into device `name` and activates it.
+func loadAndResume(name string, p *Params) error {
+	buf, err := dmBuffer(name, dmReadonlyFlag, p)
+	if err != nil {
+		return err
+	}
+	if err := dmCall(dmTableLoad, buf); err != nil {
+		return errors.Wrapf(err, "loading table for %q", name)
+	}
+	if buf, err = dmBuffer(name, 0, nil); err != nil {
+		return err
+	}
+	if err := dmCall(dmDevSuspend, buf); err != nil {
+		return errors.Wrapf(err, "activating %q", name)
+	}
+	return nil
+}
+
+// Remove removes the device-mapper device `name`. It is not an error
+// if the device (or device-mapper itself) does not exist.
+func Remove(name string) error {
+	buf, err := dmBuffer(name, 0, nil)
+	if err != nil {
+		return err
+	}
+	if err := dmCall(dmDevRemove, buf); err != nil && err != unix.ENXIO && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "removing device %q", name)
+	}
+	return nil
+}
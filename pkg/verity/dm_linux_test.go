@@ -0,0 +1,69 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDmBuffer(t *testing.T) {
+	if req := dmRequest(dmTableLoad); req != 0xc138fd09 {
+		t.Errorf("unexpected DM_TABLE_LOAD request %#x", req)
+	}
+
+	p := &Params{
+		DataDevice:    "/dev/loop0",
+		HashDevice:    "/dev/loop1",
+		DataBlockSize: 4096,
+		HashBlockSize: 4096,
+		DataBlocks:    8,
+		Algorithm:     "sha256",
+		RootHash:      []byte{0x01},
+	}
+	buf, err := dmBuffer("torcx-foo", dmReadonlyFlag, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	if v := le.Uint32(buf[0:]); v != dmVersionMajor {
+		t.Errorf("unexpected version %d", v)
+	}
+	if start := le.Uint32(buf[16:]); start != 312 {
+		t.Errorf("unexpected data start %d", start)
+	}
+	if count := le.Uint32(buf[20:]); count != 1 {
+		t.Errorf("unexpected target count %d", count)
+	}
+	if name := string(bytes.TrimRight(buf[48:176], "\x00")); name != "torcx-foo" {
+		t.Errorf("unexpected name %q", name)
+	}
+	spec := buf[312:]
+	if length := le.Uint64(spec[8:]); length != 64 {
+		t.Errorf("unexpected target length %d", length)
+	}
+	if target := string(bytes.TrimRight(spec[24:40], "\x00")); target != "verity" {
+		t.Errorf("unexpected target type %q", target)
+	}
+	params := string(spec[40 : 40+bytes.IndexByte(spec[40:], 0)])
+	if params != p.Table() {
+		t.Errorf("unexpected parameters %q", params)
+	}
+
+	if _, err := dmBuffer("", 0, nil); err == nil {
+		t.Error("expected failure for an empty name")
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verity
+
+import (
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// FormatConfig holds parameters for a new hash tree.
+type FormatConfig struct {
+	// Algorithm defaults to sha256
+	Algorithm string
+	// DataBlockSize and HashBlockSize default to 4096
+	DataBlockSize uint32
+	HashBlockSize uint32
+	// Salt defaults to 32 random bytes
+	Salt []byte
+}
+
+// Format computes the hash tree for the first `dataSize` bytes of
+// `data` and writes it with its superblock to `hash` at `hashOffset`,
+// like `veritysetup format`. It returns the superblock and root hash.
+func Format(data io.ReaderAt, dataSize int64, hash io.WriterAt, hashOffset int64, cfg FormatConfig) (*Superblock, []byte, error) {
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = "sha256"
+	}
+	if cfg.DataBlockSize == 0 {
+		cfg.DataBlockSize = 4096
+	}
+	if cfg.HashBlockSize == 0 {
+		cfg.HashBlockSize = 4096
+	}
+	if cfg.Salt == nil {
+		cfg.Salt = make([]byte, 32)
+		if _, err := rand.Read(cfg.Salt); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(cfg.Salt) > maxSaltSize {
+		return nil, nil, errors.Errorf("salt too long (%d bytes)", len(cfg.Salt))
+	}
+
+	sb := Superblock{
+		Signature:     sbSignature,
+		Version:       1,
+		HashType:      HashTypeNormal,
+		DataBlockSize: cfg.DataBlockSize,
+		HashBlockSize: cfg.HashBlockSize,
+		SaltSize:      uint16(len(cfg.Salt)),
+	}
+	copy(sb.Algorithm[:], cfg.Algorithm)
+	copy(sb.Salt[:], cfg.Salt)
+	if _, err := rand.Read(sb.UUID[:]); err != nil {
+		return nil, nil, err
+	}
+	if err := sb.validate(); err != nil {
+		return nil, nil, err
+	}
+	if dataSize <= 0 || dataSize%int64(cfg.DataBlockSize) != 0 {
+		return nil, nil, errors.Errorf("data size %d is not a multiple of the data block size", dataSize)
+	}
+	if hashOffset%int64(cfg.HashBlockSize) != 0 {
+		return nil, nil, errors.Errorf("hash offset %d not aligned to hash block size", hashOffset)
+	}
+	sb.DataBlocks = uint64(dataSize / int64(cfg.DataBlockSize))
+	h, _ := hashFor(cfg.Algorithm)
+
+	// Digests are stored in power-of-two slots
+	slot := 1
+	for slot < h.Size() {
+		slot <<= 1
+	}
+	hashBlock := func(block []byte) []byte {
+		hh := h.New()
+		hh.Write(cfg.Salt)
+		hh.Write(block)
+		return hh.Sum(nil)
+	}
+	// hashLevel hashes `count` blocks of size `bs` read by `readBlock`,
+	// packing digests into hash blocks.
+	hashLevel := func(count uint64, bs uint32, readBlock func(i uint64, buf []byte) error) ([]byte, error) {
+		perBlock := uint64(cfg.HashBlockSize) / uint64(slot)
+		blocks := (count + perBlock - 1) / perBlock
+		level := make([]byte, blocks*uint64(cfg.HashBlockSize))
+		buf := make([]byte, bs)
+		for i := uint64(0); i < count; i++ {
+			if err := readBlock(i, buf); err != nil {
+				return nil, err
+			}
+			copy(level[i*uint64(slot):], hashBlock(buf))
+		}
+		return level, nil
+	}
+
+	readData := func(i uint64, buf []byte) error {
+		_, err := data.ReadAt(buf, int64(i)*int64(cfg.DataBlockSize))
+		return err
+	}
+	if sb.DataBlocks == 1 {
+		// A single data block is directly covered by the root hash
+		buf := make([]byte, cfg.DataBlockSize)
+		if err := readData(0, buf); err != nil {
+			return nil, nil, errors.Wrap(err, "reading data")
+		}
+		return &sb, hashBlock(buf), writeTree(hash, hashOffset, &sb, nil)
+	}
+
+	levels := [][]byte{}
+	cur, err := hashLevel(sb.DataBlocks, cfg.DataBlockSize, readData)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "reading data")
+	}
+	for {
+		levels = append(levels, cur)
+		if len(cur) == int(cfg.HashBlockSize) {
+			break
+		}
+		prev := cur
+		readPrev := func(i uint64, buf []byte) error {
+			copy(buf, prev[i*uint64(cfg.HashBlockSize):])
+			return nil
+		}
+		cur, _ = hashLevel(uint64(len(prev))/uint64(cfg.HashBlockSize), cfg.HashBlockSize, readPrev)
+	}
+	root := hashBlock(levels[len(levels)-1])
+	return &sb, root, writeTree(hash, hashOffset, &sb, levels)
+}
+
+// writeTree writes the superblock, padded to a hash block, followed
+// by hash tree levels from the top one down to the one covering data.
+func writeTree(w io.WriterAt, offset int64, sb *Superblock, levels [][]byte) error {
+	header, err := sb.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	header = append(header, make([]byte, int(sb.HashBlockSize)-len(header))...)
+	if _, err := w.WriteAt(header, offset); err != nil {
+		return errors.Wrap(err, "writing verity superblock")
+	}
+	offset += int64(len(header))
+	for i := len(levels) - 1; i >= 0; i-- {
+		if _, err := w.WriteAt(levels[i], offset); err != nil {
+			return errors.Wrap(err, "writing hash tree")
+		}
+		offset += int64(len(levels[i]))
+	}
+	return nil
+}
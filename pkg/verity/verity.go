@@ -0,0 +1,188 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package verity handles dm-verity hash trees, in the on-disk format
+// used by veritysetup, and sets up verity devices via device-mapper.
+package verity
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1" // hash algorithms supported by dm-verity
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// SuperblockSize is the size of an on-disk verity superblock
+	SuperblockSize = 512
+	// HashTypeNormal is the hash format version for non-ChromeOS trees,
+	// where the salt is prepended to each hashed block
+	HashTypeNormal = 1
+
+	sectorSize   = 512
+	maxSaltSize  = 256
+	maxBlockSize = 1 << 20
+)
+
+var sbSignature = [8]byte{'v', 'e', 'r', 'i', 't', 'y', 0, 0}
+
+// Superblock is the on-disk header of a hash tree, as written by veritysetup.
+type Superblock struct {
+	Signature     [8]byte
+	Version       uint32
+	HashType      uint32
+	UUID          [16]byte
+	Algorithm     [32]byte
+	DataBlockSize uint32
+	HashBlockSize uint32
+	DataBlocks    uint64
+	SaltSize      uint16
+	_             [6]byte
+	Salt          [maxSaltSize]byte
+	_             [168]byte
+}
+
+// ReadSuperblock reads and validates the superblock at `offset`.
+func ReadSuperblock(r io.ReaderAt, offset int64) (*Superblock, error) {
+	buf := make([]byte, SuperblockSize)
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, errors.Wrap(err, "reading verity superblock")
+	}
+	var sb Superblock
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &sb); err != nil {
+		return nil, err
+	}
+	if sb.Signature != sbSignature {
+		return nil, errors.New("missing verity superblock")
+	}
+	if err := sb.validate(); err != nil {
+		return nil, err
+	}
+	return &sb, nil
+}
+
+// HasSuperblock returns whether a superblock signature is present at
+// `offset`, without validating the superblock.
+func HasSuperblock(r io.ReaderAt, offset int64) bool {
+	var sig [8]byte
+	if _, err := r.ReadAt(sig[:], offset); err != nil {
+		return false
+	}
+	return sig == sbSignature
+}
+
+// validate checks that superblock parameters are supported.
+func (sb *Superblock) validate() error {
+	if sb.Version != 1 {
+		return errors.Errorf("unsupported verity superblock version %d", sb.Version)
+	}
+	if sb.HashType != HashTypeNormal {
+		return errors.Errorf("unsupported verity hash type %d", sb.HashType)
+	}
+	for _, bs := range []uint32{sb.DataBlockSize, sb.HashBlockSize} {
+		if bs < sectorSize || bs > maxBlockSize || bs&(bs-1) != 0 {
+			return errors.Errorf("invalid verity block size %d", bs)
+		}
+	}
+	if sb.SaltSize > maxSaltSize {
+		return errors.Errorf("invalid verity salt size %d", sb.SaltSize)
+	}
+	if _, err := hashFor(sb.AlgorithmName()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AlgorithmName returns the hash algorithm name (e.g. "sha256").
+func (sb *Superblock) AlgorithmName() string {
+	return string(bytes.TrimRight(sb.Algorithm[:], "\x00"))
+}
+
+// MarshalBinary encodes the superblock in its on-disk format.
+func (sb *Superblock) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, sb); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Params holds the parameters of a dm-verity target.
+type Params struct {
+	DataDevice     string
+	HashDevice     string
+	DataBlockSize  uint32
+	HashBlockSize  uint32
+	DataBlocks     uint64
+	HashStartBlock uint64
+	Algorithm      string
+	RootHash       []byte
+	Salt           []byte
+}
+
+// Params returns the target parameters for a hash tree with this
+// superblock at `hashOffset` on `hashDev`, protecting `dataDev`.
+func (sb *Superblock) Params(dataDev, hashDev string, hashOffset int64, rootHash []byte) (*Params, error) {
+	if hashOffset < 0 || hashOffset%int64(sb.HashBlockSize) != 0 {
+		return nil, errors.Errorf("hash offset %d not aligned to hash block size", hashOffset)
+	}
+	return &Params{
+		DataDevice:     dataDev,
+		HashDevice:     hashDev,
+		DataBlockSize:  sb.DataBlockSize,
+		HashBlockSize:  sb.HashBlockSize,
+		DataBlocks:     sb.DataBlocks,
+		HashStartBlock: uint64(hashOffset)/uint64(sb.HashBlockSize) + 1,
+		Algorithm:      sb.AlgorithmName(),
+		RootHash:       rootHash,
+		Salt:           append([]byte{}, sb.Salt[:sb.SaltSize]...),
+	}, nil
+}
+
+// Sectors returns the size of the protected data, in 512-byte sectors.
+func (p *Params) Sectors() uint64 {
+	return p.DataBlocks * uint64(p.DataBlockSize) / sectorSize
+}
+
+// Table returns the device-mapper table parameters of the verity target.
+func (p *Params) Table() string {
+	salt := "-"
+	if len(p.Salt) > 0 {
+		salt = hex.EncodeToString(p.Salt)
+	}
+	return fmt.Sprintf("%d %s %s %d %d %d %d %s %s %s",
+		HashTypeNormal, p.DataDevice, p.HashDevice,
+		p.DataBlockSize, p.HashBlockSize, p.DataBlocks, p.HashStartBlock,
+		p.Algorithm, hex.EncodeToString(p.RootHash), salt)
+}
+
+// hashFor returns the hash function for a dm-verity algorithm name.
+func hashFor(algorithm string) (crypto.Hash, error) {
+	h, ok := map[string]crypto.Hash{
+		"sha1":   crypto.SHA1,
+		"sha256": crypto.SHA256,
+		"sha512": crypto.SHA512,
+	}[algorithm]
+	if !ok || !h.Available() {
+		return 0, errors.Errorf("unsupported verity hash algorithm %q", algorithm)
+	}
+	return h, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 CoreOS Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package verity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// hashBlocks returns the salted sha256 digests of `data` blocks, packed
+// into a zero-padded 4096-byte hash block.
+func hashBlocks(salt []byte, data []byte, count int) []byte {
+	block := make([]byte, 4096)
+	for i := 0; i < count; i++ {
+		d := sha256.Sum256(append(append([]byte{}, salt...), data[i*4096:(i+1)*4096]...))
+		copy(block[i*32:], d[:])
+	}
+	return block
+}
+
+func TestFormat(t *testing.T) {
+	salt := bytes.Repeat([]byte{0x5a}, 32)
+	fp, err := ioutil.TempFile("", "torcx_test_verity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+
+	testCases := []struct {
+		blocks     int
+		hashBlocks int
+	}{
+		{1, 0},
+		{2, 1},
+		{200, 3},
+	}
+
+	for _, tt := range testCases {
+		data := make([]byte, tt.blocks*4096)
+		for i := range data {
+			data[i] = byte(i / 4096)
+		}
+		hashOffset := int64(len(data))
+		if err := fp.Truncate(0); err != nil {
+			t.Fatal(err)
+		}
+		sb, root, err := Format(bytes.NewReader(data), int64(len(data)), fp, hashOffset, FormatConfig{Salt: salt})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sb.DataBlocks != uint64(tt.blocks) {
+			t.Errorf("%d blocks: got %d data blocks", tt.blocks, sb.DataBlocks)
+		}
+		fi, _ := fp.Stat()
+		if expected := hashOffset + int64(4096*(1+tt.hashBlocks)); fi.Size() != expected {
+			t.Errorf("%d blocks: expected %d bytes, got %d", tt.blocks, expected, fi.Size())
+		}
+
+		// Recompute the root hash for trees of up to 128 blocks
+		if tt.blocks <= 2 {
+			var expected [32]byte
+			if tt.blocks == 1 {
+				expected = sha256.Sum256(append(append([]byte{}, salt...), data...))
+			} else {
+				expected = sha256.Sum256(append(append([]byte{}, salt...), hashBlocks(salt, data, tt.blocks)...))
+			}
+			if !bytes.Equal(root, expected[:]) {
+				t.Errorf("%d blocks: expected root hash %x, got %x", tt.blocks, expected, root)
+			}
+		}
+
+		read, err := ReadSuperblock(fp, hashOffset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *read != *sb {
+			t.Errorf("%d blocks: superblock mismatch", tt.blocks)
+		}
+	}
+}
+
+func TestParamsTable(t *testing.T) {
+	sb := Superblock{
+		Signature:     sbSignature,
+		Version:       1,
+		HashType:      HashTypeNormal,
+		DataBlockSize: 4096,
+		HashBlockSize: 4096,
+		DataBlocks:    256,
+		SaltSize:      2,
+	}
+	copy(sb.Algorithm[:], "sha256")
+	copy(sb.Salt[:], []byte{0xab, 0xcd})
+
+	if _, err := sb.Params("/dev/loop0", "/dev/loop0", 100, []byte{0x01}); err == nil {
+		t.Error("expected failure for unaligned hash offset")
+	}
+	p, err := sb.Params("/dev/loop0", "/dev/loop0", 256*4096, []byte{0x01, 0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "1 /dev/loop0 /dev/loop0 4096 4096 256 257 sha256 0102 abcd"
+	if table := p.Table(); table != expected {
+		t.Errorf("expected table %q, got %q", expected, table)
+	}
+	if p.Sectors() != 2048 {
+		t.Errorf("expected 2048 sectors, got %d", p.Sectors())
+	}
+}
@@ -21,15 +21,15 @@ declare -A versions
 ## Scan for images
 
 scan_assets() {
-  for path in $("${BIN_FIND}" "${ASSETS_PATH}" -type f \( -name '*:*.torcx.tgz' -o -name '*:*.torcx.squashfs' \) -printf '%P\n'); do
+  for path in $("${BIN_FIND}" "${ASSETS_PATH}" -type f \( -name '*:*.torcx.tgz' -o -name '*:*.torcx.tar.zst' -o -name '*:*.torcx.tar.xz' -o -name '*:*.torcx.squashfs' -o -name '*:*.torcx.erofs' -o -name '*:*.torcx.oci-archive' \) -printf '%P\n'); do
     local img namever name version format shahash namehash seen
     img="$(echo "${path}" | rev | cut -d'/' -f 1 | rev)"
-    namever="$(echo "${img}" | rev | cut -d'.' -f 3- | rev)"
+    namever="${img%.torcx.*}"
 
     # Extract image properties from filepath
     name="$(echo "${namever}" | cut -d':' -f 1)"
     version="$(echo "${namever}" | cut -d':' -f 2)"
-    format="$(echo "${img}" | rev | cut -d'.' -f 1 | rev)"
+    format="${img##*.torcx.}"
     shahash="sha512-$("${BIN_SHASUM}" "${ASSETS_PATH}"/"${path}" | cut -d' ' -f 1)"
 
     # Record properties in keyed maps